@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -15,11 +16,13 @@ import (
 	"github.com/dpinela/mflg/internal/buffer"
 	"github.com/dpinela/mflg/internal/config"
 	"github.com/dpinela/mflg/internal/highlight"
+	"github.com/dpinela/mflg/internal/merge"
 	"github.com/dpinela/mflg/internal/pathwatch"
 	"github.com/dpinela/mflg/internal/termdraw"
 	"github.com/dpinela/mflg/internal/termesc"
 
 	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
 )
 
 type application struct {
@@ -30,15 +33,38 @@ type application struct {
 	cursorVisible            bool
 	screen                   *termdraw.Screen
 	promptHandler            func(string) // What to do with the prompt input when the user hits Enter
+	promptCancelHandler      func()       // If not nil, what to do when the user dismisses the prompt
+	completion               *completionPopup
+	list                     *listView // If not nil, a list the user is picking an entry from
 	note                     string
 	noteClearTimer           timer
 
-	saveDelay      time.Duration
-	saveTimer      timer
-	taskQueue      chan func() // Used by asynchronous tasks to run code on the main event loop
-	fsWatcher      *pathwatch.Watcher
-	fileChangeCh   chan struct{}
-	configChangeCh chan struct{}
+	saveDelay       time.Duration
+	saveTimer       timer
+	historyDelay    time.Duration // How long after a save the undo history is saved; see saveHistoryLater
+	historyTimer    timer
+	taskQueue       chan func() // Used by asynchronous tasks to run code on the main event loop
+	fsWatcher       *pathwatch.Watcher
+	fileChangeCh    chan pathwatch.Event
+	configChangeCh  chan pathwatch.Event
+	savedBuf        *buffer.Buffer // The content of the open file when it was last loaded or saved
+	savedHash       string         // The hash of hashedBuf, to save computing it more than once
+	hashedBuf       *buffer.Buffer
+	savedInfo       os.FileInfo // The file written by the last save, if any
+	langServers     map[string]*languageServer
+	fileConflict    bool         // Whether the user is deciding what to do about conflicting changes to the file
+	shownDiagnostic string       // The message of the diagnostic at the cursor, when it was last checked
+	buildPending    bool         // Whether the build command is running
+	buildErrors     []buildError // The errors reported by the last build
+	buildErrorIndex int          // The index of the build error last gone to; -1 if none
+
+	// Whether the journal left by an earlier session is being kept, because the user put off
+	// deciding whether to recover the edits in it; see offerRecovery.
+	keepOldJournal bool
+
+	// The text last copied from several cursors at once, as from a block selection. Pasting it with a
+	// single cursor inserts it as a block.
+	copiedBlock []byte
 
 	// These fields are used when receiving a bracketed paste
 	pasteBuffer      []byte
@@ -46,6 +72,8 @@ type application struct {
 
 	titleNeedsRedraw bool
 
+	console console // If not nil, the terminal the application runs in, for job control
+
 	config *config.Config
 }
 
@@ -91,11 +119,12 @@ func newApplication(outdev io.Writer, size termdraw.Point) *application {
 	return &application{
 		cursorVisible: true,
 		saveDelay:     1 * time.Second,
+		historyDelay:  30 * time.Second,
 		screen:        termdraw.NewScreen(outdev, size),
 		taskQueue:     make(chan func(), 32),
 
-		fileChangeCh:   make(chan struct{}, 32),
-		configChangeCh: make(chan struct{}, 32),
+		fileChangeCh:   make(chan pathwatch.Event, 32),
+		configChangeCh: make(chan pathwatch.Event, 32),
 		fsWatcher:      pathwatch.NewWatcher(),
 	}
 }
@@ -119,15 +148,24 @@ func (app *application) navigateTo(where string) error {
 	if app.filename != "" {
 		oldLocation.pos = app.mainWindow.windowCoordsToTextCoords(app.mainWindow.cursorPos)
 	}
-	line := 1
+	line, col := 1, 0
 	regex := (*regexp.Regexp)(nil)
+	symbolName := ""
 	filename := where
 	err := error(nil)
 	if i := strings.IndexByte(where, ':'); i != -1 {
 		filename = where[:i]
-		if rest := where[i+1:]; allASCIIDigits(rest) {
+		rest := where[i+1:]
+		switch m := lineColRE.FindStringSubmatch(rest); {
+		case strings.HasPrefix(rest, "@"):
+			symbolName = rest[1:]
+		case allASCIIDigits(rest):
 			line, err = strconv.Atoi(rest)
-		} else {
+		case m != nil:
+			if line, err = strconv.Atoi(m[1]); err == nil {
+				col, err = strconv.Atoi(m[2])
+			}
+		default:
 			regex, err = regexp.Compile(rest)
 		}
 		if err != nil {
@@ -159,8 +197,12 @@ func (app *application) navigateTo(where string) error {
 		return err
 	}
 	switch {
+	case symbolName != "":
+		app.gotoSymbol(app.mainWindow, symbolName)
 	case regex != nil:
 		app.mainWindow.searchRegexp(regex, 0)
+	case line > 0 && col > 0:
+		app.mainWindow.gotoLineAndColumn(line-1, col-1)
 	case line > 0:
 		app.mainWindow.gotoLine(line - 1)
 	}
@@ -171,6 +213,10 @@ func (app *application) navigateTo(where string) error {
 	return nil
 }
 
+// lineColRE matches a line and column number, as in the locations printed by compilers, along
+// with the message that follows them, if any.
+var lineColRE = regexp.MustCompile(`^([0-9]+):([0-9]+)(:.*)?$`)
+
 // expandPath expands references to environment variables in path, of the form $VAR or ${VAR}.
 // It also expands ~/ at the start of a path to the user's home directory.
 func expandPath(path string) string {
@@ -203,15 +249,29 @@ func (app *application) gotoFile(filename string) error {
 			return err
 		}
 		if app.fileChangeCh == nil {
-			app.fileChangeCh = make(chan struct{}, 32)
+			app.fileChangeCh = make(chan pathwatch.Event, 32)
 		}
 		app.fsWatcher.Remove(app.filename, app.fileChangeCh)
 		app.finishFormatNow()
 		app.saveNow()
+		app.saveHistoryNow()
 		app.fsWatcher.Add(filename, app.fileChangeCh)
+		if app.mainWindow != nil {
+			app.closeJournal()
+			app.closeDocument(app.mainWindow)
+		}
 		size := app.screen.Size()
 		app.mainWindow = newWindow(app, size.X, size.Y, buf)
-		app.mainWindow.onChange = app.resetSaveTimer
+		app.mainWindow.onChange = app.mainWindowChanged
+		app.savedBuf = buf.Copy()
+		app.savedInfo = nil
+		app.keepOldJournal = false
+		// The journal left by the last session is only replaced once the user decides what to
+		// do with any edits in it.
+		unsaved, err := readJournal(filename, buf)
+		if err != nil {
+			app.setNotification(err.Error())
+		}
 		if ext := filepath.Ext(filename); ext != "" {
 			app.mainWindow.langConfig = app.config.ConfigForExt(ext[1:])
 			app.mainWindow.highlighter = highlight.Language(ext[1:], app.mainWindow)
@@ -220,10 +280,65 @@ func (app *application) gotoFile(filename string) error {
 		}
 		app.filename = filename
 		app.titleNeedsRedraw = true
+		if err := loadHistory(filename, app.mainWindow); err != nil {
+			app.setNotification(err.Error())
+		}
+		app.markBuildErrors(app.mainWindow, filename)
+		app.openDocument(app.mainWindow, filename)
+		app.checkFile()
+		if len(unsaved) > 0 {
+			app.offerRecovery(unsaved)
+		} else {
+			app.startJournal()
+		}
 	}
 	return nil
 }
 
+// handleFileChange reacts to a change made to the open file by another program.
+func (app *application) handleFileChange(ev pathwatch.Event) {
+	if ev.Path != app.filename {
+		// Left over from a file that is no longer open
+		return
+	}
+	switch ev.Op {
+	case pathwatch.Deleted, pathwatch.Renamed:
+		// Keep the content as it is; the file will be written back on the next save.
+		what := "deleted"
+		if ev.Op == pathwatch.Renamed {
+			what = "moved"
+		}
+		app.setNotification(fmt.Sprintf("%s was %s; it will be recreated when you make changes", filepath.Base(ev.Path), what))
+	default:
+		if app.isOwnWrite() {
+			return
+		}
+		if err := app.reloadFile(); err != nil {
+			app.setNotification(err.Error())
+		}
+	}
+}
+
+// isOwnWrite reports whether the open file is still the one written by the last save.
+// Saves always replace the file with a new one, so a different file, size or modification time
+// means that another program changed it; but a program writing to the file in place may leave
+// those as they were, so the content is compared too.
+func (app *application) isOwnWrite() bool {
+	if app.savedInfo == nil {
+		return false
+	}
+	info, err := os.Stat(app.filename)
+	if err != nil || !os.SameFile(info, app.savedInfo) || info.Size() != app.savedInfo.Size() ||
+		!info.ModTime().Equal(app.savedInfo.ModTime()) {
+		return false
+	}
+	hash, err := fileHash(app.filename)
+	return err == nil && hash == app.savedContentHash()
+}
+
+// reloadFile handles a change to the open file made by another program.
+// If there are no unsaved edits, the file's new content is loaded as an undoable change; otherwise,
+// the user is asked whether to keep their version, take the one on disk, or merge both.
 func (app *application) reloadFile() error {
 	buf := buffer.New()
 	if f, err := os.Open(app.filename); err == nil {
@@ -235,25 +350,93 @@ func (app *application) reloadFile() error {
 	} else if !os.IsNotExist(err) {
 		return err
 	}
-	app.mainWindow.buf = buf
-	app.mainWindow.wrappedBuf.Reset(buf)
-	app.mainWindow.highlighter.Invalidate(0)
-	app.mainWindow.roundCursorPos()
-	app.mainWindow.needsRedraw = true
-	if app.promptWindow != nil {
-		app.promptWindow.needsRedraw = true
+	app.finishFormatNow()
+	if app.fileConflict || sameContent(buf, app.savedBuf) {
+		return nil
 	}
+	if !app.saveTimer.pending {
+		app.takeTheirs(buf)
+		return nil
+	}
+	app.saveTimer.stop()
+	app.fileConflict = true
+	app.askAboutConflict(buf)
 	return nil
 }
 
-func (app *application) gotoNextMatch() {
-	if app.searchRE != nil {
-		tp := app.mainWindow.windowCoordsToTextCoords(app.mainWindow.cursorPos)
-		app.navStack = append(app.navStack, location{filename: app.filename, pos: tp})
-		app.mainWindow.searchRegexp(app.searchRE, tp.Y+1)
+// askAboutConflict asks the user whether to keep their version of the open file, take buf, the one
+// on disk, or merge both; it asks again until it gets one of those answers.
+func (app *application) askAboutConflict(buf *buffer.Buffer) {
+	app.openPrompt("File changed on disk; [k]eep mine, [t]ake theirs, [m]erge?", func(resp string) {
+		switch strings.TrimSpace(resp) {
+		case "k", "K":
+			app.fileConflict = false
+			app.keepMine(buf)
+		case "t", "T":
+			app.fileConflict = false
+			app.takeTheirs(buf)
+		case "m", "M":
+			app.fileConflict = false
+			app.mergeWith(buf)
+		default:
+			app.askAboutConflict(buf)
+		}
+	})
+	app.promptCancelHandler = func() {
+		app.fileConflict = false
+		app.keepMine(buf)
 	}
 }
 
+// takeTheirs replaces the main window's content with buf, the current content of the open file.
+func (app *application) takeTheirs(buf *buffer.Buffer) {
+	app.savedBuf = buf.Copy()
+	app.mainWindow.replaceContent(buf)
+	app.mainWindow.roundCursorPos()
+	app.resetJournal()
+	// The buffer now matches the file, so there is no need to save it; but the history has
+	// to be saved so that it can be restored.
+	app.saveTimer.stop()
+	app.saveHistoryLater()
+}
+
+// keepMine overwrites the open file, whose current content is buf, with the main window's content.
+func (app *application) keepMine(buf *buffer.Buffer) {
+	app.savedBuf = buf.Copy()
+	app.resetJournal()
+	app.resetSaveTimer()
+}
+
+// mergeWith combines the changes made to the open file by another program, whose current content
+// is buf, with those made in the main window.
+func (app *application) mergeWith(buf *buffer.Buffer) {
+	merged, conflicts := merge.Merge(allLines(app.savedBuf), allLines(app.mainWindow.buf), allLines(buf))
+	result := buffer.New()
+	result.ReadFrom(strings.NewReader(strings.Join(merged, "")))
+	app.savedBuf = buf.Copy()
+	app.mainWindow.replaceContent(result)
+	app.mainWindow.roundCursorPos()
+	app.resetJournal()
+	app.resetSaveTimer()
+	if conflicts > 0 {
+		app.setNotification(fmt.Sprintf("%d conflicting changes; look for %q", conflicts, merge.MineMarker))
+	}
+}
+
+func allLines(buf *buffer.Buffer) []string { return buf.SliceLines(0, buf.LineCount()) }
+
+func sameContent(a, b *buffer.Buffer) bool {
+	if a.LineCount() != b.LineCount() {
+		return false
+	}
+	for i := 0; i < a.LineCount(); i++ {
+		if a.Line(i) != b.Line(i) {
+			return false
+		}
+	}
+	return true
+}
+
 func (app *application) back() error {
 	if len(app.navStack) == 0 {
 		return nil
@@ -270,25 +453,104 @@ func (app *application) back() error {
 
 func (app *application) currentFile() string { return app.filename }
 
-func (app *application) resetSaveTimer() { app.saveTimer.reset(app.saveDelay) }
+// mainWindowChanged is called whenever the main window's buffer is modified.
+func (app *application) mainWindowChanged() {
+	if app.keepOldJournal {
+		// The edits in the old journal no longer apply once the file changes.
+		app.keepOldJournal = false
+		app.startJournal()
+	}
+	app.resetSaveTimer()
+}
+
+func (app *application) resetSaveTimer() {
+	// Don't overwrite the file until the user decides what to do with the conflicting changes.
+	if !app.fileConflict {
+		app.saveTimer.reset(app.saveDelay)
+	}
+}
 
 func (app *application) saveNow() {
 	if app.saveTimer.pending {
 		if !app.saveTimer.timer.Stop() {
 			<-app.saveTimer.timer.C
 		}
-		saveBuffer(app.filename, app.mainWindow.buf)
+		app.save()
 		app.saveTimer.pending = false
 	}
 }
 
+// save writes the main window's buffer to the open file. Its undo history is saved a while later.
+func (app *application) save() error {
+	if err := saveBuffer(app.filename, app.mainWindow.buf); err != nil {
+		return err
+	}
+	app.savedBuf = app.mainWindow.buf.Copy()
+	app.savedInfo, _ = os.Stat(app.filename)
+	app.resetJournal()
+	app.saveHistoryLater()
+	return nil
+}
+
+// savedContentHash returns the hash of app.savedBuf, computing it only once for each version.
+func (app *application) savedContentHash() string {
+	if app.hashedBuf != app.savedBuf {
+		app.savedHash = contentHash(app.savedBuf)
+		app.hashedBuf = app.savedBuf
+	}
+	return app.savedHash
+}
+
+// saveHistoryLater arranges for the main window's undo history to be saved once app.historyDelay
+// has passed, unless that is already arranged. Hashing and encoding it is too slow to do on every
+// save of a large file.
+func (app *application) saveHistoryLater() {
+	if !app.historyTimer.pending {
+		app.historyTimer.reset(app.historyDelay)
+	}
+}
+
+// saveHistoryNow saves the main window's undo history right away, if saving it was put off.
+func (app *application) saveHistoryNow() {
+	if app.historyTimer.pending {
+		app.historyTimer.stop()
+		app.saveHistory()
+	}
+}
+
+// saveHistory saves the main window's undo history, as long as its buffer matches the file on disk;
+// if it doesn't, the next save will arrange for the history to be saved again.
+func (app *application) saveHistory() {
+	if app.saveTimer.pending || app.fileConflict {
+		return
+	}
+	if err := saveHistory(app.filename, app.mainWindow, app.savedContentHash()); err != nil {
+		app.setNotification(err.Error())
+	}
+}
+
 func (app *application) finishFormatNow() {
 	for app.mainWindow != nil && app.mainWindow.formatPending {
 		(<-app.taskQueue)()
 	}
 }
 
-func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
+// shutdown finishes any pending formatting and saves the open file, so that nothing is lost when
+// mflg exits.
+func (app *application) shutdown() {
+	if app.fileConflict {
+		app.cancelPrompt()
+	}
+	app.finishFormatNow()
+	app.saveNow()
+	app.saveHistoryNow()
+	app.closeJournal()
+}
+
+// run handles input from in until the user quits, the input ends, or one of the signals received
+// from signals asks for mflg to exit. SIGWINCH, on the other hand, makes it adapt to the terminal's
+// new size.
+func (app *application) run(in io.Reader, signals <-chan os.Signal) error {
 	cp, err := config.Path()
 	if err != nil {
 		return err
@@ -307,14 +569,20 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 		}
 	}()
 	for {
+		app.showCursorDiagnostic()
 		app.redraw()
 		if err := app.screen.Flip(); err != nil {
+			// Most likely the terminal is gone, but the user's work can still be saved.
+			app.shutdown()
 			return err
 		}
+		app.syncJournal()
 		aw := app.activeWindow()
 		select {
 		case c, ok := <-inputCh:
 			if !ok {
+				// The terminal was probably closed.
+				app.shutdown()
 				return nil
 			}
 			if app.inBracketedPaste {
@@ -329,6 +597,12 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 				}
 				continue
 			}
+			if app.list != nil && app.promptWindow == nil && app.handleListKey(c) {
+				continue
+			}
+			if app.completion != nil && app.handleCompletionKey(c) {
+				continue
+			}
 			switch c {
 			case termesc.UpKey:
 				aw.repeatMove(aw.moveCursorUp)
@@ -342,10 +616,7 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 				app.inBracketedPaste = true
 				app.pasteBuffer = app.pasteBuffer[:0]
 			case "\x11":
-				app.finishFormatNow()
-				if app.saveTimer.pending {
-					saveBuffer(app.filename, app.mainWindow.buf)
-				}
+				app.shutdown()
 				return nil
 			case "\x7f", "\b":
 				aw.backspace()
@@ -356,13 +627,82 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 					}
 				})
 			case "\x07":
-				app.gotoNextMatch()
+				app.gotoMatch(1)
+			case "\x1bg":
+				app.gotoMatch(-1)
+			case "\x1bn":
+				aw.addCursorAtNextOccurrence()
+			case "\x1bl":
+				aw.addCursorsToSelectedLines()
+			case "\x1ba":
+				aw.markBlockBound()
+			case "\x1bz":
+				if err := app.suspend(); err != nil {
+					app.shutdown()
+					return err
+				}
+			case "\x1bh":
+				if aw == app.mainWindow {
+					app.showHistory()
+				}
 			case "\x02":
 				if err := app.back(); err != nil {
 					app.setNotification(err.Error())
 				}
 			case "\x06":
 				aw.formatBuffer()
+			case "\x04":
+				if aw == app.mainWindow {
+					app.gotoDefinition()
+				}
+			case "\x05":
+				if aw == app.mainWindow {
+					app.findReferences()
+				}
+			case "\x1f":
+				if aw == app.mainWindow {
+					app.startSearch()
+				}
+			case "\x13":
+				if aw == app.mainWindow {
+					app.openPrompt("Find in files:", func(searchRE string) {
+						re, err := regexp.Compile(searchRE)
+						if err != nil {
+							app.setNotification(err.Error())
+							return
+						}
+						app.findInFiles(re)
+					})
+				}
+			case "\x17":
+				if aw == app.mainWindow {
+					app.openPrompt("Replace in files:", func(searchRE string) {
+						re, err := regexp.Compile(searchRE)
+						if err != nil {
+							app.setNotification(err.Error())
+							return
+						}
+						app.openPrompt("With:", func(replacement string) {
+							app.replaceInFiles(re, replacement)
+						})
+					})
+				}
+			case "\x0b":
+				if aw == app.mainWindow {
+					app.runBuild()
+				}
+			case "\x14":
+				if aw == app.mainWindow {
+					app.gotoBuildError(1)
+				}
+			case "\x10":
+				if aw == app.mainWindow {
+					app.gotoBuildError(-1)
+				}
+			case "\x0e":
+				if aw == app.mainWindow {
+					app.openCompletion()
+				}
 			case "\x12":
 				app.openPrompt("Replace:", func(searchRE string) {
 					re, err := regexp.Compile(searchRE)
@@ -374,6 +714,19 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 						app.mainWindow.replaceRegexp(re, replacement)
 					})
 				})
+			case "\x1br":
+				if aw == app.mainWindow {
+					app.openPrompt("Replace one by one:", func(searchRE string) {
+						re, err := regexp.Compile(searchRE)
+						if err != nil {
+							app.setNotification(err.Error())
+							return
+						}
+						app.openPrompt("With:", func(replacement string) {
+							app.replaceInteractively(re, replacement)
+						})
+					})
+				}
 			case "\x01":
 				if !aw.inMouseSelection() {
 					aw.markSelectionBound()
@@ -386,6 +739,8 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 				aw.paste()
 			case "\x1a":
 				aw.undo()
+			case "\x19":
+				aw.redo()
 			case "\x15":
 				if len(aw.undoStack) > 0 && app.promptWindow == nil {
 					app.openPrompt("Discard changes [y/Esc]?", func(resp string) {
@@ -398,8 +753,10 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 				}
 			case "\x1b":
 				switch {
-				case aw.selection.Set || aw.selectionAnchor.Set || aw.mouseSelectionAnchor.Set:
+				case aw.selection.Set || aw.selectionAnchor.Set || aw.mouseSelectionAnchor.Set || aw.blockAnchor.Set:
 					aw.resetSelectionState()
+				case len(aw.extraCursors) > 0:
+					aw.clearExtraCursors()
 				case app.promptWindow != nil:
 					app.cancelPrompt()
 				}
@@ -418,7 +775,16 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 					aw.moveCursorLeftWord()
 				}
 			}
-		case <-resizeSignal:
+			if app.completion != nil {
+				app.updateCompletion()
+			}
+		case sig := <-signals:
+			switch sig {
+			case unix.SIGWINCH:
+			default:
+				app.shutdown()
+				return nil
+			}
 			// This can only fail if our terminal turns into a non-terminal
 			// during execution, which is highly unlikely.
 			if w, h, err := terminal.GetSize(0); err != nil {
@@ -428,15 +794,20 @@ func (app *application) run(in io.Reader, resizeSignal <-chan os.Signal) error {
 			}
 		case <-app.saveTimer.channel():
 			app.saveTimer.pending = false
-			if err := saveBuffer(app.filename, app.mainWindow.buf); err != nil {
+			if err := app.save(); err != nil {
 				app.setNotification(err.Error())
+			} else {
+				app.checkFile()
 			}
+		case <-app.historyTimer.channel():
+			app.historyTimer.pending = false
+			app.saveHistory()
 		case <-app.noteClearTimer.channel():
 			app.noteClearTimer.pending = false
 			app.note = ""
 			app.mainWindow.needsRedraw = true
-		case <-app.fileChangeCh:
-			app.reloadFile()
+		case ev := <-app.fileChangeCh:
+			app.handleFileChange(ev)
 		case <-app.configChangeCh:
 			app.loadConfig()
 		case err := <-app.fsWatcher.Errors():
@@ -464,25 +835,42 @@ func (app *application) resize(height, width int) {
 
 // openPrompt opens a prompt window at the bottom of the viewport.
 // When the user hits Enter, whenDone is called with the entered text.
+// If another prompt was already open, it is cancelled.
 func (app *application) openPrompt(prompt string, whenDone func(string)) {
+	if handler := app.promptCancelHandler; handler != nil {
+		app.promptCancelHandler = nil
+		handler()
+	}
+	app.closeCompletion()
 	app.promptWindow = newWindow(app, app.screen.Size().X, 1, buffer.New())
 	app.promptWindow.setGutterText(prompt)
 	app.promptWindow.highlighter = highlight.Language("", app.promptWindow)
 	app.promptHandler = whenDone
+	app.promptCancelHandler = nil
 	app.note = ""
 }
 
+// cancelPrompt closes the prompt window without accepting its input.
 func (app *application) cancelPrompt() {
+	handler := app.promptCancelHandler
+	app.closePrompt()
+	if handler != nil {
+		handler()
+	}
+}
+
+func (app *application) closePrompt() {
 	app.mainWindow.needsRedraw = true
 	app.promptWindow = nil
 	app.promptHandler = nil
+	app.promptCancelHandler = nil
 }
 
 func (app *application) finishPrompt() {
 	// Do things in this order so that the prompt handler can safely call openPrompt.
 	response := app.promptWindow.buf.Line(0)
 	handler := app.promptHandler
-	app.cancelPrompt()
+	app.closePrompt()
 	handler(response)
 }
 
@@ -511,6 +899,13 @@ func (app *application) redraw() {
 	app.screen.Clear()
 	app.screen.SetTitle(app.filename)
 	app.mainWindow.redraw(app.screen)
+	if app.list != nil {
+		// Leave the bottom row free for the prompt and notifications.
+		app.list.draw(app.screen, app.screen.Size().Y-1)
+	}
+	if app.completion != nil {
+		app.completion.draw(app.screen, app.promptYOffset())
+	}
 	// When displaying the prompt or a message, clear out the bottom row first so the existing text doesn't show.
 	switch {
 	case app.promptWindow != nil:
@@ -595,6 +990,12 @@ func (app *application) cursorPos() point {
 }
 
 func (app *application) handleMouseEvent(ev termesc.MouseEvent) {
+	if app.completion != nil && app.handleCompletionMouseEvent(ev) {
+		return
+	}
+	if app.list != nil && app.handleListMouseEvent(ev) {
+		return
+	}
 	if py := app.promptYOffset(); ev.Y >= py && app.promptWindow != nil {
 		ev.Y -= py
 		app.promptWindow.handleMouseEvent(ev)
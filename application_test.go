@@ -3,16 +3,27 @@ package main
 import (
 	"github.com/dpinela/mflg/internal/buffer"
 	"github.com/dpinela/mflg/internal/config"
+	"github.com/dpinela/mflg/internal/highlight"
+	"github.com/dpinela/mflg/internal/lsp"
+	"github.com/dpinela/mflg/internal/pathwatch"
 	"github.com/dpinela/mflg/internal/termdraw"
 	"github.com/dpinela/mflg/internal/termesc"
 	"testing"
 
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -104,6 +115,25 @@ func TestAutoSave(t *testing.T) {
 	checkFileContents(t, name, "ABC\nrp")
 }
 
+func TestSaveAfterPanic(t *testing.T) {
+	f, err := ioutil.TempFile("", "mflg-panic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	name := f.Name()
+	defer os.Remove(name)
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.testNav(t, name)
+	typeString(app.mainWindow, "ABC")
+	saveAfterPanic(app)
+	checkFileContents(t, name, "ABC")
+	// An application too broken to save must not cause another panic.
+	app.mainWindow = nil
+	saveAfterPanic(app)
+}
+
 func TestNavigation(t *testing.T) {
 	d, err := filepath.Abs("testdata")
 	if err != nil {
@@ -166,21 +196,67 @@ func TestNavigation(t *testing.T) {
 	})
 	t.Run("CycleRegexMatches", func(t *testing.T) {
 		app.testNav(t, "B:[ae]t$")
-		app.checkLocation(t, nameB, 1)
-		app.gotoNextMatch()
-		app.checkLocation(t, nameB, 2)
-		app.gotoNextMatch()
-		app.checkLocation(t, nameB, 4)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 1})
+		checkSelection(t, 1, app.mainWindow, optionalTextRange{textRange{Begin: point{X: 2, Y: 1}, End: point{X: 4, Y: 1}}, true})
+		app.gotoMatch(1)
+		app.checkFullLocation(t, nameB, point{X: 8, Y: 2})
+		app.checkNote(t, "Match 2 of 3")
+		checkSelection(t, 2, app.mainWindow, optionalTextRange{textRange{Begin: point{X: 8, Y: 2}, End: point{X: 10, Y: 2}}, true})
+		app.gotoMatch(1)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 4})
+		app.checkNote(t, "Match 3 of 3")
 		app.testBack(t)
-		app.checkLocation(t, nameB, 2)
-		app.gotoNextMatch()
-		app.checkLocation(t, nameB, 4)
-		app.gotoNextMatch()
-		app.checkLocation(t, nameB, 1)
+		app.checkFullLocation(t, nameB, point{X: 8, Y: 2})
+		app.gotoMatch(1)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 4})
+		app.gotoMatch(1)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 1})
+		app.checkNote(t, "Match 1 of 3")
 		app.mainWindow.cursorPos = point{X: 1, Y: 3}
-		app.gotoNextMatch()
-		app.checkLocation(t, nameB, 4)
+		app.gotoMatch(1)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 4})
 	})
+	t.Run("CycleRegexMatchesBackwards", func(t *testing.T) {
+		app.testNav(t, "B:[ae]t$")
+		app.gotoMatch(-1)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 4})
+		app.checkNote(t, "Match 3 of 3")
+		app.gotoMatch(-1)
+		app.checkFullLocation(t, nameB, point{X: 8, Y: 2})
+		app.gotoMatch(-1)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 1})
+		app.checkNote(t, "Match 1 of 3")
+		app.gotoMatch(-1)
+		app.checkFullLocation(t, nameB, point{X: 2, Y: 4})
+		app.testNav(t, "B:nothing like this")
+		app.gotoMatch(-1)
+		app.checkNote(t, "No matches")
+	})
+	t.Run("LineAndColumn", func(t *testing.T) {
+		app.testNav(t, nameA+":2:3")
+		app.checkFullLocation(t, nameA, point{X: 2, Y: 1})
+		app.testNav(t, ":1:99")
+		app.checkFullLocation(t, nameA, point{X: 5, Y: 0})
+		app.testNav(t, nameA+":2:4: undefined: psum")
+		app.checkFullLocation(t, nameA, point{X: 3, Y: 1})
+	})
+}
+
+func TestNavigateToByteColumn(t *testing.T) {
+	f, err := ioutil.TempFile("", "mflg-column-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("héllo wörld\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.testNav(t, f.Name()+":1:8: undefined: wörld")
+	app.checkFullLocation(t, f.Name(), point{X: 6, Y: 0})
 }
 
 func (app *application) testNav(t *testing.T, dest string) {
@@ -210,6 +286,13 @@ func (app *application) checkFullLocation(t *testing.T, filename string, wantTP
 	}
 }
 
+func (app *application) checkNote(t *testing.T, want string) {
+	t.Helper()
+	if app.note != want {
+		t.Errorf("notification is %q, want %q", app.note, want)
+	}
+}
+
 func checkFileContents(t *testing.T, filename, want string) {
 	t.Helper()
 	data, err := ioutil.ReadFile(filename)
@@ -220,3 +303,1205 @@ func checkFileContents(t *testing.T, filename, want string) {
 		t.Errorf("ReadFile(%q): got %q, want %q", filename, got, want)
 	}
 }
+
+var fakeLanguageServer string
+
+func TestMain(m *testing.M) {
+	// Keep undo histories saved by tests out of the user's configuration directory.
+	dir, err := ioutil.TempDir("", "mflg-test-config")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	fakeLanguageServer = filepath.Join(dir, "fakeserver")
+	if out, err := exec.Command("go", "build", "-o", fakeLanguageServer, "./internal/lsp/testdata/fakeserver").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "error building fake language server: %v\n%s", err, out)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestUndoHistoryPersistence(t *testing.T) {
+	f, err := ioutil.TempFile("", "mflg-history-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := f.Name()
+	defer os.Remove(name)
+	_, err = io.WriteString(f, "lorem\nipsum")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(text string) {
+		app := newTestApplication()
+		defer app.fsWatcher.Close()
+		app.saveDelay = time.Hour
+		if err := app.navigateTo(name); err != nil {
+			t.Fatal(err)
+		}
+		typeString(app.mainWindow, text)
+		app.shutdown()
+	}
+	edit("ABC")
+	edit("\rDEF")
+	checkFileContents(t, name, "\nDEFABClorem\nipsum")
+
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	if err := app.navigateTo(name); err != nil {
+		t.Fatal(err)
+	}
+	app.mainWindow.undo()
+	if got, want := app.mainWindow.buf.Line(0), "ABClorem\n"; got != want {
+		t.Errorf("after reopening and undoing once, line 0 = %q, want %q", got, want)
+	}
+	app.mainWindow.undoAll()
+	if got, want := app.mainWindow.buf.Line(0), "lorem\n"; got != want {
+		t.Errorf("after reopening and undoing all, line 0 = %q, want %q", got, want)
+	}
+	app.mainWindow.redo()
+	app.saveNow()
+
+	// A history that no longer matches the file must not be restored.
+	if err := ioutil.WriteFile(name, []byte("changed elsewhere\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app2 := newTestApplication()
+	defer app2.fsWatcher.Close()
+	if err := app2.navigateTo(name); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(app2.mainWindow.undoStack); n != 0 {
+		t.Errorf("after opening file modified outside mflg, undo stack has %d entries, want 0", n)
+	}
+}
+
+func TestEditJournalRecovery(t *testing.T) {
+	f, err := ioutil.TempFile("", "mflg-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := f.Name()
+	defer os.Remove(name)
+	_, err = io.WriteString(f, "lorem\nipsum")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() *application {
+		app := newTestApplication()
+		app.saveDelay = time.Hour
+		if err := app.navigateTo(name); err != nil {
+			t.Fatal(err)
+		}
+		return app
+	}
+	// Simulate a crash by abandoning the application before it saves the file.
+	crash := func(text string) {
+		app := open()
+		defer app.fsWatcher.Close()
+		if app.promptWindow != nil {
+			t.Fatal("recovery offered with nothing to recover")
+		}
+		typeString(app.mainWindow, text)
+		app.syncJournal()
+	}
+	answer := func(app *application, resp string) {
+		t.Helper()
+		if app.promptWindow == nil {
+			t.Fatal("recovery not offered after a crash")
+		}
+		typeString(app.promptWindow, resp)
+		app.finishPrompt()
+	}
+
+	crash("ABC\rDEF")
+	// An entry cut short by the crash must be ignored.
+	jf, err := stateFilename("journal", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jw, err := os.OpenFile(jf, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(jw, `{"At":{"X":`)
+	jw.Close()
+	// Dismissing the offer, or having it replaced by another prompt, must keep the edits for the
+	// next time the file is opened.
+	for _, dismiss := range []func(*application){
+		(*application).cancelPrompt,
+		func(app *application) { app.openPrompt("Go to:", func(string) {}) },
+	} {
+		app := open()
+		if app.promptWindow == nil {
+			t.Fatal("recovery not offered after a crash")
+		}
+		dismiss(app)
+		app.closeJournal()
+		app.fsWatcher.Close()
+	}
+	app := open()
+	defer app.fsWatcher.Close()
+	answer(app, "y")
+	checkBufContent(t, app.mainWindow.buf, "ABC\nDEFlorem\nipsum")
+	checkFileContents(t, name, "lorem\nipsum")
+	app.mainWindow.undo()
+	checkBufContent(t, app.mainWindow.buf, "lorem\nipsum")
+	app.mainWindow.redo()
+	app.saveNow()
+	checkFileContents(t, name, "ABC\nDEFlorem\nipsum")
+
+	// Once saved, there is nothing left to recover.
+	crash("X")
+	app2 := open()
+	defer app2.fsWatcher.Close()
+	answer(app2, "n")
+	checkBufContent(t, app2.mainWindow.buf, "ABC\nDEFlorem\nipsum")
+	app2.closeJournal()
+	app3 := open()
+	defer app3.fsWatcher.Close()
+	if app3.promptWindow != nil {
+		t.Error("recovery offered again after declining it")
+	}
+
+	// A journal that no longer matches the file must be ignored.
+	crash("Y")
+	if err := ioutil.WriteFile(name, []byte("changed elsewhere\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app4 := open()
+	defer app4.fsWatcher.Close()
+	if app4.promptWindow != nil {
+		t.Error("recovery offered after the file was modified outside mflg")
+	}
+}
+
+func openTempFile(t *testing.T, app *application, content string) (name string) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "mflg-reload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = f.Name()
+	_, err = io.WriteString(f, content)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.navigateTo(name); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReloadExternalChange(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	name := openTempFile(t, app, "lorem\nipsum")
+	defer os.Remove(name)
+	if err := ioutil.WriteFile(name, []byte("lorem\ndolor\nsit"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reloadFile(); err != nil {
+		t.Fatal(err)
+	}
+	checkBufContent(t, app.mainWindow.buf, "lorem\ndolor\nsit")
+	if app.promptWindow != nil || app.saveTimer.pending {
+		t.Error("reloading a file with no unsaved edits prompted the user or scheduled a save")
+	}
+	app.mainWindow.undo()
+	checkBufContent(t, app.mainWindow.buf, "lorem\nipsum")
+}
+
+func TestReloadConflict(t *testing.T) {
+	for _, tt := range []struct {
+		response, want string
+	}{
+		{"k", "Xlorem\nipsum\ndolor"},
+		{"t", "lorem\nipsum\nsit"},
+		{"m", "Xlorem\nipsum\nsit"},
+	} {
+		t.Run(tt.response, func(t *testing.T) {
+			app := newTestApplication()
+			defer app.fsWatcher.Close()
+			app.saveDelay = time.Hour
+			name := openTempFile(t, app, "lorem\nipsum\ndolor")
+			defer os.Remove(name)
+			typeString(app.mainWindow, "X")
+			if err := ioutil.WriteFile(name, []byte("lorem\nipsum\nsit"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.reloadFile(); err != nil {
+				t.Fatal(err)
+			}
+			if app.promptWindow == nil {
+				t.Fatal("no prompt opened after conflicting change")
+			}
+			typeString(app.promptWindow, tt.response)
+			app.finishPrompt()
+			checkBufContent(t, app.mainWindow.buf, tt.want)
+			app.saveNow()
+			checkFileContents(t, name, tt.want)
+		})
+	}
+}
+
+func TestReloadConflictUnrecognisedAnswer(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.saveDelay = time.Hour
+	name := openTempFile(t, app, "lorem\nipsum")
+	defer os.Remove(name)
+	typeString(app.mainWindow, "X")
+	if err := ioutil.WriteFile(name, []byte("lorem\ndolor"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reloadFile(); err != nil {
+		t.Fatal(err)
+	}
+	app.finishPrompt()
+	if app.promptWindow == nil || !app.fileConflict {
+		t.Fatal("empty answer to conflict prompt wasn't asked again")
+	}
+	checkBufContent(t, app.mainWindow.buf, "Xlorem\nipsum")
+	checkFileContents(t, name, "lorem\ndolor")
+	typeString(app.promptWindow, "t")
+	app.finishPrompt()
+	checkBufContent(t, app.mainWindow.buf, "lorem\ndolor")
+}
+
+func TestReloadMergeConflict(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.saveDelay = time.Hour
+	name := openTempFile(t, app, "lorem\nipsum")
+	defer os.Remove(name)
+	typeString(app.mainWindow, "X")
+	if err := ioutil.WriteFile(name, []byte("Ylorem\nipsum"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reloadFile(); err != nil {
+		t.Fatal(err)
+	}
+	typeString(app.promptWindow, "m")
+	app.finishPrompt()
+	checkBufContent(t, app.mainWindow.buf, "<<<<<<< mine\nXlorem\n=======\nYlorem\n>>>>>>> theirs\nipsum")
+	app.mainWindow.undo()
+	checkBufContent(t, app.mainWindow.buf, "Xlorem\nipsum")
+}
+
+func TestExternalDelete(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	name := openTempFile(t, app, "lorem\nipsum")
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	app.handleFileChange(pathwatch.Event{Path: name, Op: pathwatch.Deleted})
+	checkBufContent(t, app.mainWindow.buf, "lorem\nipsum")
+	if len(app.mainWindow.undoStack) != 0 {
+		t.Error("deleting the open file was recorded as an edit")
+	}
+}
+
+func TestOwnWritesIgnored(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	name := openTempFile(t, app, "lorem\nipsum")
+	defer os.Remove(name)
+	typeString(app.mainWindow, "X")
+	app.saveNow()
+	if !app.isOwnWrite() {
+		t.Error("file just saved not recognized as own write")
+	}
+	// Written in place, with the same size and modification time.
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("Y")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, app.savedInfo.ModTime(), app.savedInfo.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if app.isOwnWrite() {
+		t.Error("file written in place by someone else recognized as own write")
+	}
+	if err := ioutil.WriteFile(name, []byte("Xlorem\nipsum"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if app.isOwnWrite() {
+		t.Error("file written by someone else recognized as own write")
+	}
+}
+
+func TestSaveOnTerminationSignal(t *testing.T) {
+	for _, sig := range []os.Signal{unix.SIGTERM, unix.SIGHUP} {
+		app := newTestApplication()
+		defer app.fsWatcher.Close()
+		app.saveDelay = time.Hour
+		name := openTempFile(t, app, "lorem")
+		defer os.Remove(name)
+		app.resize(stdHeight, stdWidth)
+		typeString(app.mainWindow, "ABC")
+		fakeConsole := make(inactiveReader)
+		defer close(fakeConsole)
+		signals := make(chan os.Signal, 1)
+		signals <- sig
+		done := make(chan error)
+		go func() { done <- app.run(fakeConsole, signals) }()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		checkFileContents(t, name, "ABClorem")
+	}
+}
+
+// testConsole is a console that only counts how many times it was acquired and suspended, and
+// calls whileSuspended, if set, in place of stopping.
+type testConsole struct {
+	acquired, suspended int
+	whileSuspended      func()
+}
+
+func (c *testConsole) acquire() error { c.acquired++; return nil }
+
+func (c *testConsole) suspend() error {
+	c.suspended++
+	if c.whileSuspended != nil {
+		c.whileSuspended()
+	}
+	return nil
+}
+
+func TestSuspend(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.saveDelay = time.Hour
+	name := openTempFile(t, app, "lorem")
+	defer os.Remove(name)
+	var out bytes.Buffer
+	app.screen = termdraw.NewScreen(&out, termdraw.Point{X: stdWidth, Y: stdHeight})
+	con := &testConsole{whileSuspended: func() {
+		checkFileContents(t, name, "ABClorem")
+		if err := ioutil.WriteFile(name, []byte("changed elsewhere\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	app.console = con
+	typeString(app.mainWindow, "ABC")
+	app.redraw()
+	app.screen.Flip()
+
+	out.Reset()
+	if err := app.suspend(); err != nil {
+		t.Fatal(err)
+	}
+	if con.suspended != 1 || con.acquired != 1 {
+		t.Errorf("console suspended %d times and acquired %d times, want 1 and 1", con.suspended, con.acquired)
+	}
+	checkBufContent(t, app.mainWindow.buf, "changed elsewhere\n")
+	app.redraw()
+	app.screen.Flip()
+	if !strings.Contains(out.String(), termesc.ClearScreenForward) {
+		t.Error("screen not redrawn from scratch after suspending")
+	}
+}
+
+func TestTypingDuringAutoSave(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.saveDelay = time.Millisecond
+	name := openTempFile(t, app, "")
+	defer os.Remove(name)
+	app.resize(stdHeight, stdWidth)
+	in, out := io.Pipe()
+	done := make(chan error)
+	go func() { done <- app.run(in, nil) }()
+	var want strings.Builder
+	for i := 0; i < 300; i++ {
+		c := string(rune('a' + i%26))
+		if i%50 == 49 {
+			c = "\r"
+			want.WriteString("\n")
+		} else {
+			want.WriteString(c)
+		}
+		io.WriteString(out, c)
+		// Give autosaves and the resulting file change notifications a chance to happen in between
+		// keystrokes.
+		time.Sleep(time.Duration(i%3) * time.Millisecond)
+	}
+	io.WriteString(out, "\x11")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkFileContents(t, name, want.String())
+	checkBufContent(t, app.mainWindow.buf, want.String())
+}
+
+// runTasksUntil runs the tasks queued with app.do, as the main loop would, until cond becomes true.
+func (app *application) runTasksUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for !cond() {
+		select {
+		case f := <-app.taskQueue:
+			f()
+		case <-timeout:
+			t.Fatal("timed out waiting for background tasks")
+		}
+	}
+}
+
+func TestLanguageServerSync(t *testing.T) {
+	for _, args := range [][]string{nil, {"-sync=1"}} {
+		t.Run(strings.Join(args, ""), func(t *testing.T) {
+			app := newTestApplication()
+			defer app.fsWatcher.Close()
+			defer app.closeLanguageServers()
+			app.config.Lang = map[string]config.LangConfig{
+				"txt": {LanguageServer: append([]string{fakeLanguageServer}, args...)},
+			}
+			f, err := ioutil.TempFile("", "mflg-lsp-test*.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("lorem\nípsum\n")
+			f.Close()
+			defer os.Remove(f.Name())
+			if err := app.navigateTo(f.Name()); err != nil {
+				t.Fatal(err)
+			}
+			w := app.mainWindow
+			app.runTasksUntil(t, func() bool { return w.doc != nil })
+			w.cursorPos = point{X: 2, Y: 1}
+			typeString(w, "X\r")
+			w.backspace()
+			w.backspace()
+			w.cursorPos = point{X: 0, Y: 0}
+			w.insertText([]byte("a\nb"))
+			w.undo()
+			w.redo()
+			var serverText string
+			if err := w.doc.client.Call(context.Background(), "fake/documentText", lsp.TextDocumentIdentifier{URI: w.doc.uri}, &serverText); err != nil {
+				t.Fatal(err)
+			}
+			if want := bufferText(w.buf); serverText != want {
+				t.Errorf("server has %q, want %q", serverText, want)
+			}
+		})
+	}
+}
+
+func TestLanguageServerDiagnostics(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	defer app.closeLanguageServers()
+	app.config.Lang = map[string]config.LangConfig{"txt": {LanguageServer: []string{fakeLanguageServer}}}
+	f, err := ioutil.TempFile("", "mflg-lsp-test*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("lorem\n𝒾psum dolor\n")
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := app.navigateTo(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	w := app.mainWindow
+	app.runTasksUntil(t, func() bool { return w.doc != nil })
+	oldVersion := w.doc.version - 1
+	publish := func(version *int) {
+		t.Helper()
+		err := w.doc.client.Call(context.Background(), "fake/publishDiagnostics", lsp.PublishDiagnosticsParams{
+			URI:     w.doc.uri,
+			Version: version,
+			Diagnostics: []lsp.Diagnostic{
+				{Range: lsp.Range{Start: lsp.Position{Line: 1, Character: 0}, End: lsp.Position{Line: 1, Character: 6}}, Severity: lsp.SeverityWarning, Message: "bad word"},
+				{Range: lsp.Range{Start: lsp.Position{Line: 1, Character: 7}, End: lsp.Position{Line: 1, Character: 12}}, Source: "fake", Message: "worse word"},
+				// Empty ranges are widened to a character so that they can be seen.
+				{Range: lsp.Range{Start: lsp.Position{Line: 0, Character: 2}, End: lsp.Position{Line: 0, Character: 2}}, Message: "here"},
+				{Range: lsp.Range{Start: lsp.Position{Line: 0, Character: 5}, End: lsp.Position{Line: 0, Character: 5}}, Message: "line end"},
+			},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(&oldVersion)
+	publish(nil)
+	app.runTasksUntil(t, func() bool { return len(w.diagnostics) != 0 })
+	want := []diagnostic{
+		{Range: textRange{Begin: point{X: 2, Y: 0}, End: point{X: 3, Y: 0}}, Severity: lsp.SeverityError, Message: "here"},
+		{Range: textRange{Begin: point{X: 4, Y: 0}, End: point{X: 5, Y: 0}}, Severity: lsp.SeverityError, Message: "line end"},
+		{Range: textRange{Begin: point{X: 0, Y: 1}, End: point{X: 5, Y: 1}}, Severity: lsp.SeverityWarning, Message: "bad word"},
+		{Range: textRange{Begin: point{X: 6, Y: 1}, End: point{X: 11, Y: 1}}, Severity: lsp.SeverityError, Message: "fake: worse word"},
+	}
+	if !reflect.DeepEqual(w.diagnostics, want) {
+		t.Errorf("got diagnostics %v, want %v", w.diagnostics, want)
+	}
+	w.cursorPos = point{X: 8, Y: 1}
+	app.showCursorDiagnostic()
+	if app.note != "fake: worse word" {
+		t.Errorf("with the cursor over a diagnostic, notification is %q, want %q", app.note, "fake: worse word")
+	}
+}
+
+func TestParseCheckerOutput(t *testing.T) {
+	buf := buffer.New()
+	buf.ReadFrom(strings.NewReader("package main\n\nfunc main() {\n\tfmt.Println(x)\n}\n"))
+	dir := filepath.FromSlash("/src/proj")
+	filename := filepath.Join(dir, "main.go")
+	out := "# proj\n" +
+		"./main.go:4:2: undefined: fmt\n" +
+		filename + ":4:14: warning: x is unused\n" +
+		"other.go:1:1: error: not this file\n" +
+		"main.go:3: note: no column\n" +
+		"main.go:99:1: past the end\n"
+	want := []diagnostic{
+		{Range: textRange{Begin: point{X: 1, Y: 3}, End: point{X: 4, Y: 3}}, Severity: lsp.SeverityError, Message: "undefined: fmt"},
+		{Range: textRange{Begin: point{X: 13, Y: 3}, End: point{X: 14, Y: 3}}, Severity: lsp.SeverityWarning, Message: "x is unused"},
+		{Range: textRange{Begin: point{X: 0, Y: 2}, End: point{X: 13, Y: 2}}, Severity: lsp.SeverityInformation, Message: "no column"},
+	}
+	if got := parseCheckerOutput([]byte(out), dir, filename, buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func checkCompletions(t *testing.T, app *application, want ...string) {
+	t.Helper()
+	var got []string
+	if app.completion != nil {
+		for _, item := range app.completion.shown {
+			got = append(got, item.label)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("completions offered are %q, want %q", got, want)
+	}
+}
+
+func TestBufferCompletion(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	buf := buffer.New()
+	buf.ReadFrom(strings.NewReader("lorem Lorax ipsum\nlorum lo"))
+	w := newWindow(app, stdWidth, stdHeight, buf)
+	w.highlighter = highlight.Language("", w)
+	app.mainWindow = w
+	w.cursorPos = point{X: 8, Y: 1}
+	app.openCompletion()
+	checkCompletions(t, app, "Lorax", "lorem", "lorum")
+	app.handleCompletionKey(termesc.DownKey)
+	app.handleCompletionKey(termesc.DownKey)
+	app.handleCompletionKey("\t")
+	checkCompletions(t, app)
+	checkLineContent(t, 1, w, 1, "lorum lorum")
+	checkCursorPos(t, 1, w, point{X: 11, Y: 1})
+	w.undo()
+	checkLineContent(t, 2, w, 1, "lorum lo")
+
+	app.openCompletion()
+	typeString(w, "ra")
+	app.updateCompletion()
+	checkCompletions(t, app, "Lorax")
+	w.typeText(" ")
+	app.updateCompletion()
+	checkCompletions(t, app)
+
+	// Words too far from the cursor aren't offered.
+	far := buffer.New()
+	far.ReadFrom(strings.NewReader("lorax\n" + strings.Repeat("\n", completionScanLines+1) + "lorem lo"))
+	var got []string
+	for _, item := range bufferCompletions(far, point{X: 6, Y: completionScanLines + 2}) {
+		got = append(got, item.label)
+	}
+	if want := []string{"lo", "lorem"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with distant words, completions are %q, want %q", got, want)
+	}
+}
+
+func TestLanguageServerCompletion(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	defer app.closeLanguageServers()
+	app.config.Lang = map[string]config.LangConfig{"txt": {LanguageServer: []string{fakeLanguageServer}}}
+	f, err := ioutil.TempFile("", "mflg-lsp-test*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("𝒾psum lorem\n")
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := app.navigateTo(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	w := app.mainWindow
+	app.runTasksUntil(t, func() bool { return w.doc != nil })
+	w.cursorPos = point{X: 11, Y: 0}
+	typeString(w, " 𝒾")
+	app.openCompletion()
+	app.runTasksUntil(t, func() bool { return app.completion != nil })
+	checkCompletions(t, app, "𝒾psum")
+	app.redraw()
+	p := app.completion.pos
+	app.handleMouseEvent(termesc.MouseEvent{X: p.X + 1, Y: p.Y, Button: termesc.LeftButton})
+	app.handleMouseEvent(termesc.MouseEvent{X: p.X + 1, Y: p.Y, Button: termesc.ReleaseButton})
+	checkCompletions(t, app)
+	checkLineContent(t, 1, w, 0, "𝒾psum lorem 𝒾psum")
+	checkCursorPos(t, 1, w, point{X: 17, Y: 0})
+}
+
+func TestLanguageServerDefinitionAndReferences(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	defer app.closeLanguageServers()
+	app.config.Lang = map[string]config.LangConfig{"txt": {LanguageServer: []string{fakeLanguageServer}}}
+	f, err := ioutil.TempFile("", "mflg-lsp-test*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("x := 1\ny := x + x\n")
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := app.navigateTo(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	w := app.mainWindow
+	app.runTasksUntil(t, func() bool { return w.doc != nil })
+	w.cursorPos = point{X: 9, Y: 1}
+	app.gotoDefinition()
+	app.runTasksUntil(t, func() bool { return w.cursorPos != point{X: 9, Y: 1} })
+	checkCursorPos(t, 1, w, point{X: 0, Y: 0})
+	if err := app.back(); err != nil {
+		t.Fatal(err)
+	}
+	checkCursorPos(t, 2, w, point{X: 9, Y: 1})
+
+	app.findReferences()
+	app.runTasksUntil(t, func() bool { return app.list != nil })
+	want := []string{
+		filepath.Base(f.Name()) + ":1: x := 1",
+		filepath.Base(f.Name()) + ":2: y := x + x",
+		filepath.Base(f.Name()) + ":2: y := x + x",
+	}
+	if !reflect.DeepEqual(app.list.entries, want) {
+		t.Errorf("got references %q, want %q", app.list.entries, want)
+	}
+	app.handleListKey(termesc.DownKey)
+	app.handleListKey("\r")
+	if app.list != nil {
+		t.Error("list still open after picking an entry")
+	}
+	checkCursorPos(t, 3, w, point{X: 5, Y: 1})
+	if len(app.navStack) != 1 {
+		t.Errorf("navigation stack has %d entries, want 1", len(app.navStack))
+	}
+}
+
+func TestTagsDefinition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mflg-tags-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.c":   "int main() {\n\treturn helper();\n}\n",
+		"helper.c": "#include <stdio.h>\n\nint helper() { return 0; }\n",
+		"tags":     "helper\thelper.c\t/^int helper() { return 0; }$/;\"\tf\nmain\tmain.c\t1;\"\tf\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	mainFile := filepath.Join(dir, "main.c")
+	if err := app.navigateTo(mainFile + ":2"); err != nil {
+		t.Fatal(err)
+	}
+	app.mainWindow.cursorPos = point{X: 14, Y: 1}
+	app.gotoDefinition()
+	if want := filepath.Join(dir, "helper.c"); app.filename != want {
+		t.Fatalf("went to %s, want %s", app.filename, want)
+	}
+	checkCursorPos(t, 1, app.mainWindow, point{X: 4, Y: 2})
+	if err := app.back(); err != nil {
+		t.Fatal(err)
+	}
+	if app.filename != mainFile {
+		t.Errorf("went back to %s, want %s", app.filename, mainFile)
+	}
+}
+
+func TestSymbolNavigation(t *testing.T) {
+	f, err := ioutil.TempFile("", "mflg-symbol-test*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("package x\n\ntype T struct{}\n\nfunc (t *T) Method() {}\n\nfunc helper() {}\n")
+	f.Close()
+	defer os.Remove(f.Name())
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.testNav(t, f.Name()+":@helper")
+	app.checkFullLocation(t, f.Name(), point{X: 5, Y: 6})
+	app.testNav(t, ":@Method")
+	app.checkFullLocation(t, f.Name(), point{X: 12, Y: 4})
+	app.testBack(t)
+	app.checkFullLocation(t, f.Name(), point{X: 5, Y: 6})
+	app.testNav(t, ":@Missing")
+	app.checkFullLocation(t, f.Name(), point{X: 5, Y: 6})
+}
+
+func TestLanguageServerSymbolNavigation(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	defer app.closeLanguageServers()
+	app.config.Lang = map[string]config.LangConfig{"txt": {LanguageServer: []string{fakeLanguageServer}}}
+	f, err := ioutil.TempFile("", "mflg-lsp-test*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("def outer\n  def inner\ndef other\n")
+	f.Close()
+	defer os.Remove(f.Name())
+	app.testNav(t, f.Name())
+	w := app.mainWindow
+	app.runTasksUntil(t, func() bool { return w.doc != nil })
+	for _, tt := range []struct {
+		name string
+		want point
+	}{
+		{"inner", point{X: 6, Y: 1}},
+		{"other", point{X: 4, Y: 2}},
+		{"outer.inner", point{X: 6, Y: 1}},
+	} {
+		app.testNav(t, ":@"+tt.name)
+		app.runTasksUntil(t, func() bool { return w.windowCoordsToTextCoords(w.cursorPos) == tt.want })
+	}
+}
+
+func TestScanSymbols(t *testing.T) {
+	for _, tt := range []struct {
+		lang, text string
+		want       []symbol
+	}{
+		{"go", "package x\n\nfunc (r *R) M() {\n}\n\nconst C = 1\n", []symbol{{"M", point{X: 12, Y: 2}}, {"C", point{X: 6, Y: 5}}}},
+		{"python", "class A:\n    async def f(self):\n        pass\n", []symbol{{"A", point{X: 6, Y: 0}}, {"f", point{X: 14, Y: 1}}}},
+		{"c", "#define N 3\nstatic int *f(int x)\n{\n\treturn g(x);\n}\n", []symbol{{"N", point{X: 8, Y: 0}}, {"f", point{X: 12, Y: 1}}}},
+		{"rust", "pub(crate) async fn run() {}\nimpl S {}\n", []symbol{{"run", point{X: 20, Y: 0}}}},
+		{"markdown", "# Title\n\ntext\n## Usage ##\n", []symbol{{"Title", point{X: 2, Y: 0}}, {"Usage", point{X: 3, Y: 3}}}},
+		{"txt", "def x\n", nil},
+	} {
+		buf := buffer.New()
+		buf.ReadFrom(strings.NewReader(tt.text))
+		if got := scanSymbols(buf, tt.lang); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scanSymbols(%q, %q) = %v, want %v", tt.text, tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestParseBuildOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mflg-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"main.go", "main_test.go", "Foo.java", filepath.Join("src", "a.ts")} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := "# proj\n" +
+		"./main.go:4:2: undefined: fmt\n" +
+		"main.go:7:3: call f(1,2): wrong\n" +
+		"    main_test.go:12: got 1, want 2\n" +
+		"Foo.java:3: error: cannot find symbol\n" +
+		"src/a.ts(2,5): error TS2322: Type 'string' is not assignable to type 'number'.\n" +
+		"x.c:1:1: warning: no such file\n" +
+		"FAIL\tproj\t0.01s\n"
+	want := []buildError{
+		{filepath.Join(dir, "main.go"), 4, 2, lsp.SeverityError, "undefined: fmt"},
+		{filepath.Join(dir, "main.go"), 7, 3, lsp.SeverityError, "call f(1,2): wrong"},
+		{filepath.Join(dir, "main_test.go"), 12, 0, lsp.SeverityError, "got 1, want 2"},
+		{filepath.Join(dir, "Foo.java"), 3, 0, lsp.SeverityError, "cannot find symbol"},
+		{filepath.Join(dir, "src", "a.ts"), 2, 5, lsp.SeverityError, "TS2322: Type 'string' is not assignable to type 'number'."},
+	}
+	if got := parseBuildOutput([]byte(out), dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mflg-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The second file's name would be mangled if it were passed through navigateTo.
+	nameA, nameB := filepath.Join(dir, "a.c"), filepath.Join(dir, "b:$1.c")
+	files := map[string]string{
+		nameA: "int x;\nint y;\nint z;\n",
+		nameB: "int x;\nint y;\nü ü z;\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.config.Lang = map[string]config.LangConfig{"c": {
+		Build: []string{"sh", "-c", "echo 'b:$1.c:3:7: error: bad z'; echo 'a.c:2: warning: bad y'; exit 1"},
+	}}
+	app.testNav(t, nameA)
+	app.runBuild()
+	app.runTasksUntil(t, func() bool { return !app.buildPending })
+	if want := []diagnostic{{Range: textRange{Begin: point{Y: 1}, End: point{Y: 1}}, Severity: lsp.SeverityWarning, Message: "bad y"}}; !reflect.DeepEqual(app.mainWindow.buildMarks, want) {
+		t.Errorf("build marks in a.c are %v, want %v", app.mainWindow.buildMarks, want)
+	}
+	app.gotoBuildError(1)
+	app.checkFullLocation(t, nameB, point{X: 4, Y: 2})
+	if want := "(1/2) bad z"; app.note != want {
+		t.Errorf("notification is %q, want %q", app.note, want)
+	}
+	if len(app.mainWindow.buildMarks) != 1 {
+		t.Errorf("b.c has %d build marks, want 1", len(app.mainWindow.buildMarks))
+	}
+	app.gotoBuildError(1)
+	app.checkFullLocation(t, nameA, point{X: 0, Y: 1})
+	app.gotoBuildError(1)
+	app.checkFullLocation(t, nameB, point{X: 4, Y: 2})
+	app.gotoBuildError(-1)
+	app.checkFullLocation(t, nameA, point{X: 0, Y: 1})
+	app.testBack(t)
+	app.checkFullLocation(t, nameB, point{X: 4, Y: 2})
+	// Errors are found where their marks have been moved to by later edits.
+	app.mainWindow.gotoTextPos(point{X: 0, Y: 0})
+	typeString(app.mainWindow, "\r")
+	app.gotoBuildError(-1)
+	app.checkFullLocation(t, nameB, point{X: 4, Y: 3})
+}
+
+func TestFindInFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mflg-find-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		".git/HEAD":        "needle\n",
+		".gitignore":       "*.log\nbuild/\n",
+		"a.txt":            "hay\nneedle and needle\n",
+		"sub/b$1:x.txt":    "  the needle\n",
+		"sub/.gitignore":   "secret.txt\n",
+		"sub/secret.txt":   "needle\n",
+		"debug.log":        "needle\n",
+		"build/out.txt":    "needle\n",
+		"data.bin":         "needle\x00\n",
+		"other/needles.md": "no match here\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.testNav(t, filepath.Join(dir, "a.txt"))
+	app.findInFiles(regexp.MustCompile(`needle\b`))
+	lv := app.list
+	app.runTasksUntil(t, func() bool { return !strings.HasSuffix(lv.title, "(searching...)") })
+	want := []string{
+		"a.txt:2:1: needle and needle",
+		"a.txt:2:12: needle and needle",
+		filepath.Join("sub", "b$1:x.txt") + ":1:7: the needle",
+	}
+	if !reflect.DeepEqual(lv.entries, want) {
+		t.Errorf("got matches %q, want %q", lv.entries, want)
+	}
+	if want := "Find in Files: needle\\b (3 matches)"; lv.title != want {
+		t.Errorf("list title is %q, want %q", lv.title, want)
+	}
+	app.handleListKey(termesc.DownKey)
+	app.handleListKey(termesc.DownKey)
+	app.handleListKey("\r")
+	app.checkFullLocation(t, filepath.Join(dir, "sub", "b$1:x.txt"), point{X: 6, Y: 0})
+	checkSelection(t, 1, app.mainWindow, optionalTextRange{textRange{Begin: point{X: 6, Y: 0}, End: point{X: 12, Y: 0}}, true})
+	app.testBack(t)
+	app.checkFullLocation(t, filepath.Join(dir, "a.txt"), point{X: 0, Y: 0})
+}
+
+func TestFindInFilesCancel(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	d, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testNav(t, filepath.Join(d, "A"))
+	app.findInFiles(regexp.MustCompile(`.`))
+	lv := app.list
+	app.handleListKey("\x1b")
+	if app.list != nil {
+		t.Fatal("list still open after pressing Esc")
+	}
+	// Let the search finish, so that it doesn't outlive the test; the list must not come back.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case f := <-app.taskQueue:
+			f()
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if app.list != nil || strings.HasSuffix(lv.title, "matches)") {
+		t.Errorf("canceled search still updated the list: %q", lv.title)
+	}
+}
+
+func TestReplaceInFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mflg-replace-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nameA, nameB, nameC := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt"), filepath.Join(dir, "c.txt")
+	files := map[string]string{
+		nameA: "one cat\ntwo cats\n",
+		nameB: "cat cat\r\nno dogs\r\ncat\r\n",
+		nameC: "the cat\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	app.testNav(t, nameA)
+	app.replaceInFiles(regexp.MustCompile(`c(a)t`), "d${1}wg")
+	lv := app.list
+	app.runTasksUntil(t, func() bool { return !strings.Contains(lv.title, "(searching...)") })
+	want := []string{
+		"a.txt:1:5: one cat",
+		"a.txt:2:5: two cats",
+		"b.txt:1:1: cat cat",
+		"b.txt:1:5: cat cat",
+		"b.txt:3:1: cat",
+		"c.txt:1:5: the cat",
+	}
+	if !reflect.DeepEqual(lv.entries, want) {
+		t.Fatalf("got matches %q, want %q", lv.entries, want)
+	}
+	wantPreview := []string{"-    1  one cat", "+    1  one dawg", "     2  two cats"}
+	if got := lv.preview(0); !reflect.DeepEqual(got, wantPreview) {
+		t.Errorf("preview of first match is %q, want %q", got, wantPreview)
+	}
+	// Exclude the second match in b.txt and the one in c.txt; change c.txt so that it no longer matches.
+	for _, i := range []int{3, 5} {
+		lv.selected = i
+		app.handleListKey(" ")
+	}
+	if err := ioutil.WriteFile(nameC, []byte("the dog\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lv.checked[5] = true
+	app.handleListKey("\r")
+	checkBufContent(t, app.mainWindow.buf, "one dawg\ntwo dawgs\n")
+	checkFileContents(t, nameA, "one dawg\ntwo dawgs\n")
+	checkFileContents(t, nameB, "dawg cat\r\nno dogs\r\ndawg\r\n")
+	checkFileContents(t, nameC, "the dog\n")
+	if want := "Replaced 4 matches in 2 files; 1 had changed and were skipped"; app.note != want {
+		t.Errorf("notification is %q, want %q", app.note, want)
+	}
+	app.mainWindow.undo()
+	checkBufContent(t, app.mainWindow.buf, "one cat\ntwo cats\n")
+}
+
+func TestIncrementalSearch(t *testing.T) {
+	app := newTestApplication()
+	defer app.fsWatcher.Close()
+	buf := buffer.New()
+	buf.ReadFrom(strings.NewReader("foo bar\nbaz\nbar foo\n"))
+	w := newWindow(app, stdWidth, stdHeight, buf)
+	w.highlighter = highlight.Language("", w)
+	app.mainWindow = w
+	app.filename = "test.txt"
+	w.cursorPos = point{X: 1, Y: 1}
+
+	app.startSearch()
+	typeString(app.promptWindow, "ba")
+	checkCursorPos(t, 1, w, point{X: 0, Y: 2})
+	want := []textRange{{Begin: point{X: 4, Y: 0}, End: point{X: 6, Y: 0}}, {Begin: point{X: 0, Y: 1}, End: point{X: 2, Y: 1}}, {Begin: point{X: 0, Y: 2}, End: point{X: 2, Y: 2}}}
+	if got := w.matchesBetween(0, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("highlighted %v, want %v", got, want)
+	}
+	typeString(app.promptWindow, "z")
+	checkCursorPos(t, 2, w, point{X: 0, Y: 1})
+	// An invalid regex leaves things as they are.
+	typeString(app.promptWindow, "(")
+	checkCursorPos(t, 3, w, point{X: 0, Y: 1})
+	app.promptWindow.backspace()
+	typeString(app.promptWindow, "q")
+	checkCursorPos(t, 4, w, point{X: 1, Y: 1})
+	app.cancelPrompt()
+	checkCursorPos(t, 5, w, point{X: 1, Y: 1})
+	if w.matchHighlight != nil {
+		t.Error("matches still highlighted after canceling the search")
+	}
+
+	app.startSearch()
+	typeString(app.promptWindow, "fo+")
+	checkCursorPos(t, 6, w, point{X: 4, Y: 2})
+	app.finishPrompt()
+	checkCursorPos(t, 7, w, point{X: 4, Y: 2})
+	checkSelection(t, 7, w, optionalTextRange{textRange{Begin: point{X: 4, Y: 2}, End: point{X: 7, Y: 2}}, true})
+	if len(app.navStack) != 1 || app.navStack[0].pos != (point{X: 1, Y: 1}) {
+		t.Errorf("navigation stack is %v, want the original position on top", app.navStack)
+	}
+	app.gotoMatch(1)
+	checkCursorPos(t, 8, w, point{X: 0, Y: 0})
+}
+
+func TestFindNextFollowsEdits(t *testing.T) {
+	app := newReplaceTestApplication("abc\nxbx\n", point{})
+	defer app.fsWatcher.Close()
+	w := app.mainWindow
+	app.searchRE = regexp.MustCompile("b")
+	app.gotoMatch(1)
+	app.checkNote(t, "Match 1 of 2")
+	w.resetSelectionState()
+	w.cursorPos = point{X: 0, Y: 1}
+	typeString(w, "b")
+	app.gotoMatch(1)
+	app.checkNote(t, "Match 3 of 3")
+}
+
+func TestMatchHighlightFollowsEdits(t *testing.T) {
+	w := newTestWindow(t, 20, 10, "abc\nxbx\n")
+	w.setMatchHighlight(regexp.MustCompile("b"))
+	if got := len(w.matchesBetween(0, 2)); got != 2 {
+		t.Fatalf("found %d matches, want 2", got)
+	}
+	w.cursorPos = point{X: 0, Y: 1}
+	typeString(w, "b")
+	if got := len(w.matchesBetween(0, 2)); got != 3 {
+		t.Errorf("after typing a match, found %d matches, want 3", got)
+	}
+}
+
+func newReplaceTestApplication(text string, cursor point) *application {
+	app := newTestApplication()
+	buf := buffer.New()
+	buf.ReadFrom(strings.NewReader(text))
+	w := newWindow(app, stdWidth, stdHeight, buf)
+	w.highlighter = highlight.Language("", w)
+	app.mainWindow = w
+	app.filename = "test.txt"
+	w.cursorPos = cursor
+	return app
+}
+
+func checkAskingAbout(t *testing.T, n int, app *application, want textRange) {
+	t.Helper()
+	if app.promptWindow == nil {
+		t.Fatalf("%d: not asking about any match, want %v", n, want)
+	}
+	if w := app.mainWindow; !w.selection.Set || w.selection.textRange != want {
+		t.Errorf("%d: selection is %v, want %v", n, w.selection, want)
+	}
+}
+
+func TestInteractiveReplace(t *testing.T) {
+	app := newReplaceTestApplication("cat cat\nthe cat\ncat\n", point{X: 0, Y: 1})
+	defer app.fsWatcher.Close()
+	w := app.mainWindow
+	app.replaceInteractively(regexp.MustCompile(`c(a)t`), "d${1}wg")
+	checkAskingAbout(t, 1, app, textRange{Begin: point{X: 4, Y: 1}, End: point{X: 7, Y: 1}})
+	typeString(app.promptWindow, "y")
+	checkAskingAbout(t, 2, app, textRange{Begin: point{X: 0, Y: 2}, End: point{X: 3, Y: 2}})
+	typeString(app.promptWindow, "n")
+	// Having reached the end of the buffer, it goes back to the start.
+	checkAskingAbout(t, 3, app, textRange{Begin: point{X: 0, Y: 0}, End: point{X: 3, Y: 0}})
+	typeString(app.promptWindow, "x")
+	checkAskingAbout(t, 4, app, textRange{Begin: point{X: 0, Y: 0}, End: point{X: 3, Y: 0}})
+	typeString(app.promptWindow, "a")
+	if app.promptWindow != nil {
+		t.Error("still asking after replacing all matches")
+	}
+	checkBufContent(t, w.buf, "dawg dawg\nthe dawg\ncat\n")
+	if want := "Replaced 3 matches"; app.note != want {
+		t.Errorf("notification is %q, want %q", app.note, want)
+	}
+	if w.selection.Set {
+		t.Error("match still selected after replacing")
+	}
+	w.undo()
+	checkBufContent(t, w.buf, "cat cat\nthe cat\ncat\n")
+}
+
+func TestInteractiveReplaceMultiline(t *testing.T) {
+	app := newReplaceTestApplication("é1\nü2\nx3\n", point{X: 0, Y: 1})
+	defer app.fsWatcher.Close()
+	w := app.mainWindow
+	app.replaceInteractively(regexp.MustCompile(`^(\pL)(\d)\n`), "$2$1 ")
+	checkAskingAbout(t, 1, app, textRange{Begin: point{X: 0, Y: 1}, End: point{X: 0, Y: 2}})
+	typeString(app.promptWindow, "y")
+	checkAskingAbout(t, 2, app, textRange{Begin: point{X: 3, Y: 1}, End: point{X: 0, Y: 2}})
+	typeString(app.promptWindow, "a")
+	if app.promptWindow != nil {
+		t.Error("still asking after replacing all matches")
+	}
+	checkBufContent(t, w.buf, "1é 2ü 3x ")
+	if want := "Replaced 3 matches"; app.note != want {
+		t.Errorf("notification is %q, want %q", app.note, want)
+	}
+}
+
+func TestInteractiveReplaceQuit(t *testing.T) {
+	for _, quit := range []func(*application){
+		func(app *application) { typeString(app.promptWindow, "q") },
+		func(app *application) { app.cancelPrompt() },
+	} {
+		app := newReplaceTestApplication("a\na\na\n", point{})
+		w := app.mainWindow
+		app.replaceInteractively(regexp.MustCompile(`a`), "b\nb")
+		typeString(app.promptWindow, "y")
+		checkAskingAbout(t, 1, app, textRange{Begin: point{X: 0, Y: 2}, End: point{X: 1, Y: 2}})
+		typeString(app.promptWindow, "Y")
+		checkAskingAbout(t, 2, app, textRange{Begin: point{X: 0, Y: 4}, End: point{X: 1, Y: 4}})
+		quit(app)
+		if app.promptWindow != nil {
+			t.Error("still asking after quitting")
+		}
+		checkBufContent(t, w.buf, "b\nb\nb\nb\na\n")
+		// Further typing must start a new undo step.
+		w.cursorPos = point{X: 0, Y: 4}
+		typeString(w, "c")
+		w.undo()
+		checkBufContent(t, w.buf, "b\nb\nb\nb\na\n")
+		w.undo()
+		checkBufContent(t, w.buf, "a\na\na\n")
+		app.fsWatcher.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/dpinela/mflg/internal/buffer"
+)
+
+// A block selection selects a rectangle of display columns across several lines. It is made of one
+// cursor per line, selecting the characters that start inside the rectangle on that line; lines too
+// short to reach it get a cursor at their end, with nothing selected.
+
+// markBlockBound marks the cursor position as a corner of a block selection. If a corner was
+// already marked, it selects the block between it and the cursor instead.
+func (w *window) markBlockBound() {
+	tp := w.windowCoordsToTextCoords(w.cursorPos)
+	if w.blockAnchor.Set {
+		w.selectBlock(w.blockAnchor.point, tp)
+		w.blockAnchor = optionalPoint{}
+		return
+	}
+	w.resetSelectionState()
+	w.clearExtraCursors()
+	w.blockAnchor.Put(tp)
+}
+
+// selectBlock selects the block with the characters at a and b in opposite corners. The main cursor
+// goes on b's line.
+func (w *window) selectBlock(a, b point) {
+	left, right := w.displayColumn(a), w.displayColumn(b)
+	if right < left {
+		left, right = right, left
+	}
+	w.clearSelection()
+	w.clearExtraCursors()
+	var main cursor
+	for y := min(a.Y, b.Y); y <= max(a.Y, b.Y); y++ {
+		c := cursor{pos: point{X: w.charAtColumn(y, right), Y: y}}
+		if begin := (point{X: w.charAtColumn(y, left), Y: y}); begin != c.pos {
+			c.selection.Put(textRange{Begin: begin, End: c.pos})
+		}
+		if y == b.Y {
+			main = c
+		} else {
+			w.addExtraCursor(c)
+		}
+	}
+	w.selection = main.selection
+	w.cursorPos = w.textCoordsToWindowCoords(main.pos)
+	w.followCursor()
+	w.needsRedraw = true
+}
+
+// displayColumn returns the display column where the character at tp starts, counting from the
+// start of its line rather than of its row on screen.
+func (w *window) displayColumn(tp point) int {
+	wx, _ := w.scanLineUntil(w.buf.Line(tp.Y), 0, func(_, tx int) bool { return tx >= tp.X })
+	return wx
+}
+
+// charAtColumn returns the index of the first character in the line at index y that starts at or
+// after the display column col, or the length of the line if there is none.
+func (w *window) charAtColumn(y, col int) int {
+	_, tx := w.scanLineUntil(trimLineEnding(w.buf.Line(y)), 0, func(wx, _ int) bool { return wx >= col })
+	return tx
+}
+
+// insertBlock inserts lines one below the other, starting at the cursor, each at the cursor's
+// display column, replacing the selection if there is one. Lines too short to reach that column are
+// padded with spaces, and new lines are added at the end of the buffer if needed.
+func (w *window) insertBlock(lines []string) {
+	if w.formatPending {
+		return
+	}
+	if w.selection.Set {
+		w.backspace()
+	} else {
+		w.takeSnapshot()
+	}
+	tp := w.windowCoordsToTextCoords(w.cursorPos)
+	col := w.displayColumn(tp)
+	end := tp
+	for i, text := range lines {
+		y := tp.Y + i
+		if y >= w.buf.LineCount() {
+			last := w.buf.LineCount() - 1
+			w.insert("\n", point{X: buffer.CharCount(w.buf.Line(last)), Y: last})
+		}
+		line := trimLineEnding(w.buf.Line(y))
+		wx, tx := w.scanLineUntil(line, 0, func(wx, _ int) bool { return wx >= col })
+		at := point{X: tx, Y: y}
+		text = strings.Repeat(" ", max(col-wx, 0)) + text
+		w.insert(text, at)
+		if i == 0 {
+			end = posAfterInsertion(at, text)
+		}
+	}
+	w.gotoTextPos(end)
+	w.needsRedraw = true
+	w.notifyChange()
+}
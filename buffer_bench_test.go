@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// largeDocument is about 200k lines long; at this size, any edit whose cost is proportional to the
+// number of lines in the file dominates everything else.
+var largeDocument = strings.Repeat(testDocument+"\n", 200000/strings.Count(testDocument+"\n", "\n"))
+
+func newLargeTestWindow(b *testing.B) *window {
+	w := newTestWindow(b, 100, 30, largeDocument)
+	w.cursorPos = point{X: 3, Y: 5}
+	return w
+}
+
+func BenchmarkLineBreakLargeFile(b *testing.B) {
+	w := newLargeTestWindow(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.typeText("\r")
+	}
+}
+
+func BenchmarkJoinLinesLargeFile(b *testing.B) {
+	w := newLargeTestWindow(b)
+	for i := 0; i < b.N; i++ {
+		w.wrappedBuf.InsertLineBreak(point{Y: 5})
+	}
+	w.cursorPos = point{Y: 6}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.backspace()
+	}
+}
+
+func BenchmarkTypeLargeFile(b *testing.B) {
+	w := newLargeTestWindow(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%80 == 0 {
+			w.typeText("\r")
+		}
+		w.typeText("x")
+	}
+}
+
+func BenchmarkPasteLargeFile(b *testing.B) {
+	w := newLargeTestWindow(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.insertText([]byte("one\ntwo\nthree\n"))
+	}
+}
+
+func BenchmarkDeleteRangeLargeFile(b *testing.B) {
+	w := newLargeTestWindow(b)
+	w.insertText([]byte(strings.Repeat("one\ntwo\nthree\n", b.N)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.selection.Put(textRange{Begin: point{Y: 10}, End: point{Y: 13}})
+		w.backspace()
+	}
+}
+
+func BenchmarkCopyLargeFile(b *testing.B) {
+	w := newLargeTestWindow(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.buf.Copy()
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/lsp"
+)
+
+// A buildError is a message about a place in a file, printed by a build command.
+type buildError struct {
+	filename  string
+	line, col int // Both start from 1; col is 0 if the message doesn't give one
+	severity  lsp.DiagnosticSeverity
+	message   string
+}
+
+// runBuild saves the open file, then runs the build command for its language in the root of its
+// project. Once it finishes, the errors in its output replace the error list.
+func (app *application) runBuild() {
+	command := app.mainWindow.langConfig.Build
+	if len(command) == 0 {
+		app.setNotification("No build command is configured for this language")
+		return
+	}
+	if app.buildPending {
+		app.setNotification("A build is already running")
+		return
+	}
+	app.finishFormatNow()
+	app.saveNow()
+	app.buildPending = true
+	app.setNotification("Building...")
+	dir := projectRoot(app.filename)
+	go func() {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		app.do(func() {
+			app.buildPending = false
+			if _, ok := err.(*exec.ExitError); err != nil && !ok {
+				app.setNotification(err.Error())
+				return
+			}
+			app.setBuildErrors(parseBuildOutput(out, dir))
+			switch n := len(app.buildErrors); {
+			case n > 0:
+				app.setNotification(fmt.Sprintf("Build errors: %d", n))
+			case err != nil:
+				app.setNotification("Build failed: " + err.Error())
+			default:
+				app.setNotification("Build succeeded")
+			}
+		})
+	}()
+}
+
+// setBuildErrors replaces the error list, and marks the errors in the open file.
+func (app *application) setBuildErrors(errs []buildError) {
+	app.buildErrors = errs
+	app.buildErrorIndex = -1
+	app.markBuildErrors(app.mainWindow, app.filename)
+}
+
+// markBuildErrors marks the errors in the file at filename in w's gutter.
+// Columns in build errors count bytes, as in compiler messages.
+func (app *application) markBuildErrors(w *window, filename string) {
+	w.buildMarks, w.buildMarkErrs = w.buildMarks[:0], w.buildMarkErrs[:0]
+	for i, e := range app.buildErrors {
+		if e.filename == filename && e.line <= w.buf.LineCount() {
+			line := trimLineEnding(w.buf.Line(e.line - 1))
+			p := point{X: buffer.CharCount(line[:min(max(e.col-1, 0), len(line))]), Y: e.line - 1}
+			w.buildMarks = append(w.buildMarks, diagnostic{
+				Range:    textRange{Begin: p, End: p},
+				Severity: e.severity,
+				Message:  e.message,
+			})
+			w.buildMarkErrs = append(w.buildMarkErrs, i)
+		}
+	}
+	sort.Stable(buildMarkOrder{w})
+	w.needsRedraw = true
+}
+
+// buildMarkOrder sorts a window's build marks by line, keeping each one's error index with it.
+type buildMarkOrder struct{ w *window }
+
+func (o buildMarkOrder) Len() int { return len(o.w.buildMarks) }
+func (o buildMarkOrder) Less(i, j int) bool {
+	return o.w.buildMarks[i].Range.Begin.Y < o.w.buildMarks[j].Range.Begin.Y
+}
+func (o buildMarkOrder) Swap(i, j int) {
+	o.w.buildMarks[i], o.w.buildMarks[j] = o.w.buildMarks[j], o.w.buildMarks[i]
+	o.w.buildMarkErrs[i], o.w.buildMarkErrs[j] = o.w.buildMarkErrs[j], o.w.buildMarkErrs[i]
+}
+
+// buildMarkPos returns the current position of the mark for the error at index i in the error list,
+// and whether there is one in the window.
+func (w *window) buildMarkPos(i int) (point, bool) {
+	for k, j := range w.buildMarkErrs {
+		if j == i {
+			return w.buildMarks[k].Range.Begin, true
+		}
+	}
+	return point{}, false
+}
+
+// gotoBuildError goes to the error delta places after the last one gone to in the error list,
+// wrapping around at either end, and displays its message.
+func (app *application) gotoBuildError(delta int) {
+	n := len(app.buildErrors)
+	if n == 0 {
+		app.setNotification("No build errors")
+		return
+	}
+	i := app.buildErrorIndex + delta
+	if app.buildErrorIndex == -1 && delta < 0 {
+		i = n - 1
+	}
+	i = (i%n + n) % n
+	e := app.buildErrors[i]
+	// The file's build marks follow the edits made to it since the build, so the error's mark says
+	// where it is now.
+	if err := app.jumpTo(location{filename: e.filename}); err != nil {
+		app.setNotification(err.Error())
+		return
+	}
+	if p, ok := app.mainWindow.buildMarkPos(i); ok {
+		app.mainWindow.gotoTextPos(p)
+	}
+	app.buildErrorIndex = i
+	app.setNotification(fmt.Sprintf("(%d/%d) %s", i+1, n, e.message))
+}
+
+// tscMessageRE matches the messages printed by the TypeScript compiler, such as
+// "src/a.ts(12,5): error TS2322: Type 'string' is not assignable to type 'number'."
+var tscMessageRE = regexp.MustCompile(`^(.+?)\((\d+),(\d+)\):\s*(.*)$`)
+
+// parseBuildOutput extracts the errors from the output of a build command run in the directory dir.
+// It understands messages in the forms "file:line:col: message" and "file:line: message", printed by
+// Go, gcc, javac and many others, as well as those printed by tsc. Messages about files that don't
+// exist are left out, since they are probably not messages at all.
+func parseBuildOutput(out []byte, dir string) []buildError {
+	var errs []buildError
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		var m []string
+		path := ""
+		for _, re := range []*regexp.Regexp{tscMessageRE, checkerMessageRE} {
+			if m = re.FindStringSubmatch(sc.Text()); m == nil {
+				continue
+			}
+			path = filepath.Clean(strings.TrimSpace(m[1]))
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				break
+			}
+			m = nil
+		}
+		if m == nil {
+			continue
+		}
+		e := buildError{filename: path}
+		e.line, _ = strconv.Atoi(m[2])
+		e.col, _ = strconv.Atoi(m[3])
+		if e.line < 1 {
+			continue
+		}
+		e.severity, e.message = messageSeverity(m[4])
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// buildMarksBetween returns the build errors marked on lines i through j-1 of the window's buffer.
+func (w *window) buildMarksBetween(i, j int) []diagnostic {
+	start := sort.Search(len(w.buildMarks), func(k int) bool { return w.buildMarks[k].Range.Begin.Y >= i })
+	end := sort.Search(len(w.buildMarks), func(k int) bool { return w.buildMarks[k].Range.Begin.Y >= j })
+	return w.buildMarks[start:end]
+}
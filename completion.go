@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpinela/charseg"
+	"github.com/mattn/go-runewidth"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/color"
+	"github.com/dpinela/mflg/internal/lsp"
+	"github.com/dpinela/mflg/internal/termdraw"
+	"github.com/dpinela/mflg/internal/termesc"
+)
+
+// A completionPopup offers a list of ways to complete the word being typed in the main window.
+type completionPopup struct {
+	win      *window
+	start    point            // Where the word being completed starts
+	items    []completionItem // Everything on offer
+	shown    []completionItem // The items that match the word as typed so far
+	selected int              // The index in shown of the item that Tab/Enter accepts
+	top      int              // The index in shown of the first item on screen
+
+	// Where the popup was last drawn, in screen coordinates.
+	pos, size termdraw.Point
+}
+
+// A completionItem is one entry in a completion popup.
+type completionItem struct {
+	label, detail string
+	filter        string // What the word being completed must be a prefix of for the item to be shown
+	text          string // The text to insert
+	start         point  // The start of the text that the item replaces; the end is the cursor
+}
+
+// How many items a completion popup shows at once, at most.
+const maxCompletionRows = 8
+
+// How long to wait for a language server to answer a completion request.
+const completionTimeout = 3 * time.Second
+
+var (
+	completionStyle         = termdraw.Style{Foreground: &color.Color{R: 230, G: 230, B: 230}, Background: &color.Color{R: 60, G: 60, B: 60}}
+	completionSelectedStyle = termdraw.Style{Foreground: &color.Color{R: 230, G: 230, B: 230}, Background: &color.Color{R: 60, G: 60, B: 60}, Inverted: true}
+)
+
+// openCompletion opens a completion popup for the word before the cursor in the main window.
+// The items come from the language server, if there is one; otherwise, they are the other words
+// in the buffer that start with the same characters.
+func (app *application) openCompletion() {
+	w := app.mainWindow
+	if app.promptWindow != nil || w.formatPending {
+		return
+	}
+	tp := w.windowCoordsToTextCoords(w.cursorPos)
+	start := tp
+	if tp.X > 0 {
+		if word := w.buf.WordBoundsAt(point{X: tp.X - 1, Y: tp.Y}); !word.Empty() {
+			start = word.Begin
+		}
+	}
+	if w.doc == nil {
+		if start == tp {
+			return
+		}
+		app.showCompletion(w, start, bufferCompletions(w.buf, start))
+		return
+	}
+	client, uri, pos := w.doc.client, w.doc.uri, lspPosition(w.buf, tp)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+		defer cancel()
+		items, err := client.Completion(ctx, uri, pos)
+		app.do(func() {
+			if err != nil {
+				app.setNotification(err.Error())
+				return
+			}
+			if app.mainWindow == w && app.promptWindow == nil {
+				app.showCompletion(w, start, lspCompletions(w.buf, start, items))
+			}
+		})
+	}()
+}
+
+// How many lines above and below the cursor bufferCompletions looks for words in. Scanning the
+// whole of a large file every time would make the popup slow to appear.
+const completionScanLines = 2000
+
+// bufferCompletions returns an item for each distinct word in buf near start, for the word
+// starting there.
+func bufferCompletions(buf *buffer.Buffer, start point) []completionItem {
+	seen := map[string]bool{}
+	from, to := max(start.Y-completionScanLines, 0), min(start.Y+completionScanLines+1, buf.LineCount())
+	for _, line := range buf.SliceLines(from, to) {
+		for _, word := range buffer.Words(line) {
+			seen[word] = true
+		}
+	}
+	items := make([]completionItem, 0, len(seen))
+	for word := range seen {
+		items = append(items, completionItem{label: word, filter: word, text: word, start: start})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].label < items[j].label })
+	return items
+}
+
+// lspCompletions converts the completion items sent by a language server for buf, for the word
+// starting at start.
+func lspCompletions(buf *buffer.Buffer, start point, items []lsp.CompletionItem) []completionItem {
+	cs := make([]completionItem, len(items))
+	for i, item := range items {
+		c := completionItem{label: item.Label, detail: item.Detail, filter: item.FilterText, text: item.InsertText, start: start}
+		if c.filter == "" {
+			c.filter = item.Label
+		}
+		if c.text == "" {
+			c.text = item.Label
+		}
+		if e := item.TextEdit; e != nil {
+			c.text = e.NewText
+			c.start = bufferPoint(buf, e.Range.Start)
+		}
+		cs[i] = c
+	}
+	return cs
+}
+
+func (app *application) showCompletion(w *window, start point, items []completionItem) {
+	app.completion = &completionPopup{win: w, start: start, items: items}
+	app.updateCompletion()
+	if app.completion == nil {
+		app.setNotification("No completions")
+	}
+}
+
+// updateCompletion narrows down the completion popup's items to those that match the word being
+// completed, closing it if there are none left or if the cursor moved out of the word.
+// It should be called after every action that may edit the main window or move its cursor while
+// the popup is open.
+func (app *application) updateCompletion() {
+	p := app.completion
+	w := p.win
+	tp := w.windowCoordsToTextCoords(w.cursorPos)
+	if app.mainWindow != w || app.promptWindow != nil || tp.Y != p.start.Y || tp.X < p.start.X {
+		app.closeCompletion()
+		return
+	}
+	line := w.buf.Line(tp.Y)
+	prefix := line[buffer.ByteIndexForChar(line, p.start.X):buffer.ByteIndexForChar(line, tp.X)]
+	if words := buffer.Words(prefix); prefix != "" && (len(words) != 1 || words[0] != prefix) {
+		app.closeCompletion()
+		return
+	}
+	p.shown = p.shown[:0]
+	lowerPrefix := strings.ToLower(prefix)
+	for _, item := range p.items {
+		if strings.HasPrefix(strings.ToLower(item.filter), lowerPrefix) && item.text != prefix {
+			p.shown = append(p.shown, item)
+		}
+	}
+	if len(p.shown) == 0 {
+		app.closeCompletion()
+		return
+	}
+	p.selected = min(p.selected, len(p.shown)-1)
+	w.needsRedraw = true
+}
+
+func (app *application) closeCompletion() {
+	if app.completion != nil {
+		app.completion.win.needsRedraw = true
+		app.completion = nil
+	}
+}
+
+// acceptCompletion replaces the word being completed with the selected item, then closes the popup.
+func (app *application) acceptCompletion() {
+	p := app.completion
+	item := p.shown[p.selected]
+	app.closeCompletion()
+	w := p.win
+	w.replaceRange(textRange{Begin: item.start, End: w.windowCoordsToTextCoords(w.cursorPos)}, item.text)
+}
+
+// handleCompletionKey handles a key press while the completion popup is open, reporting whether
+// it was meant for the popup.
+func (app *application) handleCompletionKey(c string) bool {
+	p := app.completion
+	switch c {
+	case termesc.UpKey:
+		p.selected = (p.selected + len(p.shown) - 1) % len(p.shown)
+	case termesc.DownKey:
+		p.selected = (p.selected + 1) % len(p.shown)
+	case "\t", "\r":
+		app.acceptCompletion()
+	case "\x1b":
+		app.closeCompletion()
+	default:
+		return false
+	}
+	return true
+}
+
+// handleCompletionMouseEvent handles a mouse event while the completion popup is open, reporting
+// whether it was meant for the popup. Clicking an item accepts it; clicking elsewhere closes the popup.
+func (app *application) handleCompletionMouseEvent(ev termesc.MouseEvent) bool {
+	p := app.completion
+	i := p.top + ev.Y - p.pos.Y
+	if ev.X < p.pos.X || ev.X >= p.pos.X+p.size.X || ev.Y < p.pos.Y || ev.Y >= p.pos.Y+p.size.Y || i >= len(p.shown) {
+		if !ev.Move {
+			app.closeCompletion()
+		}
+		return false
+	}
+	switch ev.Button {
+	case termesc.LeftButton, termesc.NoButton:
+		p.selected = i
+	case termesc.ReleaseButton:
+		// Accept on release, so that the main window doesn't see half of the click.
+		p.selected = i
+		app.acceptCompletion()
+	case termesc.ScrollUpButton:
+		p.selected = max(p.selected-1, 0)
+	case termesc.ScrollDownButton:
+		p.selected = min(p.selected+1, len(p.shown)-1)
+	}
+	return true
+}
+
+// replaceRange replaces the text in r with text, as an undo step of its own, and puts the cursor
+// after it.
+func (w *window) replaceRange(r textRange, text string) {
+	if w.formatPending {
+		return
+	}
+	w.modificationTime = time.Time{}
+	w.takeSnapshot()
+	if !r.Empty() {
+		w.deleteRange(r)
+	}
+	w.insert(text, r.Begin)
+	w.gotoTextPos(posAfterInsertion(r.Begin, text))
+	w.modificationTime = time.Time{}
+	w.needsRedraw = true
+	w.notifyChange()
+}
+
+// draw draws the popup onto console, next to the start of the word being completed.
+// yLimit is the row below the last one it may take up.
+func (p *completionPopup) draw(console *termdraw.Screen, yLimit int) {
+	w := p.win
+	wp := w.textCoordsToWindowCoords(p.start)
+	anchor := termdraw.Point{X: wp.X + w.gutterWidth(), Y: wp.Y - w.topLine}
+	if anchor.Y < 0 || anchor.Y >= yLimit {
+		// The word being completed was scrolled out of view.
+		p.size = termdraw.Point{}
+		return
+	}
+	width := 0
+	for _, item := range p.shown {
+		width = max(width, runewidth.StringWidth(completionText(item)))
+	}
+	size := console.Size()
+	p.size = termdraw.Point{X: min(width+2, min(40, size.X)), Y: min(len(p.shown), maxCompletionRows)}
+	p.pos = termdraw.Point{X: max(0, min(anchor.X, size.X-p.size.X)), Y: anchor.Y + 1}
+	if p.pos.Y+p.size.Y > yLimit {
+		p.pos.Y = max(0, anchor.Y-p.size.Y)
+	}
+	// Keep the selected item on screen.
+	switch {
+	case p.selected < p.top:
+		p.top = p.selected
+	case p.selected >= p.top+p.size.Y:
+		p.top = p.selected - p.size.Y + 1
+	}
+	for i := 0; i < p.size.Y; i++ {
+		style := completionStyle
+		if p.top+i == p.selected {
+			style = completionSelectedStyle
+		}
+		putPadded(console, termdraw.Point{X: p.pos.X, Y: p.pos.Y + i}, " "+ellipsify(completionText(p.shown[p.top+i]), max(0, p.size.X-2)), p.size.X, style)
+	}
+}
+
+func completionText(item completionItem) string {
+	if item.detail == "" {
+		return item.label
+	}
+	return item.label + "  " + item.detail
+}
+
+// putPadded draws text onto console at pos, followed by as many spaces as needed to fill width columns.
+func putPadded(console *termdraw.Screen, pos termdraw.Point, text string, width int, style termdraw.Style) {
+	end := pos.X + width
+	for text != "" {
+		c := charseg.FirstGraphemeCluster(text)
+		console.Put(pos, termdraw.Cell{Content: c, Style: style})
+		pos.X += runewidth.StringWidth(c)
+		text = text[len(c):]
+	}
+	for ; pos.X < end; pos.X++ {
+		console.Put(pos, termdraw.Cell{Content: " ", Style: style})
+	}
+}
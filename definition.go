@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/ctags"
+	"github.com/dpinela/mflg/internal/lsp"
+)
+
+// How long to wait for a language server to say where a symbol is defined or used.
+const lookupTimeout = 5 * time.Second
+
+// gotoDefinition jumps to the definition of the symbol at the cursor in the main window, as given
+// by the language server, or else by the closest tags file.
+// If there are several definitions, the user gets to pick one.
+func (app *application) gotoDefinition() {
+	w := app.mainWindow
+	tp := w.windowCoordsToTextCoords(w.cursorPos)
+	if w.doc == nil {
+		app.gotoTagDefinition(w, tp)
+		return
+	}
+	client, uri, pos := w.doc.client, w.doc.uri, lspPosition(w.buf, tp)
+	bufs := map[string]*buffer.Buffer{app.filename: w.buf.Copy()}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		locs, err := client.Definition(ctx, uri, pos)
+		found, previews := resolveLocations(locs, bufs)
+		app.do(func() {
+			if err != nil {
+				app.setNotification(err.Error())
+				return
+			}
+			if app.mainWindow == w {
+				app.showLocations("Definitions", "No definition found", found, previews)
+			}
+		})
+	}()
+}
+
+// findReferences lists the places where the symbol at the cursor in the main window is used,
+// according to the language server.
+func (app *application) findReferences() {
+	w := app.mainWindow
+	if w.doc == nil {
+		app.setNotification("Finding references needs a language server")
+		return
+	}
+	client, uri, pos := w.doc.client, w.doc.uri, lspPosition(w.buf, w.windowCoordsToTextCoords(w.cursorPos))
+	bufs := map[string]*buffer.Buffer{app.filename: w.buf.Copy()}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		locs, err := client.References(ctx, uri, pos, true)
+		found, previews := resolveLocations(locs, bufs)
+		app.do(func() {
+			if err != nil {
+				app.setNotification(err.Error())
+				return
+			}
+			if app.mainWindow == w {
+				app.showLocations("References", "No references found", found, previews)
+			}
+		})
+	}()
+}
+
+// gotoTagDefinition looks up the word at tp in w in the closest tags file to the open file.
+func (app *application) gotoTagDefinition(w *window, tp point) {
+	word := w.buf.WordBoundsAt(tp)
+	if word.Empty() && tp.X > 0 {
+		word = w.buf.WordBoundsAt(point{X: tp.X - 1, Y: tp.Y})
+	}
+	if word.Empty() {
+		return
+	}
+	name := string(w.buf.CopyRange(word))
+	tagsPath := ctags.FindFile(filepath.Dir(app.filename))
+	if tagsPath == "" {
+		app.setNotification("No language server or tags file to look up definitions with")
+		return
+	}
+	f, err := os.Open(tagsPath)
+	if err != nil {
+		app.setNotification(err.Error())
+		return
+	}
+	tags, err := ctags.Lookup(f, name)
+	f.Close()
+	if err != nil {
+		app.setNotification(err.Error())
+		return
+	}
+	var (
+		locs     []location
+		previews []string
+	)
+	bufs := map[string]*buffer.Buffer{}
+	for _, tag := range tags {
+		filename := tag.File
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(filepath.Dir(tagsPath), filename)
+		}
+		buf, err := app.fileBuffer(filename, bufs)
+		if err != nil {
+			continue
+		}
+		y := tag.Find(buf.SliceLines(0, buf.LineCount()))
+		if y == -1 {
+			continue
+		}
+		line := buf.Line(y)
+		x := 0
+		if i := strings.Index(line, name); i != -1 {
+			x = buffer.CharCount(line[:i])
+		}
+		locs = append(locs, location{filename: filename, pos: point{X: x, Y: y}})
+		previews = append(previews, strings.TrimSpace(line))
+	}
+	app.showLocations("Definitions of "+name, "No definition of "+name+" found", locs, previews)
+}
+
+// resolveLocations converts locations sent by a language server, returning them along with the text
+// of the line at each one. Those in files that can't be read are left out.
+// Files are looked up in bufs first, and those read from disk are added to it. Since this may read
+// many files, it should be called outside the main goroutine, with a copy of the open file's buffer
+// in bufs.
+func resolveLocations(locs []lsp.Location, bufs map[string]*buffer.Buffer) (resolved []location, previews []string) {
+	for _, loc := range locs {
+		filename := lsp.URIPath(loc.URI)
+		if filename == "" {
+			continue
+		}
+		buf, err := cachedFileBuffer(filename, bufs)
+		if err != nil {
+			continue
+		}
+		pos := bufferPoint(buf, loc.Range.Start)
+		resolved = append(resolved, location{filename: filename, pos: pos})
+		previews = append(previews, strings.TrimSpace(buf.Line(pos.Y)))
+	}
+	return resolved, previews
+}
+
+// fileBuffer returns the content of the file at filename: the main window's buffer if it is the
+// open file, or otherwise what is on disk. Files read from disk are kept in cache.
+func (app *application) fileBuffer(filename string, cache map[string]*buffer.Buffer) (*buffer.Buffer, error) {
+	if filename == app.filename {
+		return app.mainWindow.buf, nil
+	}
+	return cachedFileBuffer(filename, cache)
+}
+
+// cachedFileBuffer returns the content of the file at filename, from cache if it is there, or else
+// read from disk and then added to cache.
+func cachedFileBuffer(filename string, cache map[string]*buffer.Buffer) (*buffer.Buffer, error) {
+	if buf := cache[filename]; buf != nil {
+		return buf, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := buffer.New()
+	if _, err := buf.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	cache[filename] = buf
+	return buf, nil
+}
+
+// showLocations jumps to the only location in locs, or lets the user pick one from a list if there
+// are several, showing each one's entry in previews next to it. If there are none, it displays notFound.
+func (app *application) showLocations(title, notFound string, locs []location, previews []string) {
+	switch len(locs) {
+	case 0:
+		app.setNotification(notFound)
+	case 1:
+		if err := app.jumpTo(locs[0]); err != nil {
+			app.setNotification(err.Error())
+		}
+	default:
+		entries := make([]string, len(locs))
+		for i, loc := range locs {
+			entries[i] = fmt.Sprintf("%s:%d: %s", app.displayPath(loc.filename), loc.pos.Y+1, previews[i])
+		}
+		app.openList(title, entries, func(i int) {
+			if err := app.jumpTo(locs[i]); err != nil {
+				app.setNotification(err.Error())
+			}
+		})
+	}
+}
+
+// displayPath returns a short form of path for display: relative to the directory of the open file,
+// if it is inside it.
+func (app *application) displayPath(path string) string {
+	if rel, err := filepath.Rel(filepath.Dir(app.filename), path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// jumpTo goes to loc, saving the current location in the navigation stack so that Back returns to it.
+func (app *application) jumpTo(loc location) error {
+	old := location{filename: app.filename, pos: app.mainWindow.windowCoordsToTextCoords(app.mainWindow.cursorPos)}
+	if err := app.gotoFile(loc.filename); err != nil {
+		return err
+	}
+	app.mainWindow.gotoTextPos(loc.pos)
+	app.navStack = append(app.navStack, old)
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/lsp"
+)
+
+// A diagnostic is an error, warning or other remark about part of a window's buffer, reported by a
+// language server or a checker program.
+type diagnostic struct {
+	Range    textRange
+	Severity lsp.DiagnosticSeverity
+	Message  string
+}
+
+// setDiagnostics replaces the window's diagnostics with ds.
+func (w *window) setDiagnostics(ds []diagnostic) {
+	sort.SliceStable(ds, func(i, j int) bool { return ds[i].Range.Begin.Less(ds[j].Range.Begin) })
+	w.diagnostics = ds
+	w.needsRedraw = true
+}
+
+// diagnosticAt returns the most serious diagnostic whose range includes tp, counting its end, or nil
+// if there is none.
+func (w *window) diagnosticAt(tp point) *diagnostic {
+	var found *diagnostic
+	for i := range w.diagnostics {
+		d := &w.diagnostics[i]
+		if tp.Less(d.Range.Begin) {
+			break
+		}
+		if !d.Range.End.Less(tp) && (found == nil || d.Severity < found.Severity) {
+			found = d
+		}
+	}
+	return found
+}
+
+// diagnosticsBetween returns the window's diagnostics that overlap the lines from i to j, exclusive.
+func (w *window) diagnosticsBetween(i, j int) []diagnostic {
+	var ds []diagnostic
+	for _, d := range w.diagnostics {
+		if d.Range.Begin.Y >= j {
+			break
+		}
+		if d.Range.End.Y >= i {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// widenEmptyRange makes r, if it is empty, cover the character after it, or the one before it at the
+// end of a line, so that a diagnostic with that range can be seen.
+func widenEmptyRange(buf *buffer.Buffer, r textRange) textRange {
+	if r.Begin != r.End {
+		return r
+	}
+	if r.Begin.X < buffer.CharCount(trimLineEnding(buf.Line(r.Begin.Y))) {
+		r.End.X++
+	} else if r.Begin.X > 0 {
+		r.Begin.X--
+	}
+	return r
+}
+
+// shiftDiagnostics moves the window's diagnostics and build error marks so that they stay over the
+// same text after c is applied to the buffer.
+func (w *window) shiftDiagnostics(c change) {
+	for _, ds := range [][]diagnostic{w.diagnostics, w.buildMarks} {
+		for i := range ds {
+			r := &ds[i].Range
+			r.Begin = shiftPoint(r.Begin, c)
+			r.End = shiftPoint(r.End, c)
+		}
+	}
+}
+
+// shiftPoint returns where the text at p ends up after c is applied.
+// Points within the removed text move to the start of the change.
+func shiftPoint(p point, c change) point {
+	if p.Less(c.At) {
+		return p
+	}
+	removedEnd := posAfterInsertion(c.At, c.Removed)
+	if p.Less(removedEnd) {
+		return c.At
+	}
+	insertedEnd := posAfterInsertion(c.At, c.Inserted)
+	if p.Y == removedEnd.Y {
+		return point{X: insertedEnd.X + p.X - removedEnd.X, Y: insertedEnd.Y}
+	}
+	return point{X: p.X, Y: p.Y + insertedEnd.Y - removedEnd.Y}
+}
+
+// showCursorDiagnostic displays the message of the diagnostic under the main window's cursor, unless
+// it is already being displayed.
+func (app *application) showCursorDiagnostic() {
+	w := app.mainWindow
+	if w == nil || app.promptWindow != nil {
+		return
+	}
+	msg := ""
+	if d := w.diagnosticAt(w.windowCoordsToTextCoords(w.cursorPos)); d != nil {
+		msg = d.Message
+	}
+	if msg != app.shownDiagnostic && msg != "" {
+		app.setNotification(msg)
+	}
+	app.shownDiagnostic = msg
+}
+
+// publishDiagnostics handles diagnostics sent by a language server.
+func (app *application) publishDiagnostics(p lsp.PublishDiagnosticsParams) {
+	w := app.mainWindow
+	// Diagnostics for an outdated version of the document would be in the wrong places;
+	// the server will send new ones for the current version.
+	if w == nil || w.doc == nil || w.doc.uri != p.URI || (p.Version != nil && *p.Version != w.doc.version) {
+		return
+	}
+	ds := make([]diagnostic, len(p.Diagnostics))
+	for i, d := range p.Diagnostics {
+		ds[i] = diagnostic{
+			Range:    widenEmptyRange(w.buf, textRange{Begin: bufferPoint(w.buf, d.Range.Start), End: bufferPoint(w.buf, d.Range.End)}),
+			Severity: d.Severity,
+			Message:  d.Message,
+		}
+		if ds[i].Severity == 0 {
+			ds[i].Severity = lsp.SeverityError
+		}
+		if d.Source != "" {
+			ds[i].Message = d.Source + ": " + d.Message
+		}
+	}
+	w.setDiagnostics(ds)
+}
+
+// checkFile runs the checker program for the main window's language, if there is one, on the open
+// file, and shows the errors it reports as diagnostics.
+// It should be called after each save.
+func (app *application) checkFile() {
+	w := app.mainWindow
+	command := w.langConfig.Checker
+	if len(command) == 0 {
+		return
+	}
+	filename := app.filename
+	checked := app.savedBuf
+	go func() {
+		cmd := exec.Command(command[0], append(command[1:], filename)...)
+		cmd.Dir = filepath.Dir(filename)
+		out, err := cmd.CombinedOutput()
+		app.do(func() {
+			if _, ok := err.(*exec.ExitError); err != nil && !ok {
+				app.setNotification(err.Error())
+				return
+			}
+			// If the file was changed since the check started, another check will follow the
+			// next save.
+			if app.mainWindow != w || app.savedBuf != checked || app.saveTimer.pending {
+				return
+			}
+			w.setDiagnostics(parseCheckerOutput(out, cmd.Dir, filename, w.buf))
+		})
+	}()
+}
+
+// checkerMessageRE matches the lines of a checker's output that refer to a place in a file, such as
+// "main.go:12:5: undefined: x". The column is optional.
+var checkerMessageRE = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?:\s*(.*)$`)
+
+// parseCheckerOutput extracts the diagnostics for the file at filename, whose content is buf, from
+// the output of a checker program run in the directory dir.
+// Line and column numbers are taken to start from 1, and columns to count bytes.
+func parseCheckerOutput(out []byte, dir, filename string, buf *buffer.Buffer) []diagnostic {
+	var ds []diagnostic
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		m := checkerMessageRE.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		path := filepath.Clean(m[1])
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		ty, _ := strconv.Atoi(m[2])
+		if path != filename || ty < 1 || ty > buf.LineCount() {
+			continue
+		}
+		line := buf.Line(ty - 1)
+		text := strings.TrimSuffix(line, "\n")
+		col := len(leadingIndentation(text))
+		if m[3] != "" {
+			col, _ = strconv.Atoi(m[3])
+			col = min(max(col-1, 0), len(text))
+		}
+		begin := point{X: buffer.CharCount(line[:col]), Y: ty - 1}
+		end := point{X: buffer.CharCount(text), Y: ty - 1}
+		if m[3] != "" {
+			if word := buf.WordBoundsAt(begin); !word.Empty() && word.Begin == begin {
+				end = word.End
+			}
+		}
+		r := widenEmptyRange(buf, textRange{Begin: begin, End: end})
+		ds = append(ds, checkerDiagnostic(r.Begin, r.End, m[4]))
+	}
+	return ds
+}
+
+// checkerDiagnostic makes a diagnostic for a checker message, using messageSeverity to determine its
+// severity.
+func checkerDiagnostic(begin, end point, msg string) diagnostic {
+	severity, msg := messageSeverity(msg)
+	return diagnostic{Range: textRange{Begin: begin, End: end}, Severity: severity, Message: msg}
+}
+
+// messageSeverity determines the severity of a compiler message from the "error", "warning" or "note"
+// label that many compilers start them with, and returns the message without the label.
+// The label is followed by a colon, or in tsc's case, by an error code, which is kept.
+func messageSeverity(msg string) (lsp.DiagnosticSeverity, string) {
+	for _, l := range []struct {
+		label    string
+		severity lsp.DiagnosticSeverity
+	}{
+		{"error", lsp.SeverityError},
+		{"warning", lsp.SeverityWarning},
+		{"note", lsp.SeverityInformation},
+	} {
+		rest := strings.TrimPrefix(msg, l.label)
+		switch {
+		case len(rest) == len(msg):
+		case strings.HasPrefix(rest, ":"):
+			return l.severity, strings.TrimSpace(rest[1:])
+		case strings.HasPrefix(rest, " TS"):
+			return l.severity, strings.TrimSpace(rest)
+		}
+	}
+	return lsp.SeverityError, msg
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/gitignore"
+)
+
+// A fileMatch is a place where a regex matched in a file.
+type fileMatch struct {
+	filename   string
+	line, col  int    // Both start from 1; the column counts bytes, as in compiler messages
+	text       string // The line containing the match, without its line terminator
+	start, end int    // The byte offsets of the match in text
+}
+
+// Find in Files stops after finding this many matches, so as not to fill up memory.
+const maxFileMatches = 10000
+
+var errTooManyMatches = errors.New("too many matches")
+
+// findInFiles searches the files in the open file's project for re, listing the matches as they are
+// found. Picking one goes to it and selects it.
+func (app *application) findInFiles(re *regexp.Regexp) {
+	var fs *fileSearch
+	fs = app.listFileMatches("Find in Files: "+re.String(), re, func(i int) {
+		m := fs.matches[i]
+		if err := app.jumpTo(location{filename: m.filename}); err != nil {
+			app.setNotification(err.Error())
+			return
+		}
+		// Select the match, unless the file has changed since it was found.
+		if w := app.mainWindow; m.line <= w.buf.LineCount() && trimLineEnding(w.buf.Line(m.line-1)) == m.text {
+			begin := point{X: buffer.CharCount(m.text[:m.start]), Y: m.line - 1}
+			w.selectMatch(textRange{Begin: begin, End: posAfterInsertion(begin, m.text[m.start:m.end])})
+		} else {
+			w.gotoLineAndColumn(m.line-1, m.start)
+		}
+	})
+}
+
+// A fileSearch is a search for a regex in the files of a project, whose matches are shown in a list.
+type fileSearch struct {
+	root    string
+	matches []fileMatch // The matches found so far, in the same order as the list's entries
+	list    *listView
+}
+
+// listFileMatches saves the open file, then searches the files in its project for re in the
+// background, opening a list with the given title and adding the matches to it as they are found.
+// Closing the list cancels the search, if it is still running.
+func (app *application) listFileMatches(title string, re *regexp.Regexp, onPick func(int)) *fileSearch {
+	app.finishFormatNow()
+	app.saveNow()
+	fs := &fileSearch{root: projectRoot(app.filename)}
+	ctx, cancel := context.WithCancel(context.Background())
+	app.openList(title+" (searching...)", nil, onPick)
+	lv := app.list
+	lv.onClose = cancel
+	fs.list = lv
+	go func() {
+		err := searchFiles(ctx, fs.root, re, func(ms []fileMatch) {
+			app.do(func() {
+				if app.list != lv {
+					return
+				}
+				for _, m := range ms {
+					rel, err := filepath.Rel(fs.root, m.filename)
+					if err != nil {
+						rel = m.filename
+					}
+					lv.entries = append(lv.entries, fmt.Sprintf("%s:%d:%d: %s", rel, m.line, m.col, strings.TrimSpace(m.text)))
+					if lv.checked != nil {
+						lv.checked = append(lv.checked, true)
+					}
+				}
+				fs.matches = append(fs.matches, ms...)
+				app.mainWindow.needsRedraw = true
+			})
+		})
+		app.do(func() {
+			if app.list != lv {
+				return
+			}
+			switch {
+			case err == errTooManyMatches:
+				lv.title = fmt.Sprintf("%s (stopped after %d matches)", title, len(fs.matches))
+			case err != nil:
+				lv.title = fmt.Sprintf("%s (%v)", title, err)
+			case len(fs.matches) == 0:
+				lv.title = title + " (no matches)"
+			default:
+				lv.title = fmt.Sprintf("%s (%d matches)", title, len(fs.matches))
+			}
+			app.mainWindow.needsRedraw = true
+		})
+	}()
+	return fs
+}
+
+// searchFiles looks for re in the files in the directory tree at root, calling report with the
+// matches in each file that has any. It skips .git directories, files ignored by .gitignore files
+// and binary files.
+func searchFiles(ctx context.Context, root string, re *regexp.Regexp, report func([]fileMatch)) error {
+	ignores := map[string]*gitignore.Matcher{}
+	n := 0
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// Skip what can't be read, rather than giving up on the whole search.
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != root && (info.Name() == ".git" || isIgnored(ignores, root, path, info.IsDir())) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if f, err := os.Open(filepath.Join(path, ".gitignore")); err == nil {
+				if m, err := gitignore.Parse(f); err == nil {
+					ignores[path] = m
+				}
+				f.Close()
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		ms := searchFile(path, re, maxFileMatches-n)
+		n += len(ms)
+		if len(ms) > 0 {
+			report(ms)
+		}
+		if n >= maxFileMatches {
+			return errTooManyMatches
+		}
+		return nil
+	})
+}
+
+// isIgnored reports whether the file at path is ignored by the .gitignore files in its directory or
+// those above it, up to root.
+func isIgnored(ignores map[string]*gitignore.Matcher, root, path string, isDir bool) bool {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if m := ignores[dir]; m != nil {
+			rel, err := filepath.Rel(dir, path)
+			if err == nil {
+				if ignored, matched := m.Match(filepath.ToSlash(rel), isDir); matched {
+					return ignored
+				}
+			}
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// searchFile returns up to limit matches for re in the file at path. Binary files, which are taken to
+// be those with a null byte near the start, as Git does, and files that can't be read have none.
+func searchFile(path string, re *regexp.Regexp, limit int) []fileMatch {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || bytes.IndexByte(data[:min(len(data), 8000)], 0) != -1 {
+		return nil
+	}
+	var ms []fileMatch
+	for y, line := range strings.SplitAfter(string(data), "\n") {
+		line = trimLineEnding(line)
+		for _, loc := range re.FindAllStringIndex(line, -1) {
+			if len(ms) == limit {
+				return ms
+			}
+			ms = append(ms, fileMatch{filename: path, line: y + 1, col: loc[0] + 1, text: line, start: loc[0], end: loc[1]})
+		}
+	}
+	return ms
+}
+
+// trimLineEnding returns line without its terminating newline, or carriage return and newline.
+func trimLineEnding(line string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dpinela/mflg/internal/atomicwrite"
+	"github.com/dpinela/mflg/internal/buffer"
+)
+
+// Since mflg saves files automatically, there is no point at which the user decides to make their
+// edits permanent; instead, the undo history of each file is saved some time after the file itself
+// is, and when it is closed, and restored when the file is opened again, so that it can be undone
+// across editing sessions.
+
+// The maximum number of undo steps saved for each file. Older ones are forgotten.
+const maxSavedSnapshots = 1000
+
+// savedHistory is the on-disk format of a file's undo history.
+type savedHistory struct {
+	ContentHash string // The SHA-256 hash of the file's content at the end of the history, in hex
+	Undo, Redo  []snapshot
+}
+
+// historyFilename returns the location where the undo history for the file at filename is kept.
+func historyFilename(filename string) (string, error) { return stateFilename("undo", filename) }
+
+// stateFilename returns the location where the state of the given kind kept for the file at
+// filename is stored, in a directory named after that kind in mflg's configuration directory.
+func stateFilename(kind, filename string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(filename))
+	return filepath.Join(dir, "mflg", kind, hex.EncodeToString(sum[:])), nil
+}
+
+func contentHash(buf *buffer.Buffer) string {
+	h := sha256.New()
+	buf.WriteTo(h)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileHash returns the hash of the content of the file at filename, computed as by contentHash.
+func fileHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveHistory saves the undo history of w, which is editing the file at filename.
+// It should only be called while w's buffer matches that file, whose content hash is hash.
+func saveHistory(filename string, w *window, hash string) (err error) {
+	if filename == os.DevNull {
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("error saving undo history: %w", err)
+		}
+	}()
+	hf, err := historyFilename(filename)
+	if err != nil {
+		return err
+	}
+	undo := w.undoStack
+	if n := len(undo) - maxSavedSnapshots; n > 0 {
+		undo = undo[n:]
+	}
+	h := savedHistory{ContentHash: hash, Undo: undo, Redo: w.redoStack}
+	return atomicwrite.Write(hf, func(out io.Writer) error { return json.NewEncoder(out).Encode(&h) })
+}
+
+// loadHistory restores the undo history saved for the file at filename into w, as long as the
+// file's content - which w should have just loaded - hasn't changed since then.
+func loadHistory(filename string, w *window) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("error loading undo history: %w", err)
+		}
+	}()
+	hf, err := historyFilename(filename)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(hf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var h savedHistory
+	if err := json.NewDecoder(f).Decode(&h); err != nil {
+		return err
+	}
+	if h.ContentHash == contentHash(w.buf) {
+		w.undoStack = h.Undo
+		w.redoStack = h.Redo
+	}
+	return nil
+}
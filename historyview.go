@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// showHistory lists the states in the main window's undo history, oldest first, along with when
+// the step leading to each was made and what it changed. Picking one returns the buffer to that state.
+func (app *application) showHistory() {
+	w := app.mainWindow
+	steps, current := w.historySteps()
+	entries := make([]string, len(steps)+1)
+	entries[0] = "Start of history"
+	for i, s := range steps {
+		entries[i+1] = describeSnapshot(s)
+	}
+	entries[current] += " (current)"
+	app.openList("Edit History (Enter: go to state)", entries, func(i int) {
+		if app.mainWindow == w {
+			w.gotoHistoryState(i)
+		}
+	})
+	app.list.selected = current
+	app.list.preview = func(i int) []string {
+		if i == 0 {
+			return nil
+		}
+		return snapshotPreview(steps[i-1])
+	}
+}
+
+// historySteps returns the steps in the window's history: first those on the undo stack, then those
+// on the redo stack, most recently undone first. State i of the history is the one after the first
+// i steps; historySteps also returns the index of the current state.
+func (w *window) historySteps() ([]snapshot, int) {
+	steps := append([]snapshot{}, w.undoStack...)
+	for i := len(w.redoStack) - 1; i >= 0; i-- {
+		steps = append(steps, w.redoStack[i])
+	}
+	return steps, len(w.undoStack)
+}
+
+// gotoHistoryState returns the window's buffer to state i of its history (see historySteps).
+// This is a new step of its own, which doesn't throw away any other states: undoing it goes back to
+// the state the buffer was in before, and the states that had been undone stay in the history.
+func (w *window) gotoHistoryState(i int) {
+	if w.formatPending {
+		return
+	}
+	if _, current := w.historySteps(); i == current {
+		return
+	}
+	w.keepUndoneSteps()
+	s := snapshot{Before: w.cursorState(), Changes: revertSteps(w.undoStack[i:]), Time: time.Now()}
+	for _, c := range s.Changes {
+		w.applyChange(c)
+	}
+	w.restoreCursorState(w.undoStack[i].Before)
+	s.After = w.cursorState()
+	w.undoStack = append(w.undoStack, s)
+	w.finishHistoryMove()
+}
+
+// revertSteps returns the changes that revert the given steps of history, which must be the last
+// ones to have been applied.
+func revertSteps(steps []snapshot) []change {
+	var cs []change
+	for i := len(steps) - 1; i >= 0; i-- {
+		for j := len(steps[i].Changes) - 1; j >= 0; j-- {
+			cs = append(cs, steps[i].Changes[j].inverse())
+		}
+	}
+	return cs
+}
+
+// describeSnapshot summarizes a step of undo history: when it was made, which lines it touched and
+// how many bytes it added and removed.
+func describeSnapshot(s snapshot) string {
+	when := "(unknown time)"
+	if !s.Time.IsZero() {
+		when = s.Time.Format("Jan _2 15:04:05")
+	}
+	first, last, added, removed := -1, -1, 0, 0
+	for _, c := range s.Changes {
+		end := max(posAfterInsertion(c.At, c.Removed).Y, posAfterInsertion(c.At, c.Inserted).Y)
+		if first == -1 || c.At.Y < first {
+			first = c.At.Y
+		}
+		last = max(last, end)
+		added += len(c.Inserted)
+		removed += len(c.Removed)
+	}
+	var lines string
+	switch {
+	case first == -1:
+		return when + "  no changes"
+	case first == last:
+		lines = fmt.Sprintf("line %d", first+1)
+	default:
+		lines = fmt.Sprintf("lines %d-%d", first+1, last+1)
+	}
+	return fmt.Sprintf("%s  %s, +%d -%d bytes", when, lines, added, removed)
+}
+
+// snapshotPreview returns the text removed and inserted by the changes in s, for a list view's preview.
+func snapshotPreview(s snapshot) []string {
+	var lines []string
+	for _, c := range s.Changes {
+		for _, line := range strings.SplitAfter(c.Removed, "\n") {
+			if line != "" {
+				lines = append(lines, "- "+trimLineEnding(line))
+			}
+		}
+		for _, line := range strings.SplitAfter(c.Inserted, "\n") {
+			if line != "" {
+				lines = append(lines, "+ "+trimLineEnding(line))
+			}
+		}
+	}
+	return lines
+}
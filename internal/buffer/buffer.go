@@ -13,17 +13,18 @@ import (
 
 // Buffer is a text buffer that support efficient access to individual lines of text.
 // It implements the io.ReaderFrom and io.WriterTo interfaces.
+//
+// The lines are stored in a persistent balanced tree, so that edits take time logarithmic in the
+// number of lines, and copies share all of their structure with the original.
 type Buffer struct {
-	lines []string
+	lines *rope
 }
 
-func New() *Buffer { return &Buffer{lines: []string{""}} }
+func New() *Buffer { return &Buffer{lines: newLeaf([]string{""})} }
 
-func (b *Buffer) Copy() *Buffer {
-	newLines := make([]string, len(b.lines))
-	copy(newLines, b.lines)
-	return &Buffer{lines: newLines}
-}
+// Copy returns a buffer with the same content as b, which can be modified independently of it.
+// It takes constant time.
+func (b *Buffer) Copy() *Buffer { return &Buffer{lines: b.lines} }
 
 // Indicates a buffer indented with tabs.
 const IndentTabs = 0
@@ -33,40 +34,43 @@ const IndentTabs = 0
 // If it cannot determine the indentation type, returns IndentTabs.
 func (b *Buffer) IndentType() int {
 	multiplesSeen := make([]int, 32)
-lineScan:
-	for _, line := range b.lines {
-		numSpaces := 0
-		hasTabs := false
-	prefixScan:
-		for i := range line {
-			switch line[i] {
-			case '\t':
-				if numSpaces > 0 {
-					// If we run into a line that mixes tabs and spaces, just ignore that line
-					// and hope to use the rest to find out what we need.
-					continue lineScan
-				}
-				hasTabs = true
-			case ' ':
-				if hasTabs {
-					continue lineScan
+	b.lines.eachLeaf(func(lines []string) bool {
+	lineScan:
+		for _, line := range lines {
+			numSpaces := 0
+			hasTabs := false
+		prefixScan:
+			for i := range line {
+				switch line[i] {
+				case '\t':
+					if numSpaces > 0 {
+						// If we run into a line that mixes tabs and spaces, just ignore that line
+						// and hope to use the rest to find out what we need.
+						continue lineScan
+					}
+					hasTabs = true
+				case ' ':
+					if hasTabs {
+						continue lineScan
+					}
+					numSpaces++
+				default:
+					break prefixScan
 				}
-				numSpaces++
-			default:
-				break prefixScan
 			}
-		}
-		switch {
-		case hasTabs:
-			multiplesSeen[0]++
-		case numSpaces > 0:
-			for i := 1; i < len(multiplesSeen); i++ {
-				if numSpaces%i == 0 {
-					multiplesSeen[i]++
+			switch {
+			case hasTabs:
+				multiplesSeen[0]++
+			case numSpaces > 0:
+				for i := 1; i < len(multiplesSeen); i++ {
+					if numSpaces%i == 0 {
+						multiplesSeen[i]++
+					}
 				}
 			}
 		}
-	}
+		return true
+	})
 	best := IndentTabs
 	bestCount := 0
 	for i, n := range multiplesSeen {
@@ -84,12 +88,13 @@ lineScan:
 // ReadFrom clears the buffer and replaces its content with the data read from r, reading
 // until EOF.
 func (b *Buffer) ReadFrom(r io.Reader) (n int64, err error) {
-	b.lines = b.lines[:0]
+	var lines []string
+	defer func() { b.lines = buildRope(lines) }()
 	br := bufio.NewReader(r)
 	for {
 		var line string
 		line, err = br.ReadString('\n')
-		b.lines = append(b.lines, line)
+		lines = append(lines, line)
 		if err != nil {
 			if err == io.EOF {
 				err = nil
@@ -103,32 +108,44 @@ func (b *Buffer) ReadFrom(r io.Reader) (n int64, err error) {
 // WriteTo writes the full content of the buffer to w.
 func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
 	var n int64
-	for _, line := range b.lines {
-		nw, err := w.Write([]byte(line))
-		n += int64(nw)
-		if err != nil {
-			return n, err
+	var err error
+	b.lines.eachLeaf(func(lines []string) bool {
+		for _, line := range lines {
+			var nw int
+			nw, err = io.WriteString(w, line)
+			n += int64(nw)
+			if err != nil {
+				return false
+			}
 		}
-	}
-	return n, nil
+		return true
+	})
+	return n, err
 }
 
 // Reader returns an io.Reader that implements Read by reading the full contents of b.
-// It is not safe to modify b concurrently with calls to Read on the Reader.
-func (b *Buffer) Reader() io.Reader { return &reader{lines: b.lines} }
+// The Reader sees the content b had when Reader was called; it is safe to modify b while it is
+// being read, even concurrently.
+func (b *Buffer) Reader() io.Reader { return &reader{src: b.lines} }
 
 type reader struct {
-	i     int
-	lines []string
+	src   *rope
+	y     int      // The index of the first line in lines
+	lines []string // The rest of the leaf currently being read
+	i     int      // The byte offset to read from in lines[0]
 }
 
 func (r *reader) Read(b []byte) (int, error) {
 	if len(r.lines) == 0 {
-		return 0, io.EOF
+		if r.y >= r.src.len() {
+			return 0, io.EOF
+		}
+		r.lines = r.src.leafFrom(r.y)
 	}
 	n := copy(b, r.lines[0][r.i:])
 	if r.i += n; r.i == len(r.lines[0]) {
 		r.lines = r.lines[1:]
+		r.y++
 		r.i = 0
 	}
 	return n, nil
@@ -136,28 +153,31 @@ func (r *reader) Read(b []byte) (int, error) {
 
 // SliceLines returns the lines of the buffer in the interval [i, j[.
 func (b *Buffer) SliceLines(i, j int) []string {
-	if j > len(b.lines) {
-		j = len(b.lines)
+	if j > b.LineCount() {
+		j = b.LineCount()
+	}
+	if i > j {
+		i = j
 	}
-	return b.lines[i:j]
+	return b.lines.appendLines(make([]string, 0, j-i), i, j)
 }
 
 // Line returns line i in the buffer.
 func (b *Buffer) Line(i int) string {
-	if i >= len(b.lines) {
-		i = len(b.lines) - 1
+	if i >= b.LineCount() {
+		i = b.LineCount() - 1
 	}
-	return b.lines[i]
+	return b.lines.line(i)
 }
 
 // LineCount returns the number of lines in the buffer.
-func (b *Buffer) LineCount() int { return len(b.lines) }
+func (b *Buffer) LineCount() int { return b.lines.len() }
 
 // WordBoundsAt finds the boundaries of the word spanning text-space point p, if there is one.
 // If there isn't, it returns an empty range whose endpoints are both equal to p.
 // A word is defined as a sequence of Unicode letters and numbers, possibly with combining marks.
 func (b *Buffer) WordBoundsAt(p Point) Range {
-	line := b.lines[p.Y]
+	line := b.Line(p.Y)
 	lastWordStart := -1
 	x := 0
 	lastWord := func() Range {
@@ -188,12 +208,34 @@ func (b *Buffer) WordBoundsAt(p Point) Range {
 	return Range{p, p}
 }
 
+// Words returns the words in line, in the order they appear.
+// Words are defined as for WordBoundsAt.
+func Words(line string) []string {
+	var words []string
+	start := -1
+	for i := 0; i < len(line); {
+		c := charseg.FirstGraphemeCluster(line[i:])
+		switch inWord := isWordChar(c); {
+		case inWord && start == -1:
+			start = i
+		case !inWord && start != -1:
+			words = append(words, line[start:i])
+			start = -1
+		}
+		i += len(c)
+	}
+	if start != -1 {
+		words = append(words, line[start:])
+	}
+	return words
+}
+
 // NextWordBoundary returns the position of the character to the right of the first word boundary after p.
 // Word characters are defined as for WordBoundsAt.
 //
 // If there are no more word boundaries after p, returns p.
 func (b *Buffer) NextWordBoundary(p Point) Point {
-	line := b.lines[p.Y]
+	line := b.Line(p.Y)
 	i := ByteIndexForChar(line, p.X)
 	q := p
 	var wasInWord bool
@@ -208,7 +250,7 @@ func (b *Buffer) NextWordBoundary(p Point) Point {
 		wasInWord = isInWord
 	}
 	// If we get here, we got to the end of the line without finding a word boundary. Go to the start of the next line.
-	if p.Y+1 < len(b.lines) {
+	if p.Y+1 < b.LineCount() {
 		return Point{0, p.Y + 1}
 	}
 	return q
@@ -219,7 +261,7 @@ func (b *Buffer) NextWordBoundary(p Point) Point {
 //
 // If there are no more word boundaries before p, returns p.
 func (b *Buffer) PrevWordBoundary(p Point) Point {
-	line := b.lines[p.Y]
+	line := b.Line(p.Y)
 	wasInWord := false
 	lastWordBoundary := -1
 	for i, x := 0, 0; i < len(line) && x < p.X; x++ {
@@ -235,7 +277,7 @@ func (b *Buffer) PrevWordBoundary(p Point) Point {
 	// No taking shortcuts with len() instead of CharCount() here; the values might be functionally equivalent, but tests will notice the difference.
 	if lastWordBoundary == -1 {
 		if p.Y > 0 {
-			return Point{CharCount(b.lines[p.Y-1]), p.Y - 1}
+			return Point{CharCount(b.Line(p.Y - 1)), p.Y - 1}
 		}
 		return p
 	}
@@ -256,39 +298,21 @@ func ByteIndexForChar(line string, col int) int {
 }
 
 func (b *Buffer) Insert(text string, p Point) {
-	line := b.lines[p.Y]
+	line := b.Line(p.Y)
 	insPoint := ByteIndexForChar(line, p.X)
-	numNewLines := strings.Count(text, "\n")
-	if numNewLines > 0 {
-		b.lines = append(b.lines, make([]string, numNewLines)...)
-		copy(b.lines[p.Y+1+numNewLines:], b.lines[p.Y+1:])
-		nl := strings.IndexByte(text, '\n')
-		carry := line[insPoint:]
-		b.lines[p.Y] = line[:insPoint] + text[:nl+1]
-		text = text[nl+1:]
-		for i := p.Y + 1; nl != -1; i++ {
-			newLine := text
-			q := strings.IndexByte(text, '\n')
-			if q != -1 {
-				q = q + 1
-				newLine, text = text[:q], text[q:]
-			}
-			b.lines[i] = newLine
-			nl = q
-		}
-		b.lines[p.Y+numNewLines] = b.lines[p.Y+numNewLines] + carry
+	if strings.IndexByte(text, '\n') == -1 {
+		b.lines = b.lines.set(p.Y, line[:insPoint]+text+line[insPoint:])
 		return
 	}
-	b.lines[p.Y] = line[:insPoint] + text + line[insPoint:]
+	newLines := strings.SplitAfter(line[:insPoint]+text, "\n")
+	newLines[len(newLines)-1] += line[insPoint:]
+	b.lines = b.lines.splice(p.Y, p.Y+1, newLines)
 }
 
 func (b *Buffer) InsertLineBreak(p Point) {
-	line := b.lines[p.Y]
-	b.lines = append(b.lines, "")
-	copy(b.lines[p.Y+1:], b.lines[p.Y:])
+	line := b.Line(p.Y)
 	i := ByteIndexForChar(line, p.X)
-	b.lines[p.Y] = line[:i] + "\n"
-	b.lines[p.Y+1] = line[i:]
+	b.lines = b.lines.splice(p.Y, p.Y+1, []string{line[:i] + "\n", line[i:]})
 }
 
 func (b *Buffer) DeleteChar(p Point) {
@@ -298,15 +322,13 @@ func (b *Buffer) DeleteChar(p Point) {
 		if p.Y == 0 {
 			return
 		}
-		prevLine := b.lines[p.Y-1]
-		b.lines[p.Y-1] = prevLine[:len(prevLine)-1] + b.lines[p.Y]
-		copy(b.lines[p.Y:], b.lines[p.Y+1:])
-		b.lines = b.lines[:len(b.lines)-1]
+		prevLine := b.Line(p.Y - 1)
+		b.lines = b.lines.splice(p.Y-1, p.Y+1, []string{prevLine[:len(prevLine)-1] + b.Line(p.Y)})
 	} else {
-		line := b.lines[p.Y]
+		line := b.Line(p.Y)
 		i := ByteIndexForChar(line, p.X-1)
 		n := NextCharBoundary(line[i:])
-		b.lines[p.Y] = line[:i] + line[i+n:]
+		b.lines = b.lines.set(p.Y, line[:i]+line[i+n:])
 	}
 }
 
@@ -314,40 +336,37 @@ func (b *Buffer) DeleteChar(p Point) {
 // The range is treated as a half-open range, and may extend past the end of the text.
 func (b *Buffer) DeleteRange(r Range) {
 	r = r.Normalize()
-	if r.Begin.Y >= len(b.lines) {
+	n := b.LineCount()
+	if r.Begin.Y >= n {
 		return
 	}
-	p := ByteIndexForChar(b.lines[r.Begin.Y], r.Begin.X)
-	if r.End.Y >= len(b.lines) {
-		b.lines[r.Begin.Y] = b.lines[r.Begin.Y][:p]
-		b.lines = b.lines[:r.Begin.Y+1]
+	first := b.Line(r.Begin.Y)
+	p := ByteIndexForChar(first, r.Begin.X)
+	if r.End.Y >= n {
+		b.lines = b.lines.splice(r.Begin.Y, n, []string{first[:p]})
 		return
 	}
-	q := ByteIndexForChar(b.lines[r.End.Y], r.End.X)
-	b.lines[r.Begin.Y] = b.lines[r.Begin.Y][:p] + b.lines[r.End.Y][q:]
-	if r.Begin.Y != r.End.Y {
-		// Delete all the lines entirely between the start and the end point;
-		// the line where the end point lies is deleted too, since it was
-		// merged into the start line.
-		copy(b.lines[r.Begin.Y+1:], b.lines[r.End.Y+1:])
-		b.lines = b.lines[:len(b.lines)-(r.End.Y-r.Begin.Y)]
-	}
+	last := b.Line(r.End.Y)
+	q := ByteIndexForChar(last, r.End.X)
+	// The line where the end point lies is deleted too, since it is merged into the start line.
+	b.lines = b.lines.splice(r.Begin.Y, r.End.Y+1, []string{first[:p] + last[q:]})
 }
 
 // ReplaceLine replaces the contents with line y with text.
-func (b *Buffer) ReplaceLine(y int, text string) { b.lines[y] = text }
+func (b *Buffer) ReplaceLine(y int, text string) { b.lines = b.lines.set(y, text) }
 
 // CopyRange returns a copy of the characters in the given range, as a
 // contiguous slice.
 func (b *Buffer) CopyRange(r Range) []byte {
-	p := ByteIndexForChar(b.lines[r.Begin.Y], r.Begin.X)
-	q := ByteIndexForChar(b.lines[r.End.Y], r.End.X)
+	first := b.Line(r.Begin.Y)
+	p := ByteIndexForChar(first, r.Begin.X)
 	if r.Begin.Y == r.End.Y {
-		return []byte(b.lines[r.Begin.Y][p:q])
+		return []byte(first[p:ByteIndexForChar(first, r.End.X)])
 	}
-	out := []byte(b.lines[r.Begin.Y][p:])
-	for i := r.Begin.Y + 1; i < r.End.Y; i++ {
-		out = append(out, b.lines[i]...)
+	last := b.Line(r.End.Y)
+	out := []byte(first[p:])
+	for _, line := range b.SliceLines(r.Begin.Y+1, r.End.Y) {
+		out = append(out, line...)
 	}
-	return append(out, b.lines[r.End.Y][:q]...)
+	return append(out, last[:ByteIndexForChar(last, r.End.X)]...)
 }
@@ -172,6 +172,22 @@ func TestWordBounds(t *testing.T) {
 	}
 }
 
+func TestWords(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"(){}\n", nil},
+		{"limão_2 (a,bc)\n", []string{"limão_2", "a", "bc"}},
+		{wordBoundsBracketsTest, []string{"teach", "a", "man", "to", "fish", "now"}},
+	} {
+		if got := Words(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Words(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
 func truncateWithEllipsis(s string, n int) string {
 	if n > len(s) {
 		return s
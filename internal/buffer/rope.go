@@ -0,0 +1,216 @@
+package buffer
+
+// maxLeafLines is the maximum number of lines held by each leaf of a rope.
+const maxLeafLines = 64
+
+// A rope is a persistent, height-balanced binary tree whose leaves hold runs of consecutive lines.
+// Nodes are never modified after they are created, so any number of ropes may share them; every
+// operation that changes a rope returns a new one, leaving the original intact.
+//
+// The nil *rope is a valid, empty rope.
+type rope struct {
+	left, right *rope
+	lines       []string // The lines in a leaf; always nil for interior nodes
+	count       int      // The number of lines in the rope
+	height      int      // 0 for leaves
+}
+
+func newLeaf(lines []string) *rope {
+	if len(lines) == 0 {
+		return nil
+	}
+	return &rope{lines: lines, count: len(lines)}
+}
+
+// newNode joins two ropes without rebalancing them.
+func newNode(left, right *rope) *rope {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	}
+	return &rope{left: left, right: right, count: left.count + right.count, height: 1 + max(left.height, right.height)}
+}
+
+// buildRope returns a balanced rope holding the given lines.
+// The rope takes ownership of the slice; the caller must not modify it afterwards.
+func buildRope(lines []string) *rope {
+	if len(lines) <= maxLeafLines {
+		return newLeaf(lines[:len(lines):len(lines)])
+	}
+	// Split at a leaf boundary so that all leaves but the last are full.
+	leaves := (len(lines) + maxLeafLines - 1) / maxLeafLines
+	mid := leaves / 2 * maxLeafLines
+	return newNode(buildRope(lines[:mid]), buildRope(lines[mid:]))
+}
+
+func (r *rope) len() int {
+	if r == nil {
+		return 0
+	}
+	return r.count
+}
+
+func (r *rope) depth() int {
+	if r == nil {
+		return -1
+	}
+	return r.height
+}
+
+func (r *rope) isLeaf() bool { return r.left == nil }
+
+// line returns line i of the rope, which must be in range.
+func (r *rope) line(i int) string {
+	for !r.isLeaf() {
+		if i < r.left.count {
+			r = r.left
+		} else {
+			i -= r.left.count
+			r = r.right
+		}
+	}
+	return r.lines[i]
+}
+
+// leafFrom returns the lines from line i up to the end of the leaf that contains it.
+func (r *rope) leafFrom(i int) []string {
+	for !r.isLeaf() {
+		if i < r.left.count {
+			r = r.left
+		} else {
+			i -= r.left.count
+			r = r.right
+		}
+	}
+	return r.lines[i:]
+}
+
+// set returns a copy of r with line i replaced by s.
+func (r *rope) set(i int, s string) *rope {
+	if r.isLeaf() {
+		lines := make([]string, len(r.lines))
+		copy(lines, r.lines)
+		lines[i] = s
+		return newLeaf(lines)
+	}
+	if i < r.left.count {
+		return &rope{left: r.left.set(i, s), right: r.right, count: r.count, height: r.height}
+	}
+	return &rope{left: r.left, right: r.right.set(i-r.left.count, s), count: r.count, height: r.height}
+}
+
+// split returns two ropes: one holding the first i lines of r, the other holding the rest.
+func (r *rope) split(i int) (*rope, *rope) {
+	switch {
+	case i <= 0:
+		return nil, r
+	case i >= r.len():
+		return r, nil
+	case r.isLeaf():
+		return newLeaf(r.lines[:i:i]), newLeaf(r.lines[i:])
+	case i < r.left.count:
+		a, b := r.left.split(i)
+		return a, concat(b, r.right)
+	default:
+		a, b := r.right.split(i - r.left.count)
+		return concat(r.left, a), b
+	}
+}
+
+// concat returns a balanced rope holding the lines of a followed by those of b.
+func concat(a, b *rope) *rope {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	// Merge small adjacent leaves, so that repeated splitting doesn't fragment the tree.
+	if a.isLeaf() && b.isLeaf() && a.count+b.count <= maxLeafLines {
+		lines := make([]string, 0, a.count+b.count)
+		lines = append(lines, a.lines...)
+		return newLeaf(append(lines, b.lines...))
+	}
+	switch d := a.height - b.height; {
+	case d > 1:
+		return balance(a.left, concat(a.right, b))
+	case d < -1:
+		return balance(concat(a, b.left), b.right)
+	default:
+		return newNode(a, b)
+	}
+}
+
+// balance joins two ropes whose heights differ by at most 2, applying an AVL rotation if necessary
+// to keep the result balanced.
+func balance(l, r *rope) *rope {
+	switch d := l.depth() - r.depth(); {
+	case d > 1:
+		if l.left.depth() >= l.right.depth() {
+			return newNode(l.left, newNode(l.right, r))
+		}
+		return newNode(newNode(l.left, l.right.left), newNode(l.right.right, r))
+	case d < -1:
+		if r.right.depth() >= r.left.depth() {
+			return newNode(newNode(l, r.left), r.right)
+		}
+		return newNode(newNode(l, r.left.left), newNode(r.left.right, r.right))
+	}
+	return newNode(l, r)
+}
+
+// splice returns a copy of r with lines [i, j[ replaced by newLines.
+func (r *rope) splice(i, j int, newLines []string) *rope {
+	if j == i+1 && len(newLines) == 1 {
+		return r.set(i, newLines[0])
+	}
+	left, rest := r.split(i)
+	_, right := rest.split(j - i)
+	return concat(concat(left, buildRope(newLines)), right)
+}
+
+// appendLines appends lines [i, j[ of r to out and returns the extended slice.
+func (r *rope) appendLines(out []string, i, j int) []string {
+	if r == nil || i >= j {
+		return out
+	}
+	if r.isLeaf() {
+		return append(out, r.lines[i:j]...)
+	}
+	n := r.left.count
+	if i < n {
+		out = r.left.appendLines(out, i, min(j, n))
+	}
+	if j > n {
+		out = r.right.appendLines(out, max(i-n, 0), j-n)
+	}
+	return out
+}
+
+// eachLeaf calls f with the lines in each leaf of r, in order, until f returns false.
+// It reports whether all calls to f returned true.
+func (r *rope) eachLeaf(f func(lines []string) bool) bool {
+	switch {
+	case r == nil:
+		return true
+	case r.isLeaf():
+		return f(r.lines)
+	}
+	return r.left.eachLeaf(f) && r.right.eachLeaf(f)
+}
+
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func max(x, y int) int {
+	if x < y {
+		return y
+	}
+	return x
+}
@@ -0,0 +1,108 @@
+package buffer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkRope verifies that r holds want and satisfies the rope invariants.
+func checkRope(t *testing.T, step int, r *rope, want []string) {
+	t.Helper()
+	if got := r.appendLines(nil, 0, r.len()); !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+		t.Fatalf("step %d: rope contains %q, want %q", step, got, want)
+	}
+	if err := r.checkInvariants(); err != nil {
+		t.Fatalf("step %d: %v", step, err)
+	}
+}
+
+func (r *rope) checkInvariants() error {
+	if r == nil {
+		return nil
+	}
+	if r.isLeaf() {
+		if r.count != len(r.lines) || r.count == 0 || r.count > maxLeafLines {
+			return fmt.Errorf("leaf with %d lines has count %d", len(r.lines), r.count)
+		}
+		return nil
+	}
+	if r.left == nil || r.right == nil {
+		return fmt.Errorf("interior node with a missing child")
+	}
+	if r.count != r.left.count+r.right.count {
+		return fmt.Errorf("node count %d != %d + %d", r.count, r.left.count, r.right.count)
+	}
+	if d := r.left.height - r.right.height; d < -1 || d > 1 || r.height != 1+max(r.left.height, r.right.height) {
+		return fmt.Errorf("unbalanced node: heights %d, %d under %d", r.left.height, r.right.height, r.height)
+	}
+	if err := r.left.checkInvariants(); err != nil {
+		return err
+	}
+	return r.right.checkInvariants()
+}
+
+func TestRopeRandomEdits(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var model []string
+	for i := 0; i < 1000; i++ {
+		model = append(model, fmt.Sprint("line ", i))
+	}
+	r := buildRope(append([]string(nil), model...))
+	checkRope(t, 0, r, model)
+	for step := 1; step <= 2000; step++ {
+		i := rng.Intn(len(model) + 1)
+		j := i + rng.Intn(len(model)-i+1)
+		if rng.Intn(4) == 0 {
+			j = min(i+rng.Intn(3*maxLeafLines), len(model))
+		}
+		newLines := make([]string, rng.Intn(2*maxLeafLines))
+		for k := range newLines {
+			newLines[k] = fmt.Sprint("new ", step, ".", k)
+		}
+		old := r
+		oldModel := append([]string(nil), model...)
+		r = r.splice(i, j, append([]string(nil), newLines...))
+		model = append(model[:i:i], append(newLines, model[j:]...)...)
+		checkRope(t, step, r, model)
+		// The original rope must be unaffected by the edit.
+		checkRope(t, step, old, oldModel)
+		if len(model) == 0 {
+			model = []string{"restart"}
+			r = buildRope([]string{"restart"})
+		}
+	}
+}
+
+func TestRopeSet(t *testing.T) {
+	model := strings.SplitAfter(strings.Repeat("x\n", 300), "\n")
+	r := buildRope(append([]string(nil), model...))
+	r2 := r.set(150, "changed\n")
+	checkRope(t, 1, r, model)
+	model[150] = "changed\n"
+	checkRope(t, 2, r2, model)
+}
+
+func TestCopyIndependence(t *testing.T) {
+	buf := bufFromData(t, multilineTestData)
+	c := buf.Copy()
+	buf.Insert("DING\nTEXT\nFOO", Point{5, 0})
+	testContent(t, buf, multilineDataAfterInsert)
+	testContent(t, c, multilineTestData)
+}
+
+func TestReaderSnapshot(t *testing.T) {
+	buf := bufFromData(t, strings.Repeat(multilineTestData+"\n", 100))
+	r := buf.Reader()
+	buf.DeleteRange(Range{Point{0, 0}, Point{0, 200}})
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat(multilineTestData+"\n", 100); string(data) != want {
+		t.Errorf("Reader returned %d bytes, want %d", len(data), len(want))
+	}
+}
@@ -25,7 +25,13 @@ type Style struct {
 }
 
 type LangConfig struct {
-	Formatter []string // Formatter program and arguments to pass to it
+	Formatter      []string // Formatter program and arguments to pass to it
+	LanguageServer []string // Language server program and arguments to pass to it
+	// Program and arguments to pass to it, run on each file after saving it to check it for errors.
+	// The file's path is passed as the last argument.
+	Checker []string
+	// Program and arguments to pass to it, run in the project's root directory to build it.
+	Build []string
 }
 
 // Returns the appropriate LangConfig for a file with the given filename extension.
@@ -0,0 +1,130 @@
+// Package ctags reads the tags files generated by ctags programs, which index the definitions
+// in a set of source files.
+package ctags
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Tag is the location of a definition.
+type Tag struct {
+	Name string
+	File string // The file containing the definition, relative to the tags file's directory
+	// If not zero, the number of the line containing the definition, starting from 1; otherwise,
+	// the definition is found by Pattern.
+	Line int
+	// The text of the line containing the definition. If it starts with ^, the line starts with the
+	// rest; if it ends with $, the line ends with the rest. Otherwise, the line just contains it.
+	Pattern string
+}
+
+// Lookup returns the tags named name in the tags file read from r.
+// Lines that aren't valid tags are ignored.
+func Lookup(r io.Reader, name string) ([]Tag, error) {
+	var tags []Tag
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	prefix := name + "\t"
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		if tag, ok := parseTag(line); ok {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, sc.Err()
+}
+
+func parseTag(line string) (Tag, bool) {
+	fields := strings.SplitN(line, "\t", 3)
+	if len(fields) < 3 {
+		return Tag{}, false
+	}
+	tag := Tag{Name: fields[0], File: fields[1]}
+	address := fields[2]
+	switch {
+	case address == "":
+		return Tag{}, false
+	case address[0] == '/' || address[0] == '?':
+		// A search pattern, delimited by the first character; that character and backslashes are
+		// escaped with backslashes inside it.
+		var b strings.Builder
+		i := 1
+		for ; i < len(address) && address[i] != address[0]; i++ {
+			if address[i] == '\\' && i+1 < len(address) && (address[i+1] == address[0] || address[i+1] == '\\') {
+				i++
+			}
+			b.WriteByte(address[i])
+		}
+		if i == len(address) {
+			return Tag{}, false
+		}
+		tag.Pattern = b.String()
+	default:
+		n := strings.IndexFunc(address, func(r rune) bool { return r < '0' || r > '9' })
+		if n == -1 {
+			n = len(address)
+		}
+		var err error
+		if tag.Line, err = strconv.Atoi(address[:n]); err != nil || tag.Line < 1 {
+			return Tag{}, false
+		}
+	}
+	return tag, true
+}
+
+// Find returns the index in lines of the line containing the definition, or -1 if there is none.
+// Lines may include their terminating newlines.
+func (t Tag) Find(lines []string) int {
+	if t.Pattern == "" {
+		if t.Line > len(lines) {
+			return -1
+		}
+		return t.Line - 1
+	}
+	text := t.Pattern
+	atStart := strings.HasPrefix(text, "^")
+	atEnd := strings.HasSuffix(text, "$")
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "^"), "$")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\n")
+		var ok bool
+		switch {
+		case atStart && atEnd:
+			ok = line == text
+		case atStart:
+			ok = strings.HasPrefix(line, text)
+		case atEnd:
+			ok = strings.HasSuffix(line, text)
+		default:
+			ok = strings.Contains(line, text)
+		}
+		if ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// FindFile returns the path of the tags file closest to dir: the one in dir itself, or else in
+// the closest directory above it. It returns an empty string if there is none.
+func FindFile(dir string) string {
+	for {
+		p := filepath.Join(dir, "tags")
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			return p
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
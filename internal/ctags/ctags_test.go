@@ -0,0 +1,80 @@
+package ctags
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTags = "!_TAG_FILE_FORMAT\t2\t/extended format/\n" +
+	"Find\tctags.go\t/^func (t Tag) Find(lines []string) int {$/;\"\tf\n" +
+	"Lookup\tctags.go\t/^func Lookup(r io.Reader, name string) ([]Tag, error) {$/;\"\tf\n" +
+	"Lookup\tother/lookup.c\t12;\"\tf\n" +
+	"Lookups\tx.go\t3\n" +
+	"path\tpath.go\t?a/b\\?c?\n" +
+	"broken\tbroken.go\t/^never ends\n"
+
+func TestLookup(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want []Tag
+	}{
+		{"Find", []Tag{{Name: "Find", File: "ctags.go", Pattern: "^func (t Tag) Find(lines []string) int {$"}}},
+		{"Lookup", []Tag{
+			{Name: "Lookup", File: "ctags.go", Pattern: "^func Lookup(r io.Reader, name string) ([]Tag, error) {$"},
+			{Name: "Lookup", File: "other/lookup.c", Line: 12},
+		}},
+		{"path", []Tag{{Name: "path", File: "path.go", Pattern: "a/b?c"}}},
+		{"broken", nil},
+		{"Look", nil},
+	} {
+		got, err := Lookup(strings.NewReader(testTags), tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	lines := []string{"package ctags\n", "\n", "func (t Tag) Find(lines []string) int {\n", "\tx := a/b?c\n"}
+	for _, tt := range []struct {
+		tag  Tag
+		want int
+	}{
+		{Tag{Pattern: "^func (t Tag) Find(lines []string) int {$"}, 2},
+		{Tag{Pattern: "^func (t Tag) Find("}, 2},
+		{Tag{Pattern: "^func (t Tag) Find($"}, -1},
+		{Tag{Pattern: "a/b?c"}, 3},
+		{Tag{Line: 2}, 1},
+		{Tag{Line: 5}, -1},
+	} {
+		if got := tt.tag.Find(lines); got != tt.want {
+			t.Errorf("%+v.Find() = %d, want %d", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestFindFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mflg-ctags-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "a", "b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "a", "tags")
+	if err := ioutil.WriteFile(want, []byte(testTags), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := FindFile(sub); got != want {
+		t.Errorf("FindFile(%q) = %q, want %q", sub, got, want)
+	}
+}
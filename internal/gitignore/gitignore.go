@@ -0,0 +1,101 @@
+// Package gitignore matches paths against the patterns in .gitignore files, as described in
+// gitignore(5).
+package gitignore
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+)
+
+// A Matcher holds the patterns from one .gitignore file.
+type Matcher struct {
+	patterns []pattern
+}
+
+type pattern struct {
+	segments []string // The pattern split at slashes
+	negated  bool     // Whether the pattern started with !, re-including what it matches
+	dirOnly  bool     // Whether the pattern ended with /, matching only directories
+	anchored bool     // Whether the pattern matches relative to the .gitignore's directory, or else at any depth
+}
+
+// Parse reads the patterns in a .gitignore file from r.
+func Parse(r io.Reader) (*Matcher, error) {
+	m := &Matcher{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var p pattern
+		if line[0] == '!' {
+			p.negated = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.segments = strings.Split(line, "/")
+		m.patterns = append(m.patterns, p)
+	}
+	return m, sc.Err()
+}
+
+// Match reports whether the file at name, a slash-separated path relative to the .gitignore's
+// directory, is ignored. The second result reports whether any pattern matched it at all; if not,
+// the decision is up to the .gitignore files in the directories above.
+func (m *Matcher) Match(name string, isDir bool) (ignored, matched bool) {
+	segments := strings.Split(name, "/")
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		p := m.patterns[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		if p.anchored {
+			ok = matchSegments(p.segments, segments)
+		} else {
+			ok = matchSegments(p.segments, segments[len(segments)-1:])
+		}
+		if ok {
+			return !p.negated, true
+		}
+	}
+	return false, false
+}
+
+// matchSegments reports whether the path split into names matches the pattern split into
+// segments, where a ** segment matches any number of names.
+func matchSegments(segments, names []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(segments[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, err := path.Match(segments[0], names[0]); err != nil || !ok {
+			return false
+		}
+		segments, names = segments[1:], names[1:]
+	}
+	return len(names) == 0
+}
@@ -0,0 +1,49 @@
+package gitignore
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPatterns = `# Build output
+*.o
+/bin
+build/
+docs/**/*.html
+!docs/keep/*.html
+\!important
+a/**/b
+`
+
+func TestMatch(t *testing.T) {
+	m, err := Parse(strings.NewReader(testPatterns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name          string
+		isDir         bool
+		ignored, seen bool
+	}{
+		{"main.o", false, true, true},
+		{"src/x/main.o", false, true, true},
+		{"main.c", false, false, false},
+		{"bin", true, true, true},
+		{"src/bin", true, false, false},
+		{"build", true, true, true},
+		{"src/build", true, true, true},
+		{"build", false, false, false},
+		{"docs/a.html", false, true, true},
+		{"docs/x/y/a.html", false, true, true},
+		{"docs/keep/a.html", false, false, true},
+		{"!important", false, true, true},
+		{"a/b", true, true, true},
+		{"a/x/y/b", false, true, true},
+		{"x/a/b", false, false, false},
+	} {
+		ignored, seen := m.Match(tt.name, tt.isDir)
+		if ignored != tt.ignored || seen != tt.seen {
+			t.Errorf("Match(%q, %v) = %v, %v; want %v, %v", tt.name, tt.isDir, ignored, seen, tt.ignored, tt.seen)
+		}
+	}
+}
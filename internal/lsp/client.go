@@ -0,0 +1,356 @@
+// Package lsp implements a client for the Language Server Protocol, which lets mflg get
+// language-specific information about the code being edited from an external program.
+//
+// Only the parts of the protocol that mflg uses are implemented.
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Client is a connection to a language server, running as a child process.
+// All of its methods are safe to call concurrently.
+type Client struct {
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	out     *bufio.Reader
+	handler func(method string, params json.RawMessage)
+
+	// Outgoing messages are queued in outbox and written by a separate goroutine, so that a slow
+	// server can't block the goroutines sending notifications. The queue is unbounded; wake
+	// is signalled whenever something is added to it or the connection breaks.
+	wake chan struct{}
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan *response
+	outbox  []interface{}
+	err     error // If not nil, the connection is broken and this is why
+
+	// SyncKind is how the server wants changes to documents to be sent, as reported
+	// during initialization; see DidChange.
+	SyncKind TextDocumentSyncKind
+	// The capabilities that the server reported during initialization.
+	Capabilities ServerCapabilities
+
+	done chan struct{} // Closed when the server's output ends
+}
+
+// ErrClosed is returned by calls on a Client whose connection to the server is gone.
+var ErrClosed = errors.New("language server connection closed")
+
+// A ResponseError is an error reported by the server in response to a request.
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("language server error %d: %s", e.Code, e.Message)
+}
+
+type request struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      *int        `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type response struct {
+	Result json.RawMessage
+	Error  *ResponseError
+}
+
+// incoming is any message from the server: a response, a notification or a request.
+type incoming struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+	Result json.RawMessage  `json:"result"`
+	Error  *ResponseError   `json:"error"`
+}
+
+// How long to wait for the server to exit on Close before killing it.
+const shutdownTimeout = 2 * time.Second
+
+// Start runs the language server given by command (the program followed by its arguments) for
+// the project located at the directory root, and completes the initialization handshake.
+//
+// handler is called with the method and parameters of each notification sent by the server,
+// from a goroutine of the client's; it must not call Call, and should return promptly. It may be nil.
+func Start(ctx context.Context, command []string, root string, handler func(method string, params json.RawMessage)) (*Client, error) {
+	if len(command) == 0 {
+		return nil, errors.New("no language server command given")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = root
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &Client{
+		cmd:     cmd,
+		in:      in,
+		out:     bufio.NewReader(out),
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+		pending: map[int]chan *response{},
+		done:    make(chan struct{}),
+	}
+	go c.writeLoop()
+	go c.readLoop()
+	var result InitializeResult
+	err = c.Call(ctx, "initialize", InitializeParams{
+		ProcessID: os.Getpid(),
+		RootURI:   FileURI(root),
+		Capabilities: ClientCapabilities{
+			TextDocument: TextDocumentClientCapabilities{
+				Synchronization: SynchronizationCapabilities{DidSave: false},
+			},
+		},
+	}, &result)
+	if err != nil {
+		c.kill()
+		return nil, fmt.Errorf("error initializing language server %s: %w", command[0], err)
+	}
+	c.Capabilities = result.Capabilities
+	c.SyncKind = result.Capabilities.syncKind()
+	if err := c.Notify("initialized", struct{}{}); err != nil {
+		c.kill()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Call sends a request to the server and waits for the response, whose result is decoded into result
+// unless it is nil.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	ch := make(chan *response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+	c.send(request{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return c.brokenErr()
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil || len(resp.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Notify sends a notification to the server. It doesn't wait for the notification to actually
+// be sent; notifications are always sent in the order that Notify is called.
+func (c *Client) Notify(method string, params interface{}) error {
+	if err := c.brokenErr(); err != nil {
+		return err
+	}
+	c.send(request{JSONRPC: "2.0", Method: method, Params: params})
+	return nil
+}
+
+// Close asks the server to exit, killing it if it doesn't do so promptly, and releases
+// the client's resources.
+func (c *Client) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := c.Call(ctx, "shutdown", nil, nil); err == nil {
+		c.Notify("exit", nil)
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+	}
+	c.kill()
+}
+
+func (c *Client) kill() {
+	c.fail(ErrClosed)
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
+
+func (c *Client) brokenErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// fail marks the connection as broken with the given error, and wakes up any goroutines waiting
+// for a response.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.outbox = nil
+	c.signal()
+}
+
+// send queues msg to be written to the server. It never blocks on the server; and so that a stalled
+// server can't make the queue grow without bound, a change replacing the whole content of a document
+// takes the place of one just before it in the queue that did the same.
+func (c *Client) send(msg interface{}) {
+	c.mu.Lock()
+	if c.err == nil {
+		if n := len(c.outbox); n > 0 && supersedes(msg, c.outbox[n-1]) {
+			c.outbox[n-1] = msg
+		} else {
+			c.outbox = append(c.outbox, msg)
+		}
+	}
+	c.mu.Unlock()
+	c.signal()
+}
+
+// supersedes reports whether msg makes old unnecessary: whether both replace the whole content of
+// the same document.
+func supersedes(msg, old interface{}) bool {
+	uri, ok := fullChangeURI(msg)
+	oldURI, oldOK := fullChangeURI(old)
+	return ok && oldOK && uri == oldURI
+}
+
+// fullChangeURI returns the URI of the document whose whole content msg replaces, if it is a
+// didChange notification that does so.
+func fullChangeURI(msg interface{}) (string, bool) {
+	r, ok := msg.(request)
+	if !ok || r.Method != "textDocument/didChange" {
+		return "", false
+	}
+	p, ok := r.Params.(DidChangeTextDocumentParams)
+	if !ok || len(p.ContentChanges) != 1 || p.ContentChanges[0].Range != nil {
+		return "", false
+	}
+	return p.TextDocument.URI, true
+}
+
+func (c *Client) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) writeLoop() {
+	defer c.in.Close()
+	for range c.wake {
+		c.mu.Lock()
+		msgs, broken := c.outbox, c.err != nil
+		c.outbox = nil
+		c.mu.Unlock()
+		if broken {
+			return
+		}
+		for _, msg := range msgs {
+			data, err := json.Marshal(msg)
+			if err == nil {
+				_, err = fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(data), data)
+			}
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+	for {
+		data, err := readMessage(c.out)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+		var msg incoming
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch {
+		case msg.Method != "" && msg.ID != nil:
+			// We don't handle any requests from the server; an empty reply is
+			// acceptable for the ones that servers commonly send anyway.
+			c.send(struct {
+				JSONRPC string           `json:"jsonrpc"`
+				ID      *json.RawMessage `json:"id"`
+				Result  interface{}      `json:"result"`
+			}{"2.0", msg.ID, nil})
+		case msg.Method != "":
+			if c.handler != nil {
+				c.handler(msg.Method, msg.Params)
+			}
+		case msg.ID != nil:
+			id, err := strconv.Atoi(string(*msg.ID))
+			if err != nil {
+				continue
+			}
+			c.mu.Lock()
+			ch := c.pending[id]
+			delete(c.pending, id)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- &response{Result: msg.Result, Error: msg.Error}
+			}
+		}
+	}
+}
+
+// readMessage reads a single message, with its header, from r, and returns its content.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message header from language server: %w", err)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
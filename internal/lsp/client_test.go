@@ -0,0 +1,297 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeServer string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mflg-lsp-test")
+	if err != nil {
+		panic(err)
+	}
+	fakeServer = filepath.Join(dir, "fakeserver")
+	if out, err := exec.Command("go", "build", "-o", fakeServer, "./testdata/fakeserver").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "error building fake language server: %v\n%s", err, out)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func startFake(t *testing.T, handler func(string, json.RawMessage), args ...string) *Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Start(ctx, append([]string{fakeServer}, args...), os.TempDir(), handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func documentText(t *testing.T, c *Client, uri string) string {
+	t.Helper()
+	var text string
+	if err := c.Call(context.Background(), "fake/documentText", TextDocumentIdentifier{URI: uri}, &text); err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+func TestDocumentSync(t *testing.T) {
+	c := startFake(t, nil)
+	defer c.Close()
+	if c.SyncKind != SyncIncremental {
+		t.Errorf("got sync kind %d, want %d", c.SyncKind, SyncIncremental)
+	}
+	const uri = "file:///tmp/test.go"
+	c.DidOpen(uri, "go", 1, "lorem\nipsum\n")
+	c.DidChange(uri, 2, []TextDocumentContentChangeEvent{
+		{Range: &Range{Start: Position{Line: 1, Character: 0}, End: Position{Line: 1, Character: 2}}, Text: "𝄞"},
+		{Range: &Range{Start: Position{Line: 1, Character: 3}, End: Position{Line: 1, Character: 3}}, Text: "!"},
+	})
+	if got, want := documentText(t, c, uri), "lorem\n𝄞s!um\n"; got != want {
+		t.Errorf("after incremental changes, server has %q, want %q", got, want)
+	}
+	c.DidChange(uri, 3, []TextDocumentContentChangeEvent{{Text: "dolor"}})
+	if got, want := documentText(t, c, uri), "dolor"; got != want {
+		t.Errorf("after full change, server has %q, want %q", got, want)
+	}
+}
+
+func TestFullSyncKind(t *testing.T) {
+	c := startFake(t, nil, "-sync=1")
+	defer c.Close()
+	if c.SyncKind != SyncFull {
+		t.Errorf("got sync kind %d, want %d", c.SyncKind, SyncFull)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	c := startFake(t, nil)
+	defer c.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uri := fmt.Sprintf("file:///tmp/%d.go", i)
+			c.DidOpen(uri, "go", 1, uri)
+			if got := documentText(t, c, uri); got != uri {
+				t.Errorf("document %s has text %q", uri, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServerMessages(t *testing.T) {
+	notes := make(chan ShowMessageParams, 1)
+	c := startFake(t, func(method string, params json.RawMessage) {
+		if method == "window/showMessage" {
+			var p ShowMessageParams
+			json.Unmarshal(params, &p)
+			notes <- p
+		}
+	})
+	defer c.Close()
+	want := ShowMessageParams{Type: MessageWarning, Message: "hello"}
+	if err := c.Call(context.Background(), "fake/showMessage", want, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-notes:
+		if got != want {
+			t.Errorf("got notification %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Error("notification from server not delivered")
+	}
+	var ok bool
+	if err := c.Call(context.Background(), "fake/askClient", nil, &ok); err != nil || !ok {
+		t.Errorf("request to client disrupted the connection: %v", err)
+	}
+}
+
+func TestNotifyWhileServerStalled(t *testing.T) {
+	c := startFake(t, nil)
+	defer c.Close()
+	const uri = "file:///tmp/stall.go"
+	c.DidOpen(uri, "go", 1, "")
+	c.Notify("fake/stall", nil)
+	start := time.Now()
+	// Enough text to fill the pipe to the server several times over.
+	text := strings.Repeat("x", 4096)
+	for i := 0; i < 1000; i++ {
+		c.DidChange(uri, 2+i, []TextDocumentContentChangeEvent{{Text: text}})
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("sending notifications to a stalled server took %v", d)
+	}
+	c.mu.Lock()
+	queued := 0
+	for _, msg := range c.outbox {
+		if _, ok := fullChangeURI(msg); ok {
+			queued++
+		}
+	}
+	c.mu.Unlock()
+	if queued > 1 {
+		t.Errorf("%d changes queued for a stalled server, want them to be combined into one", queued)
+	}
+	if got := documentText(t, c, uri); got != text {
+		t.Errorf("server has %d bytes after changes, want %d", len(got), len(text))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := startFake(t, nil)
+	err := c.Call(context.Background(), "fake/noSuchMethod", nil, nil)
+	if rerr, ok := err.(*ResponseError); !ok || rerr.Code != -32601 {
+		t.Errorf("calling unknown method returned %v, want method not found error", err)
+	}
+	c.Close()
+	if err := c.Call(context.Background(), "fake/documentText", TextDocumentIdentifier{}, nil); err != ErrClosed {
+		t.Errorf("call after Close returned %v, want %v", err, ErrClosed)
+	}
+}
+
+var utf16Tests = []struct {
+	line       string
+	units, off int
+}{
+	{"abc", 2, 2},
+	{"aé𝄞b", 2, 3},
+	{"aé𝄞b", 4, 7},
+	{"aé𝄞b", 9, 8},
+}
+
+func TestByteOffset(t *testing.T) {
+	for _, tt := range utf16Tests {
+		if got := ByteOffset(tt.line, tt.units); got != tt.off {
+			t.Errorf("ByteOffset(%q, %d) = %d, want %d", tt.line, tt.units, got, tt.off)
+		}
+		if tt.units <= UTF16Len(tt.line) {
+			if got := UTF16Len(tt.line[:tt.off]); got != tt.units {
+				t.Errorf("UTF16Len(%q) = %d, want %d", tt.line[:tt.off], got, tt.units)
+			}
+		}
+	}
+}
+
+func TestURIs(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "a b", "c.go")
+	uri := FileURI(path)
+	if got := URIPath(uri); got != path {
+		t.Errorf("URIPath(FileURI(%q)) = %q (URI was %q)", path, got, uri)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	for _, args := range [][]string{nil, {"-completion-array"}} {
+		c := startFake(t, nil, args...)
+		const uri = "file:///tmp/test.go"
+		c.DidOpen(uri, "go", 1, "lorem ipsum\nlo")
+		items, err := c.Completion(context.Background(), uri, Position{Line: 1, Character: 2})
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []CompletionItem{
+			{Label: "lorem", Detail: "fake", TextEdit: &TextEdit{Range: Range{Start: Position{1, 0}, End: Position{1, 2}}, NewText: "lorem"}},
+			{Label: "ipsum", Detail: "fake", TextEdit: &TextEdit{Range: Range{Start: Position{1, 0}, End: Position{1, 2}}, NewText: "ipsum"}},
+			{Label: "lo", Detail: "fake", TextEdit: &TextEdit{Range: Range{Start: Position{1, 0}, End: Position{1, 2}}, NewText: "lo"}},
+		}
+		if !reflect.DeepEqual(items, want) {
+			t.Errorf("%v: got %+v, want %+v", args, items, want)
+		}
+	}
+}
+
+func TestDefinitionAndReferences(t *testing.T) {
+	c := startFake(t, nil)
+	defer c.Close()
+	const uri = "file:///tmp/test.go"
+	c.DidOpen(uri, "go", 1, "x := 1\ny := x + x\n")
+	defs, err := c.Definition(context.Background(), uri, Position{Line: 1, Character: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Location{{URI: uri, Range: Range{Position{0, 0}, Position{0, 1}}}}; !reflect.DeepEqual(defs, want) {
+		t.Errorf("got definitions %+v, want %+v", defs, want)
+	}
+	refs, err := c.References(context.Background(), uri, Position{Line: 0, Character: 0}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Location{
+		{URI: uri, Range: Range{Position{0, 0}, Position{0, 1}}},
+		{URI: uri, Range: Range{Position{1, 5}, Position{1, 6}}},
+		{URI: uri, Range: Range{Position{1, 9}, Position{1, 10}}},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("got references %+v, want %+v", refs, want)
+	}
+}
+
+func TestDecodeLocations(t *testing.T) {
+	loc := Location{URI: "file:///a.go", Range: Range{Position{1, 2}, Position{1, 5}}}
+	for _, tt := range []struct {
+		in   string
+		want []Location
+	}{
+		{`null`, nil},
+		{`[]`, []Location{}},
+		{`{"uri":"file:///a.go","range":{"start":{"line":1,"character":2},"end":{"line":1,"character":5}}}`, []Location{loc}},
+		{`[{"uri":"file:///a.go","range":{"start":{"line":1,"character":2},"end":{"line":1,"character":5}}}]`, []Location{loc}},
+		{`[{"targetUri":"file:///a.go","targetRange":{"start":{"line":0,"character":0},"end":{"line":3,"character":0}},` +
+			`"targetSelectionRange":{"start":{"line":1,"character":2},"end":{"line":1,"character":5}}}]`, []Location{loc}},
+	} {
+		got, err := decodeLocations(json.RawMessage(tt.in))
+		if err != nil {
+			t.Errorf("decodeLocations(%s): %v", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeLocations(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeSymbols(t *testing.T) {
+	r := Range{Position{1, 0}, Position{3, 1}}
+	sel := Range{Position{1, 5}, Position{1, 9}}
+	for _, tt := range []struct {
+		in   string
+		want []DocumentSymbol
+	}{
+		{`null`, nil},
+		{`[]`, []DocumentSymbol{}},
+		{`[{"name":"main","kind":12,"range":{"start":{"line":1,"character":0},"end":{"line":3,"character":1}},` +
+			`"selectionRange":{"start":{"line":1,"character":5},"end":{"line":1,"character":9}},` +
+			`"children":[{"name":"x","kind":13,"range":{"start":{"line":1,"character":5},"end":{"line":1,"character":9}},` +
+			`"selectionRange":{"start":{"line":1,"character":5},"end":{"line":1,"character":9}}}]}]`,
+			[]DocumentSymbol{{Name: "main", Range: r, SelectionRange: sel, Children: []DocumentSymbol{{Name: "x", Range: sel, SelectionRange: sel}}}}},
+		{`[{"name":"main","kind":12,"location":{"uri":"file:///a.go","range":{"start":{"line":1,"character":0},"end":{"line":3,"character":1}}},"containerName":"pkg"}]`,
+			[]DocumentSymbol{{Name: "main", Range: r, SelectionRange: r}}},
+	} {
+		got, err := decodeSymbols(json.RawMessage(tt.in))
+		if err != nil {
+			t.Errorf("decodeSymbols(%s): %v", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeSymbols(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
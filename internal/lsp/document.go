@@ -0,0 +1,187 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// DidOpen tells the server that a document was opened, with the given content.
+// The version should be incremented on every subsequent change to the document.
+func (c *Client) DidOpen(uri, languageID string, version int, text string) error {
+	return c.Notify("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: languageID, Version: version, Text: text},
+	})
+}
+
+// DidChange tells the server about changes made to a document, which bring it to the given version.
+// The changes must be in the form requested by the server; see Client.SyncKind.
+func (c *Client) DidChange(uri string, version int, changes []TextDocumentContentChangeEvent) error {
+	return c.Notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{URI: uri, Version: version},
+		ContentChanges: changes,
+	})
+}
+
+// DidClose tells the server that a document is no longer open.
+func (c *Client) DidClose(uri string) error {
+	return c.Notify("textDocument/didClose", DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}})
+}
+
+// Completion asks the server for the items that could be inserted at the given position in a document.
+func (c *Client) Completion(ctx context.Context, uri string, pos Position) ([]CompletionItem, error) {
+	var result json.RawMessage
+	err := c.Call(ctx, "textDocument/completion", CompletionParams{
+		TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: pos},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	var items []CompletionItem
+	if json.Unmarshal(result, &items) == nil {
+		return items, nil
+	}
+	var list CompletionList
+	if err := json.Unmarshal(result, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// Definition asks the server where the symbol at the given position in a document is defined.
+// There may be several answers, or none.
+func (c *Client) Definition(ctx context.Context, uri string, pos Position) ([]Location, error) {
+	var result json.RawMessage
+	err := c.Call(ctx, "textDocument/definition", TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: pos}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLocations(result)
+}
+
+// References asks the server for the locations where the symbol at the given position in a
+// document is used, including its declaration if includeDeclaration is true.
+func (c *Client) References(ctx context.Context, uri string, pos Position, includeDeclaration bool) ([]Location, error) {
+	var result []Location
+	err := c.Call(ctx, "textDocument/references", ReferenceParams{
+		TextDocumentPositionParams: TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: pos},
+		Context:                    ReferenceContext{IncludeDeclaration: includeDeclaration},
+	}, &result)
+	return result, err
+}
+
+// DocumentSymbols asks the server for the symbols defined in a document, as a tree.
+func (c *Client) DocumentSymbols(ctx context.Context, uri string) ([]DocumentSymbol, error) {
+	var result json.RawMessage
+	err := c.Call(ctx, "textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSymbols(result)
+}
+
+// decodeSymbols decodes a result that may be null, or an array of either DocumentSymbols or
+// SymbolInformations. The latter are converted into DocumentSymbols with no children.
+func decodeSymbols(result json.RawMessage) ([]DocumentSymbol, error) {
+	if len(result) == 0 || string(result) == "null" {
+		return nil, nil
+	}
+	var items []struct {
+		DocumentSymbol
+		Location *Location `json:"location"`
+	}
+	if err := json.Unmarshal(result, &items); err != nil {
+		return nil, err
+	}
+	syms := make([]DocumentSymbol, len(items))
+	for i, item := range items {
+		syms[i] = item.DocumentSymbol
+		if item.Location != nil {
+			syms[i] = DocumentSymbol{Name: item.Name, Range: item.Location.Range, SelectionRange: item.Location.Range}
+		}
+	}
+	return syms, nil
+}
+
+// decodeLocations decodes a result that may be null, a Location, or an array of either Locations
+// or LocationLinks.
+func decodeLocations(result json.RawMessage) ([]Location, error) {
+	if len(result) == 0 || string(result) == "null" {
+		return nil, nil
+	}
+	var loc Location
+	if json.Unmarshal(result, &loc) == nil && loc.URI != "" {
+		return []Location{loc}, nil
+	}
+	var items []struct {
+		Location
+		LocationLink
+	}
+	if err := json.Unmarshal(result, &items); err != nil {
+		return nil, err
+	}
+	locs := make([]Location, len(items))
+	for i, item := range items {
+		locs[i] = item.Location
+		if item.TargetURI != "" {
+			locs[i] = Location{URI: item.TargetURI, Range: item.TargetSelectionRange}
+		}
+	}
+	return locs, nil
+}
+
+// FileURI returns the file:// URI for the file at path, which should be absolute.
+func FileURI(path string) string {
+	path = filepath.ToSlash(path)
+	// Windows paths start with a drive letter, rather than a slash.
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// URIPath returns the path of the file with the given file:// URI.
+// It returns an empty string if uri is not a valid file URI.
+func URIPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	path := u.Path
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+// UTF16Len returns the length of s in UTF-16 code units; this is how the protocol measures
+// character offsets in positions.
+func UTF16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+	return n
+}
+
+// ByteOffset returns the byte offset into line that corresponds to an offset of n UTF-16 code units.
+// If n is past the end of line, it returns len(line).
+func ByteOffset(line string, n int) int {
+	for i, r := range line {
+		if n <= 0 {
+			return i
+		}
+		n -= utf16RuneLen(r)
+	}
+	return len(line)
+}
+
+func utf16RuneLen(r rune) int {
+	// Characters outside the Basic Multilingual Plane take up a surrogate pair.
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
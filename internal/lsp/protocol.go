@@ -0,0 +1,228 @@
+package lsp
+
+import "encoding/json"
+
+// These types mirror those defined in the protocol specification; see
+// https://microsoft.github.io/language-server-protocol/specification.
+
+// A Position is a location in a document. Line is zero-based; Character is the
+// zero-based offset into the line in UTF-16 code units (see UTF16Len and ByteOffset).
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// A Range is the part of a document between Start (inclusive) and End (exclusive).
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// A Location is a range in a particular document.
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+type TextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type VersionedTextDocumentIdentifier struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+}
+
+type TextDocumentItem struct {
+	URI        string `json:"uri"`
+	LanguageID string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+}
+
+// A TextDocumentContentChangeEvent describes a change to a document: either the text in Range was
+// replaced with Text, or, if Range is nil, the whole document was.
+type TextDocumentContentChangeEvent struct {
+	Range *Range `json:"range,omitempty"`
+	Text  string `json:"text"`
+}
+
+type DidOpenTextDocumentParams struct {
+	TextDocument TextDocumentItem `json:"textDocument"`
+}
+
+type DidChangeTextDocumentParams struct {
+	TextDocument   VersionedTextDocumentIdentifier  `json:"textDocument"`
+	ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
+}
+
+type DidCloseTextDocumentParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+type TextDocumentPositionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+type InitializeParams struct {
+	ProcessID    int                `json:"processId"`
+	RootURI      string             `json:"rootUri"`
+	Capabilities ClientCapabilities `json:"capabilities"`
+}
+
+type ClientCapabilities struct {
+	TextDocument TextDocumentClientCapabilities `json:"textDocument"`
+}
+
+type TextDocumentClientCapabilities struct {
+	Synchronization SynchronizationCapabilities `json:"synchronization"`
+}
+
+type SynchronizationCapabilities struct {
+	DidSave bool `json:"didSave"`
+}
+
+type InitializeResult struct {
+	Capabilities ServerCapabilities `json:"capabilities"`
+}
+
+// ServerCapabilities holds the features that a server supports.
+type ServerCapabilities struct {
+	// Either a TextDocumentSyncKind or an object with a "change" field holding one.
+	TextDocumentSync json.RawMessage `json:"textDocumentSync,omitempty"`
+}
+
+// TextDocumentSyncKind determines how changes to documents are sent to the server.
+type TextDocumentSyncKind int
+
+const (
+	SyncNone        TextDocumentSyncKind = 0 // The server doesn't want documents synchronized
+	SyncFull        TextDocumentSyncKind = 1 // Each change includes the full text of the document
+	SyncIncremental TextDocumentSyncKind = 2 // Each change includes only the edited range
+)
+
+func (sc ServerCapabilities) syncKind() TextDocumentSyncKind {
+	var kind TextDocumentSyncKind
+	if json.Unmarshal(sc.TextDocumentSync, &kind) == nil {
+		return kind
+	}
+	var options struct {
+		Change TextDocumentSyncKind `json:"change"`
+	}
+	json.Unmarshal(sc.TextDocumentSync, &options)
+	return options.Change
+}
+
+// ShowMessageParams are the parameters of the window/showMessage notification.
+type ShowMessageParams struct {
+	Type    MessageType `json:"type"`
+	Message string      `json:"message"`
+}
+
+type MessageType int
+
+const (
+	MessageError   MessageType = 1
+	MessageWarning MessageType = 2
+	MessageInfo    MessageType = 3
+	MessageLog     MessageType = 4
+)
+
+// PublishDiagnosticsParams are the parameters of the textDocument/publishDiagnostics notification,
+// which replaces all diagnostics previously reported for a document.
+type PublishDiagnosticsParams struct {
+	URI string `json:"uri"`
+	// If not nil, the version of the document that the diagnostics apply to.
+	Version     *int         `json:"version,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// A Diagnostic is an error, warning or other remark about part of a document.
+type Diagnostic struct {
+	Range    Range              `json:"range"`
+	Severity DiagnosticSeverity `json:"severity,omitempty"`
+	Source   string             `json:"source,omitempty"`
+	Message  string             `json:"message"`
+}
+
+// DiagnosticSeverity is how serious a diagnostic is. The zero value means that the server didn't say;
+// clients decide how to treat such diagnostics.
+type DiagnosticSeverity int
+
+const (
+	SeverityError       DiagnosticSeverity = 1
+	SeverityWarning     DiagnosticSeverity = 2
+	SeverityInformation DiagnosticSeverity = 3
+	SeverityHint        DiagnosticSeverity = 4
+)
+
+type CompletionParams struct {
+	TextDocumentPositionParams
+}
+
+// A CompletionList is the result of a textDocument/completion request. Servers may also reply with
+// just the items.
+type CompletionList struct {
+	// If true, typing further should make the server send different items, rather than just
+	// fewer of them.
+	IsIncomplete bool             `json:"isIncomplete"`
+	Items        []CompletionItem `json:"items"`
+}
+
+// A CompletionItem is a suggestion of text to insert at some position in a document.
+type CompletionItem struct {
+	Label  string `json:"label"`
+	Detail string `json:"detail,omitempty"`
+	// The text to match against what the user has typed; if empty, Label is used instead.
+	FilterText string `json:"filterText,omitempty"`
+	// The text to insert; if empty, Label is used instead. Ignored if TextEdit is not nil.
+	InsertText string `json:"insertText,omitempty"`
+	// If not nil, the edit to make when the item is chosen. Its range must be on a single line and
+	// contain the position that completion was requested at.
+	TextEdit *TextEdit `json:"textEdit,omitempty"`
+}
+
+// A TextEdit is a replacement of the text in Range with NewText.
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
+type ReferenceParams struct {
+	TextDocumentPositionParams
+	Context ReferenceContext `json:"context"`
+}
+
+type ReferenceContext struct {
+	IncludeDeclaration bool `json:"includeDeclaration"`
+}
+
+// A LocationLink is a location along with the part of it that should be shown as selected.
+// Servers send it instead of a Location only if the client says it supports it, but some do anyway.
+type LocationLink struct {
+	TargetURI            string `json:"targetUri"`
+	TargetRange          Range  `json:"targetRange"`
+	TargetSelectionRange Range  `json:"targetSelectionRange"`
+}
+
+type DocumentSymbolParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// A DocumentSymbol is a symbol defined in a document, along with those defined inside it.
+type DocumentSymbol struct {
+	Name string `json:"name"`
+	// The whole definition, including any comments attached to it.
+	Range Range `json:"range"`
+	// The part of Range that should be shown as selected, usually the symbol's name.
+	SelectionRange Range            `json:"selectionRange"`
+	Children       []DocumentSymbol `json:"children,omitempty"`
+}
+
+// SymbolInformation is the older, flat form of DocumentSymbol, which servers may send instead.
+type SymbolInformation struct {
+	Name          string   `json:"name"`
+	Location      Location `json:"location"`
+	ContainerName string   `json:"containerName,omitempty"`
+}
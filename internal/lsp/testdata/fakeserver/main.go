@@ -0,0 +1,270 @@
+// Command fakeserver is a minimal language server used to test the lsp package and mflg's use of it.
+// It keeps track of the documents it is told about and answers a few requests about them, some of
+// them specific to it.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/dpinela/mflg/internal/lsp"
+)
+
+type message struct {
+	ID     *json.RawMessage   `json:"id,omitempty"`
+	Method string             `json:"method,omitempty"`
+	Params json.RawMessage    `json:"params,omitempty"`
+	Result interface{}        `json:"result,omitempty"`
+	Error  *lsp.ResponseError `json:"error,omitempty"`
+}
+
+var (
+	out   = bufio.NewWriter(os.Stdout)
+	outMu sync.Mutex
+	docs  = map[string]string{}
+)
+
+func send(msg interface{}) {
+	outMu.Lock()
+	defer outMu.Unlock()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	out.Flush()
+}
+
+func reply(id *json.RawMessage, result interface{}) {
+	send(struct {
+		JSONRPC string           `json:"jsonrpc"`
+		ID      *json.RawMessage `json:"id"`
+		Result  interface{}      `json:"result"`
+	}{"2.0", id, result})
+}
+
+func notify(method string, params interface{}) {
+	send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func main() {
+	syncKind := flag.Int("sync", int(lsp.SyncIncremental), "text document sync kind to request")
+	completionArray := flag.Bool("completion-array", false, "reply to completion requests with an array instead of a CompletionList")
+	flag.Parse()
+	in := bufio.NewReader(os.Stdin)
+	for {
+		header, err := textproto.NewReader(in).ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(header.Get("Content-Length"))
+		data := make([]byte, n)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return
+		}
+		var msg message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Method {
+		case "initialize":
+			reply(msg.ID, map[string]interface{}{"capabilities": map[string]interface{}{"textDocumentSync": *syncKind}})
+		case "shutdown":
+			reply(msg.ID, nil)
+		case "exit":
+			os.Exit(0)
+		case "textDocument/didOpen":
+			var p lsp.DidOpenTextDocumentParams
+			json.Unmarshal(msg.Params, &p)
+			docs[p.TextDocument.URI] = p.TextDocument.Text
+		case "textDocument/didChange":
+			var p lsp.DidChangeTextDocumentParams
+			json.Unmarshal(msg.Params, &p)
+			for _, c := range p.ContentChanges {
+				docs[p.TextDocument.URI] = applyChange(docs[p.TextDocument.URI], c)
+			}
+		case "textDocument/didClose":
+			var p lsp.DidCloseTextDocumentParams
+			json.Unmarshal(msg.Params, &p)
+			delete(docs, p.TextDocument.URI)
+		case "textDocument/completion":
+			var p lsp.CompletionParams
+			json.Unmarshal(msg.Params, &p)
+			items := completions(docs[p.TextDocument.URI], p.Position)
+			if *completionArray {
+				reply(msg.ID, items)
+			} else {
+				reply(msg.ID, lsp.CompletionList{Items: items})
+			}
+		case "textDocument/definition", "textDocument/references":
+			// Symbols are words, defined where they first appear in the same document.
+			var p lsp.ReferenceParams
+			json.Unmarshal(msg.Params, &p)
+			text := docs[p.TextDocument.URI]
+			var locs []lsp.Location
+			for _, r := range occurrences(text, wordAt(text, p.Position)) {
+				locs = append(locs, lsp.Location{URI: p.TextDocument.URI, Range: r})
+			}
+			switch {
+			case msg.Method == "textDocument/references":
+				reply(msg.ID, locs)
+			case len(locs) == 0:
+				reply(msg.ID, nil)
+			default:
+				reply(msg.ID, locs[0])
+			}
+		case "textDocument/documentSymbol":
+			var p lsp.DocumentSymbolParams
+			json.Unmarshal(msg.Params, &p)
+			reply(msg.ID, symbols(docs[p.TextDocument.URI]))
+		case "fake/documentText":
+			var p lsp.TextDocumentIdentifier
+			json.Unmarshal(msg.Params, &p)
+			text, ok := docs[p.URI]
+			if !ok {
+				reply(msg.ID, nil)
+			} else {
+				reply(msg.ID, text)
+			}
+		case "fake/showMessage":
+			var p lsp.ShowMessageParams
+			json.Unmarshal(msg.Params, &p)
+			notify("window/showMessage", p)
+			reply(msg.ID, nil)
+		case "fake/publishDiagnostics":
+			var p lsp.PublishDiagnosticsParams
+			json.Unmarshal(msg.Params, &p)
+			notify("textDocument/publishDiagnostics", p)
+			reply(msg.ID, nil)
+		case "fake/stall":
+			// Stop reading input for a while, like a server busy with some long computation.
+			time.Sleep(2 * time.Second)
+		case "fake/askClient":
+			// The client's answer is ignored; all that matters is that it doesn't get stuck.
+			send(map[string]interface{}{"jsonrpc": "2.0", "id": "from-server", "method": "workspace/configuration", "params": map[string]interface{}{}})
+			reply(msg.ID, true)
+		default:
+			if msg.ID != nil && msg.Method != "" {
+				send(message{ID: msg.ID, Error: &lsp.ResponseError{Code: -32601, Message: "method not found: " + msg.Method}})
+			}
+		}
+	}
+}
+
+// completions offers each distinct word in text, replacing the part of a word that comes before pos.
+func completions(text string, pos lsp.Position) []lsp.CompletionItem {
+	i := offset(text, pos)
+	start := strings.LastIndexFunc(text[:i], func(r rune) bool { return !isWordChar(r) }) + 1
+	lineStart := strings.LastIndexByte(text[:i], '\n') + 1
+	editRange := lsp.Range{Start: lsp.Position{Line: pos.Line, Character: lsp.UTF16Len(text[lineStart:start])}, End: pos}
+	items := []lsp.CompletionItem{}
+	seen := map[string]bool{}
+	for _, w := range strings.FieldsFunc(text, func(r rune) bool { return !isWordChar(r) }) {
+		if !seen[w] {
+			seen[w] = true
+			items = append(items, lsp.CompletionItem{Label: w, Detail: "fake", TextEdit: &lsp.TextEdit{Range: editRange, NewText: w}})
+		}
+	}
+	return items
+}
+
+// symbols returns a symbol for each line of text of the form "def name"; those that are
+// indented are children of the last one that isn't.
+func symbols(text string) []lsp.DocumentSymbol {
+	syms := []lsp.DocumentSymbol{}
+	for y, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if !strings.HasPrefix(trimmed, "def ") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		name := strings.TrimSpace(trimmed[len("def "):])
+		start := indent + len("def ")
+		sym := lsp.DocumentSymbol{
+			Name:           name,
+			Range:          lsp.Range{Start: lsp.Position{Line: y}, End: lsp.Position{Line: y, Character: lsp.UTF16Len(line)}},
+			SelectionRange: lsp.Range{Start: lsp.Position{Line: y, Character: start}, End: lsp.Position{Line: y, Character: start + lsp.UTF16Len(name)}},
+		}
+		if indent > 0 && len(syms) > 0 {
+			parent := &syms[len(syms)-1]
+			parent.Children = append(parent.Children, sym)
+		} else {
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
+// wordAt returns the word in text that contains pos, or an empty string if there is none.
+func wordAt(text string, pos lsp.Position) string {
+	i := offset(text, pos)
+	start := strings.LastIndexFunc(text[:i], func(r rune) bool { return !isWordChar(r) }) + 1
+	end := strings.IndexFunc(text[i:], func(r rune) bool { return !isWordChar(r) })
+	if end == -1 {
+		end = len(text) - i
+	}
+	return text[start : i+end]
+}
+
+// occurrences returns the ranges of text where word appears as a whole word.
+func occurrences(text, word string) []lsp.Range {
+	var rs []lsp.Range
+	if word == "" {
+		return nil
+	}
+	for y, line := range strings.Split(text, "\n") {
+		for i := 0; i < len(line); {
+			j := strings.Index(line[i:], word)
+			if j == -1 {
+				break
+			}
+			j += i
+			k := j + len(word)
+			before := strings.LastIndexFunc(line[:j], func(r rune) bool { return !isWordChar(r) }) + 1
+			after := strings.IndexFunc(line[k:], func(r rune) bool { return !isWordChar(r) })
+			if before == j && (after == 0 || k == len(line)) {
+				rs = append(rs, lsp.Range{
+					Start: lsp.Position{Line: y, Character: lsp.UTF16Len(line[:j])},
+					End:   lsp.Position{Line: y, Character: lsp.UTF16Len(line[:k])},
+				})
+			}
+			i = k
+		}
+	}
+	return rs
+}
+
+func isWordChar(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+func applyChange(text string, c lsp.TextDocumentContentChangeEvent) string {
+	if c.Range == nil {
+		return c.Text
+	}
+	return text[:offset(text, c.Range.Start)] + c.Text + text[offset(text, c.Range.End):]
+}
+
+func offset(text string, p lsp.Position) int {
+	i := 0
+	for line := 0; line < p.Line; line++ {
+		j := strings.IndexByte(text[i:], '\n')
+		if j == -1 {
+			return len(text)
+		}
+		i += j + 1
+	}
+	lineText := text[i:]
+	if j := strings.IndexByte(lineText, '\n'); j != -1 {
+		lineText = lineText[:j]
+	}
+	return i + lsp.ByteOffset(lineText, p.Character)
+}
@@ -0,0 +1,206 @@
+// Package merge implements line-based three-way merging of text.
+package merge
+
+import "strings"
+
+// Markers delimiting each side of a conflict in merged output.
+const (
+	MineMarker   = "<<<<<<< mine"
+	SplitMarker  = "======="
+	TheirsMarker = ">>>>>>> theirs"
+)
+
+// A hunk records that the lines [BaseBegin, BaseEnd[ of the original text were replaced by the lines
+// [Begin, End[ of the modified text.
+type hunk struct {
+	BaseBegin, BaseEnd int
+	Begin, End         int
+}
+
+// Merge combines the changes made to base in mine and in theirs, which are both slices of lines.
+// Lines are compared exactly, so they should include their terminating newline, if any.
+//
+// Where both sides changed the same lines differently, both versions are included in the result,
+// delimited by conflict markers; Merge returns the number of such conflicts.
+func Merge(base, mine, theirs []string) (merged []string, conflicts int) {
+	hm, ht := diff(base, mine), diff(base, theirs)
+	basePos := 0
+	for len(hm) > 0 || len(ht) > 0 {
+		// Collect the next group of overlapping hunks from both sides.
+		var gm, gt []hunk
+		begin, end := 0, 0
+		if len(ht) == 0 || (len(hm) > 0 && hm[0].BaseBegin <= ht[0].BaseBegin) {
+			begin, end = hm[0].BaseBegin, hm[0].BaseEnd
+			gm, hm = []hunk{hm[0]}, hm[1:]
+		} else {
+			begin, end = ht[0].BaseBegin, ht[0].BaseEnd
+			gt, ht = []hunk{ht[0]}, ht[1:]
+		}
+		for {
+			if len(hm) > 0 && hm[0].BaseBegin <= end {
+				end = max(end, hm[0].BaseEnd)
+				gm, hm = append(gm, hm[0]), hm[1:]
+			} else if len(ht) > 0 && ht[0].BaseBegin <= end {
+				end = max(end, ht[0].BaseEnd)
+				gt, ht = append(gt, ht[0]), ht[1:]
+			} else {
+				break
+			}
+		}
+		merged = append(merged, base[basePos:begin]...)
+		basePos = end
+		m, t := side(base, mine, gm, begin, end), side(base, theirs, gt, begin, end)
+		switch {
+		case len(gt) == 0 || equal(m, t):
+			merged = append(merged, m...)
+		case len(gm) == 0:
+			merged = append(merged, t...)
+		default:
+			merged = append(merged, MineMarker+"\n")
+			merged = appendTerminated(merged, m)
+			merged = append(merged, SplitMarker+"\n")
+			merged = appendTerminated(merged, t)
+			merged = append(merged, TheirsMarker+"\n")
+			conflicts++
+		}
+	}
+	return append(merged, base[basePos:]...), conflicts
+}
+
+// side returns the lines that replace [begin, end[ of base in the modified text, given the hunks
+// that overlap that range.
+func side(base, modified []string, hunks []hunk, begin, end int) []string {
+	if len(hunks) == 0 {
+		return base[begin:end]
+	}
+	first, last := hunks[0], hunks[len(hunks)-1]
+	return modified[first.Begin-(first.BaseBegin-begin) : last.End+(end-last.BaseEnd)]
+}
+
+// appendTerminated appends lines to dst, making sure that the last of them ends in a newline so
+// that a conflict marker can follow it.
+func appendTerminated(dst, lines []string) []string {
+	dst = append(dst, lines...)
+	if n := len(dst); n > 0 && !strings.HasSuffix(dst[n-1], "\n") {
+		dst[n-1] += "\n"
+	}
+	return dst
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diff returns the hunks needed to turn a into b, in order.
+// It uses Myers' algorithm, which finds a minimal set of changes.
+func diff(a, b []string) []hunk {
+	// Trim common lines at the ends first; this is cheap, and in practice usually leaves very little
+	// for the main algorithm to do.
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	s := 0
+	for s < len(a)-p && s < len(b)-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	hunks := myers(a[p:len(a)-s], b[p:len(b)-s])
+	for i := range hunks {
+		hunks[i].BaseBegin += p
+		hunks[i].BaseEnd += p
+		hunks[i].Begin += p
+		hunks[i].End += p
+	}
+	return hunks
+}
+
+func myers(a, b []string) []hunk {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	// trace[d] holds v[offset-d+1 : offset+d] as it was at the start of step d: the only part of it
+	// that step reads, since it only reaches diagonals -d to d. Keeping the whole of v for each step
+	// would take O((n+m)·D) memory.
+	var trace [][]int
+	d := 0
+search:
+	for ; d <= n+m; d++ {
+		if d == 0 {
+			trace = append(trace, nil)
+		} else {
+			trace = append(trace, append([]int(nil), v[offset-d+1:offset+d]...))
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+	// Walk back through the trace, recording each edit as a one-line hunk, then coalesce adjacent ones.
+	var edits []hunk
+	x, y := n, m
+	for ; d > 0; d-- {
+		saved := trace[d]
+		v := func(k int) int { return saved[k+d-1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+		}
+		if x == prevX {
+			edits = append(edits, hunk{BaseBegin: x, BaseEnd: x, Begin: prevY, End: y})
+		} else {
+			edits = append(edits, hunk{BaseBegin: prevX, BaseEnd: x, Begin: y, End: y})
+		}
+		x, y = prevX, prevY
+	}
+	var hunks []hunk
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		if l := len(hunks) - 1; l >= 0 && hunks[l].BaseEnd == e.BaseBegin && hunks[l].End == e.Begin {
+			hunks[l].BaseEnd = e.BaseEnd
+			hunks[l].End = e.End
+		} else {
+			hunks = append(hunks, e)
+		}
+	}
+	return hunks
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
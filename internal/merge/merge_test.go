@@ -0,0 +1,73 @@
+package merge
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.SplitAfter(s, "\n")
+}
+
+var mergeTests = []struct {
+	name               string
+	base, mine, theirs string
+	want               string
+	wantConflicts      int
+}{
+	{"NoChanges", "a\nb\nc", "a\nb\nc", "a\nb\nc", "a\nb\nc", 0},
+	{"OnlyMine", "a\nb\nc", "a\nB\nc", "a\nb\nc", "a\nB\nc", 0},
+	{"OnlyTheirs", "a\nb\nc", "a\nb\nc", "a\nb\nC", "a\nb\nC", 0},
+	{"Disjoint", "a\nb\nc\nd\ne", "A\nb\nc\nd\ne", "a\nb\nc\nd\nE\nF", "A\nb\nc\nd\nE\nF", 0},
+	{"SameChange", "a\nb\nc", "a\nX\nc", "a\nX\nc", "a\nX\nc", 0},
+	{"Deletions", "a\nb\nc\nd\ne", "a\nc\nd\ne", "a\nb\nc\nd", "a\nc\nd", 0},
+	{"Conflict", "a\nb\nc", "a\nmine\nc", "a\ntheirs\nc",
+		"a\n<<<<<<< mine\nmine\n=======\ntheirs\n>>>>>>> theirs\nc", 1},
+	{"ConflictAtEnd", "a\nb", "a\nmine", "a\ntheirs",
+		"a\n<<<<<<< mine\nmine\n=======\ntheirs\n>>>>>>> theirs\n", 1},
+}
+
+func TestMerge(t *testing.T) {
+	for _, tt := range mergeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := Merge(lines(tt.base), lines(tt.mine), lines(tt.theirs))
+			if got := strings.Join(merged, ""); got != tt.want || conflicts != tt.wantConflicts {
+				t.Errorf("got %q with %d conflicts, want %q with %d", got, conflicts, tt.want, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+// apply applies hunks produced by diff(a, b) to a; the result should be b.
+func apply(a, b []string, hunks []hunk) []string {
+	var out []string
+	pos := 0
+	for _, h := range hunks {
+		out = append(out, a[pos:h.BaseBegin]...)
+		out = append(out, b[h.Begin:h.End]...)
+		pos = h.BaseEnd
+	}
+	return append(out, a[pos:]...)
+}
+
+func TestDiffRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		l := make([]string, rng.Intn(30))
+		for i := range l {
+			l[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return l
+	}
+	for i := 0; i < 1000; i++ {
+		a, b := randomLines(), randomLines()
+		if got := apply(a, b, diff(a, b)); !reflect.DeepEqual(got, b) && !(len(got) == 0 && len(b) == 0) {
+			t.Fatalf("applying diff(%q, %q) gives %q", a, b, got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package pathwatch
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+
+// inotifyNotifier is a notifier using the Linux inotify API.
+type inotifyNotifier struct {
+	fd   int
+	file *os.File // The same file as fd; reading through it lets the runtime poller handle blocking
+
+	mu   sync.Mutex
+	wds  map[int]string // The directory watched by each watch descriptor
+	dirs map[string]int // The watch descriptor for each directory
+
+	ch     chan dirEvent
+	errors chan<- error
+	done   chan struct{}
+}
+
+func newNotifier(errors chan<- error) (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotifyNotifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		wds:    map[int]string{},
+		dirs:   map[string]int{},
+		ch:     make(chan dirEvent, 10),
+		errors: errors,
+		done:   make(chan struct{}),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) add(dir string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	wd, err := unix.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	n.wds[wd] = dir
+	n.dirs[dir] = wd
+	return nil
+}
+
+func (n *inotifyNotifier) remove(dir string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	wd, ok := n.dirs[dir]
+	if !ok {
+		return
+	}
+	delete(n.dirs, dir)
+	delete(n.wds, wd)
+	unix.InotifyRmWatch(n.fd, uint32(wd))
+}
+
+func (n *inotifyNotifier) events() <-chan dirEvent { return n.ch }
+
+func (n *inotifyNotifier) close() {
+	close(n.done)
+	n.file.Close()
+}
+
+func (n *inotifyNotifier) read() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		k, err := n.file.Read(buf)
+		if err != nil {
+			select {
+			case n.errors <- err:
+			case <-n.done:
+			}
+			return
+		}
+		for i := 0; i+unix.SizeofInotifyEvent <= k; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			nameStart := i + unix.SizeofInotifyEvent
+			i = nameStart + int(raw.Len)
+			ev, ok := n.translate(int(raw.Wd), raw.Mask, strings.TrimRight(string(buf[nameStart:i]), "\x00"))
+			if !ok {
+				continue
+			}
+			select {
+			case n.ch <- ev:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
+
+// translate converts an inotify event into a dirEvent, if it is relevant.
+func (n *inotifyNotifier) translate(wd int, mask uint32, name string) (dirEvent, bool) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		return dirEvent{}, true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dir, ok := n.wds[wd]
+	if !ok {
+		return dirEvent{}, false
+	}
+	if mask&unix.IN_IGNORED != 0 {
+		// The kernel removed the watch, because the directory was deleted or its file system unmounted.
+		delete(n.wds, wd)
+		if n.dirs[dir] == wd {
+			delete(n.dirs, dir)
+		}
+		return dirEvent{dir: dir, op: Deleted}, true
+	}
+	ev := dirEvent{dir: dir, name: name}
+	switch {
+	case mask&unix.IN_DELETE_SELF != 0:
+		ev.op = Deleted
+	case mask&unix.IN_MOVE_SELF != 0:
+		ev.op = Renamed
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		ev.op = Created
+	case mask&unix.IN_DELETE != 0:
+		ev.op = Deleted
+	case mask&unix.IN_MOVED_FROM != 0:
+		ev.op = Renamed
+	case mask&unix.IN_CLOSE_WRITE != 0:
+		ev.op = Modified
+	default:
+		return dirEvent{}, false
+	}
+	return ev, true
+}
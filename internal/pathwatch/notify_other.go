@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package pathwatch
+
+import "errors"
+
+func newNotifier(errs chan<- error) (notifier, error) {
+	return nil, errors.New("native file system notifications not supported")
+}
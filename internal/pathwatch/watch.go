@@ -0,0 +1,262 @@
+// Package pathwatch provides file system change notifications.
+package pathwatch
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A Watcher keeps track of a set of paths and sends an Event on user-provided channels
+// whenever the file or directory at one of them changes.
+//
+// On Linux, the Watcher is notified of changes by the operating system, by watching the
+// parent directory of each path; this way, it also sees files being replaced by renaming
+// another file over them. Elsewhere, and for paths whose parent directory doesn't exist,
+// it polls the paths periodically, which can miss changes that don't affect a file's size
+// or modification time.
+//
+// Any errors that the Watcher encounters while monitoring the paths are delivered on the
+// channel returned by Error.
+type Watcher struct {
+	files    map[string]*watchedFile
+	dirs     map[string]int // The number of natively watched files in each directory
+	notifier notifier       // nil if there is no native notification mechanism
+	errors   chan error
+	control  chan func()
+}
+
+type watchedFile struct {
+	lastInfo  os.FileInfo
+	native    bool // Whether changes to this file are detected by the notifier, rather than by polling
+	observers []chan<- Event
+}
+
+// An Event describes a change to a watched path.
+type Event struct {
+	Path string
+	Op   Op
+}
+
+// An Op is a kind of change to a path.
+type Op int
+
+const (
+	Modified Op = iota // The file was written to, or replaced with another one
+	Created            // A file was created where there was none before
+	Deleted            // The file was deleted
+	Renamed            // The file was moved to another path
+)
+
+func (op Op) String() string {
+	switch op {
+	case Modified:
+		return "Modified"
+	case Created:
+		return "Created"
+	case Deleted:
+		return "Deleted"
+	case Renamed:
+		return "Renamed"
+	}
+	return "Op(" + strconv.Itoa(int(op)) + ")"
+}
+
+const pollInterval = time.Second / 8
+
+// NewWatcher starts a new watcher.
+// When no longer in use, the user should call Close to release resources associated with it.
+func NewWatcher() *Watcher {
+	w := newPollingWatcher()
+	if n, err := newNotifier(w.errors); err == nil {
+		w.notifier = n
+	}
+	go w.run()
+	return w
+}
+
+func newPollingWatcher() *Watcher {
+	return &Watcher{
+		files:   map[string]*watchedFile{},
+		dirs:    map[string]int{},
+		errors:  make(chan error, 10),
+		control: make(chan func(), 10),
+	}
+}
+
+// Normally we don't want a notification when we add a file, since it's redundant,
+// but for testing we need it in order to be able to reliably detect modifications without
+// races.
+var notifyOnAdd = false
+
+// Add begins sending change notifications for a path on the given channel.
+// Multiple calls to Add for the same path, but different channels, are permitted;
+// in that case, the notifications will be sent on all of them.
+func (w *Watcher) Add(path string, ch chan<- Event) {
+	w.control <- func() {
+		wf, ok := w.files[path]
+		if !ok {
+			wf = &watchedFile{}
+			w.watchNatively(path, wf)
+			wf.lastInfo = w.stat(path)
+			w.files[path] = wf
+		}
+		wf.observers = append(wf.observers, ch)
+		if notifyOnAdd {
+			ch <- Event{Path: path, Op: Modified}
+		}
+	}
+}
+
+// Remove stops sending change notifications for a path on the given channel.
+// It does not cancel other calls to Add made for the same path, but different
+// channels.
+func (w *Watcher) Remove(path string, ch chan<- Event) {
+	w.control <- func() {
+		wf, ok := w.files[path]
+		if !ok {
+			return
+		}
+		for i, ob := range wf.observers {
+			if ob != ch {
+				continue
+			}
+			if len(wf.observers) == 1 {
+				w.unwatchNatively(path, wf)
+				delete(w.files, path)
+			} else {
+				n := len(wf.observers) - 1
+				wf.observers[i] = wf.observers[n]
+				wf.observers = wf.observers[:n]
+			}
+			return
+		}
+	}
+}
+
+// Errors returns a channel on which the Watcher delivers errors it encounters.
+func (w *Watcher) Errors() <-chan error { return w.errors }
+
+// Close stops delivering change notifications for any paths and releases all resources
+// associated with the watcher.
+func (w *Watcher) Close() { w.control <- nil }
+
+func (w *Watcher) run() {
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+	var events <-chan dirEvent
+	if w.notifier != nil {
+		events = w.notifier.events()
+		defer w.notifier.close()
+	}
+	for {
+		select {
+		case <-tick.C:
+			w.poll()
+		case ev := <-events:
+			w.handleDirEvent(ev)
+		case f := <-w.control:
+			if f == nil {
+				return
+			}
+			f()
+		}
+	}
+}
+
+// stat returns information about the file at path, or nil if it doesn't exist.
+func (w *Watcher) stat(path string) os.FileInfo {
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		w.errors <- err
+	}
+	return info
+}
+
+func (w *Watcher) send(path string, wf *watchedFile, op Op) {
+	for _, ob := range wf.observers {
+		ob <- Event{Path: path, Op: op}
+	}
+}
+
+// watchNatively starts watching path with the notifier, if possible.
+func (w *Watcher) watchNatively(path string, wf *watchedFile) {
+	if w.notifier == nil || wf.native {
+		return
+	}
+	dir := filepath.Dir(path)
+	if w.dirs[dir] == 0 {
+		if err := w.notifier.add(dir); err != nil {
+			return
+		}
+	}
+	w.dirs[dir]++
+	wf.native = true
+}
+
+func (w *Watcher) unwatchNatively(path string, wf *watchedFile) {
+	if !wf.native {
+		return
+	}
+	wf.native = false
+	dir := filepath.Dir(path)
+	if w.dirs[dir]--; w.dirs[dir] == 0 {
+		delete(w.dirs, dir)
+		w.notifier.remove(dir)
+	}
+}
+
+func (w *Watcher) handleDirEvent(ev dirEvent) {
+	switch {
+	case ev.dir == "":
+		// Some events may have been lost; check every file for changes.
+		for path, wf := range w.files {
+			if wf.native {
+				w.check(path, wf)
+			}
+		}
+	case ev.name == "":
+		// The directory itself is gone, so its files will have to be polled until it comes back.
+		for path, wf := range w.files {
+			if !wf.native || filepath.Dir(path) != ev.dir {
+				continue
+			}
+			w.unwatchNatively(path, wf)
+			info := w.stat(path)
+			if wf.lastInfo != nil && info == nil {
+				w.send(path, wf, ev.op)
+			}
+			wf.lastInfo = info
+		}
+	default:
+		path := filepath.Join(ev.dir, ev.name)
+		wf, ok := w.files[path]
+		if !ok || !wf.native {
+			return
+		}
+		op := ev.op
+		if op == Created && wf.lastInfo != nil {
+			op = Modified
+		}
+		wf.lastInfo = w.stat(path)
+		w.send(path, wf, op)
+	}
+}
+
+// A notifier watches directories for changes using a native OS mechanism.
+// All of its methods, except events, are called only from the Watcher's goroutine.
+type notifier interface {
+	add(dir string) error
+	remove(dir string)
+	events() <-chan dirEvent
+	close()
+}
+
+// A dirEvent is a change to the file named name within dir.
+// If name is empty, the change happened to dir itself; if dir is also empty, some events
+// were lost.
+type dirEvent struct {
+	dir, name string
+	op        Op
+}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -12,32 +13,46 @@ func init() {
 	notifyOnAdd = true
 }
 
+func newTestPollingWatcher() *Watcher {
+	w := newPollingWatcher()
+	go w.run()
+	return w
+}
+
 func TestWatch(t *testing.T) {
+	t.Run("Native", func(t *testing.T) { testWatch(t, NewWatcher(), runtime.GOOS == "linux") })
+	t.Run("Polling", func(t *testing.T) { testWatch(t, newTestPollingWatcher(), false) })
+}
+
+func testWatch(t *testing.T, w *Watcher, native bool) {
+	defer w.Close()
+	if native && w.notifier == nil {
+		t.Fatal("native notifications unavailable")
+	}
 	dir, err := ioutil.TempDir("", "mflg-path-watch-test")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
-	w := NewWatcher()
 	t.Run("OnWrite", func(t *testing.T) {
 		f := create(t, filepath.Join(dir, "A"))
 		changes := w.addWait(f.Name())
 		f.WriteString("Hello.")
 		f.Close()
-		waitChange(t, changes, 250*time.Millisecond)
+		waitChange(t, changes, Modified, 250*time.Millisecond)
 	})
 	t.Run("OnDelete", func(t *testing.T) {
 		f := create(t, filepath.Join(dir, "B"))
 		changes := w.addWait(f.Name())
 		f.Close()
 		os.Remove(f.Name())
-		waitChange(t, changes, 250*time.Millisecond)
+		waitChange(t, changes, Deleted, 250*time.Millisecond)
 	})
 	t.Run("OnCreate", func(t *testing.T) {
 		name := filepath.Join(dir, "C")
 		changes := w.addWait(name)
 		create(t, name).Close()
-		waitChange(t, changes, 250*time.Millisecond)
+		waitChange(t, changes, Created, 250*time.Millisecond)
 	})
 	t.Run("OnParentDirCreate", func(t *testing.T) {
 		name := filepath.Join(dir, "D", "E")
@@ -46,7 +61,7 @@ func TestWatch(t *testing.T) {
 			t.Fatal(err)
 		}
 		create(t, name).Close()
-		waitChange(t, changes, 250*time.Millisecond)
+		waitChange(t, changes, Created, 250*time.Millisecond)
 	})
 	t.Run("OnParentDirDelete", func(t *testing.T) {
 		name := filepath.Join(dir, "F", "G")
@@ -56,12 +71,43 @@ func TestWatch(t *testing.T) {
 		create(t, name).Close()
 		changes := w.addWait(name)
 		os.RemoveAll(filepath.Dir(name))
-		waitChange(t, changes, 250*time.Millisecond)
+		waitChange(t, changes, Deleted, 250*time.Millisecond)
+	})
+	t.Run("OnReplace", func(t *testing.T) {
+		name := filepath.Join(dir, "H")
+		create(t, name).Close()
+		changes := w.addWait(name)
+		tmp := create(t, filepath.Join(dir, "H.tmp"))
+		tmp.WriteString("Replaced.")
+		tmp.Close()
+		if err := os.Rename(tmp.Name(), name); err != nil {
+			t.Fatal(err)
+		}
+		waitChange(t, changes, Modified, 250*time.Millisecond)
+	})
+	if !native {
+		return
+	}
+	t.Run("OnSameSizeRewrite", func(t *testing.T) {
+		name := filepath.Join(dir, "I")
+		writeFile(t, name, "AAAA")
+		changes := w.addWait(name)
+		writeFile(t, name, "BBBB")
+		waitChange(t, changes, Modified, 250*time.Millisecond)
+	})
+	t.Run("OnRename", func(t *testing.T) {
+		name := filepath.Join(dir, "J")
+		create(t, name).Close()
+		changes := w.addWait(name)
+		if err := os.Rename(name, filepath.Join(dir, "K")); err != nil {
+			t.Fatal(err)
+		}
+		waitChange(t, changes, Renamed, 250*time.Millisecond)
 	})
 }
 
-func (w *Watcher) addWait(path string) <-chan struct{} {
-	changes := make(chan struct{}, 10)
+func (w *Watcher) addWait(path string) <-chan Event {
+	changes := make(chan Event, 10)
 	w.Add(path, changes)
 	<-changes
 	return changes
@@ -75,11 +121,25 @@ func create(t *testing.T, path string) *os.File {
 	return f
 }
 
-func waitChange(t *testing.T, ch <-chan struct{}, timeout time.Duration) {
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitChange waits for an event with the given op on ch, ignoring any others.
+func waitChange(t *testing.T, ch <-chan Event, op Op, timeout time.Duration) {
 	t.Helper()
-	select {
-	case <-ch:
-	case <-time.After(timeout):
-		t.Error("failed to receive notification after", timeout)
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Op == op {
+				return
+			}
+		case <-deadline:
+			t.Errorf("failed to receive %v notification after %v", op, timeout)
+			return
+		}
 	}
 }
@@ -17,6 +17,10 @@ type Style struct {
 	Foreground, Background  *color.Color
 	Bold, Italic, Underline bool
 	Inverted                bool
+	// If true, the underline is drawn as a wavy line, where the terminal supports it; this implies Underline.
+	CurlyUnderline bool
+	// If not nil, the color of the underline; otherwise, it matches the foreground color.
+	UnderlineColor *color.Color
 }
 
 // A Cell represents a single character along with the style it should be displayed with.
@@ -108,6 +112,15 @@ func (s *Screen) SetCursorPos(p Point) { s.cursorPos = p }
 // SetCursorVisible sets whether the cursor is visible.
 func (s *Screen) SetCursorVisible(visible bool) { s.cursorVisible = visible }
 
+// Invalidate makes the next call to Flip redraw everything from scratch, title and cursor included,
+// for when something else may have written to the terminal since the last one.
+func (s *Screen) Invalidate() {
+	s.prev = nil
+	s.needsRedraw = true
+	s.titleNeedsRedraw = true
+	s.prevCursorVisible = !s.cursorVisible
+}
+
 var styleReset = termesc.SetGraphicAttributes(termesc.StyleNone)
 
 // Flip replaces the contents of the screen with the current contents of the Screen's buffer.
@@ -242,9 +255,15 @@ func makeSGRString(s *Style) string {
 	if s.Italic {
 		params = append(params, termesc.StyleItalic)
 	}
-	if s.Underline {
+	switch {
+	case s.CurlyUnderline:
+		params = append(params, termesc.StyleCurlyUnderline)
+	case s.Underline:
 		params = append(params, termesc.StyleUnderline)
 	}
+	if uc := s.UnderlineColor; uc != nil {
+		params = append(params, termesc.OutputColorUnderline(*uc))
+	}
 	if s.Inverted {
 		params = append(params, termesc.StyleInverted)
 	}
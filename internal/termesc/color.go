@@ -25,8 +25,20 @@ const (
 	StyleNotInverted       GraphicFlag = 27
 	ColorDefault           GraphicFlag = 39
 	ColorDefaultBackground GraphicFlag = 49
+	ColorDefaultUnderline  GraphicFlag = 59
 )
 
+// StyleCurlyUnderline draws a wavy underline, as commonly used to mark errors.
+const StyleCurlyUnderline = underlineStyle(3)
+
+// An underlineStyle selects a kind of underline, using the 4:n subparameter syntax.
+type underlineStyle int
+
+func (u underlineStyle) forEachSGRCode(f func(int, bool)) {
+	f(4, false)
+	f(int(u), true)
+}
+
 // Constants for the 3-bit ANSI color palette.
 const (
 	ColorBlack GraphicFlag = 30 + iota
@@ -41,20 +53,34 @@ const (
 
 // OutputColor returns the input color, reducing the color depth if the terminal does
 // not support full 24-bit color codes.
-func OutputColor(c color.Color) GraphicAttribute { return outputColor(c, false) }
+func OutputColor(c color.Color) GraphicAttribute { return outputColor(c, layerForeground) }
 
 // OutputColorBackground is like OutputColor, but returns a code that sets the background
 // color instead.
-func OutputColorBackground(c color.Color) GraphicAttribute { return outputColor(c, true) }
+func OutputColorBackground(c color.Color) GraphicAttribute { return outputColor(c, layerBackground) }
+
+// OutputColorUnderline is like OutputColor, but returns a code that sets the color of
+// underlines instead.
+func OutputColorUnderline(c color.Color) GraphicAttribute { return outputColor(c, layerUnderline) }
+
+// A colorLayer is the part of the text that a color applies to; its value is the SGR code
+// that introduces such colors.
+type colorLayer int
 
-func outputColor(c color.Color, bg bool) GraphicAttribute {
+const (
+	layerForeground colorLayer = 38
+	layerBackground colorLayer = 48
+	layerUnderline  colorLayer = 58
+)
+
+func outputColor(c color.Color, layer colorLayer) GraphicAttribute {
 	if hasTruecolor {
-		return color24{c.R, c.G, c.B, bg}
+		return color24{c.R, c.G, c.B, layer}
 	}
 	nr := narrowChannel(c.R)
 	ng := narrowChannel(c.G)
 	nb := narrowChannel(c.B)
-	return color8{16 + 36*nr + 6*ng + nb, bg}
+	return color8{16 + 36*nr + 6*ng + nb, layer}
 }
 
 func narrowChannel(x uint8) int {
@@ -63,46 +89,51 @@ func narrowChannel(x uint8) int {
 
 // color24 is a 24-bit RGB color, with 8 bits per channel.
 type color24 struct {
-	R, G, B    uint8
-	Background bool
+	R, G, B uint8
+	Layer   colorLayer
 }
 
-func (c color24) forEachSGRCode(f func(int)) {
-	if c.Background {
-		f(48)
-	} else {
-		f(38)
+func (c color24) forEachSGRCode(f func(int, bool)) {
+	// Underline colors are newer than the others, and terminals that don't know them would read
+	// the parameters that follow as separate codes; in the subparameter form, they are skipped
+	// along with it. That form includes a color space ID, which is left empty.
+	sub := c.Layer == layerUnderline
+	f(int(c.Layer), false)
+	f(2, sub)
+	if sub {
+		f(omittedSubparameter, true)
 	}
-	f(2)
-	f(int(c.R))
-	f(int(c.G))
-	f(int(c.B))
+	f(int(c.R), sub)
+	f(int(c.G), sub)
+	f(int(c.B), sub)
 }
 
 type color8 struct {
-	Color      int
-	Background bool
+	Color int
+	Layer colorLayer
 }
 
-func (c color8) forEachSGRCode(f func(int)) {
-	if c.Background {
-		f(48)
-	} else {
-		f(38)
-	}
-	f(5)
-	f(int(c.Color))
+func (c color8) forEachSGRCode(f func(int, bool)) {
+	sub := c.Layer == layerUnderline
+	f(int(c.Layer), false)
+	f(5, sub)
+	f(int(c.Color), sub)
 }
 
-func (c GraphicFlag) forEachSGRCode(f func(int)) { f(int(c)) }
+func (c GraphicFlag) forEachSGRCode(f func(int, bool)) { f(int(c), false) }
 
 // A GraphicAttribute is any graphic attribute that can be define by ANSI escape codes.
 // Currently it can only be a GraphicFlag or Color24; Color8 will be implemented in the future.
 type GraphicAttribute interface {
 	// Yields the numbers to put in the CSI ... ; ... m sequence for this attribute.
-	forEachSGRCode(func(int))
+	// Numbers that are subparameters of the previous one, and so must be separated from it by
+	// a colon rather than a semicolon, are yielded with the second argument set to true.
+	// omittedSubparameter stands for a subparameter that is left empty.
+	forEachSGRCode(func(code int, subparameter bool))
 }
 
+const omittedSubparameter = -1
+
 // SetGraphicAttributes returns a code that applies the specified graphic attributes to all future text written
 // to the terminal, in the order given.
 func SetGraphicAttributes(attrs ...GraphicAttribute) string {
@@ -112,11 +143,16 @@ func SetGraphicAttributes(attrs ...GraphicAttribute) string {
 	b := make([]byte, len(csi), 64)
 	copy(b, csi)
 	for _, attr := range attrs {
-		attr.forEachSGRCode(func(x int) {
-			if len(b) > len(csi) {
+		attr.forEachSGRCode(func(x int, subparameter bool) {
+			switch {
+			case subparameter:
+				b = append(b, ':')
+			case len(b) > len(csi):
 				b = append(b, ';')
 			}
-			b = strconv.AppendInt(b, int64(x), 10)
+			if x != omittedSubparameter {
+				b = strconv.AppendInt(b, int64(x), 10)
+			}
 		})
 	}
 	return string(append(b, 'm'))
@@ -0,0 +1,33 @@
+package termesc
+
+import (
+	"testing"
+
+	"github.com/dpinela/mflg/internal/color"
+)
+
+func TestSetGraphicAttributes(t *testing.T) {
+	defer func(old bool) { hasTruecolor = old }(hasTruecolor)
+	hasTruecolor = true
+	c := color.Color{R: 255, G: 0, B: 10}
+	for _, tt := range []struct {
+		attrs []GraphicAttribute
+		want  string
+	}{
+		{nil, ""},
+		{[]GraphicAttribute{StyleBold}, "\x1b[1m"},
+		{[]GraphicAttribute{StyleNone, StyleCurlyUnderline, StyleBold}, "\x1b[0;4:3;1m"},
+		{[]GraphicAttribute{OutputColor(c), OutputColorUnderline(c)}, "\x1b[38;2;255;0;10;58:2::255:0:10m"},
+	} {
+		if got := SetGraphicAttributes(tt.attrs...); got != tt.want {
+			t.Errorf("SetGraphicAttributes(%v) = %q, want %q", tt.attrs, got, tt.want)
+		}
+	}
+	hasTruecolor = false
+	if got, want := SetGraphicAttributes(OutputColorBackground(c)), "\x1b[48;5;196m"; got != want {
+		t.Errorf("without truecolor, got %q, want %q", got, want)
+	}
+	if got, want := SetGraphicAttributes(OutputColorUnderline(c)), "\x1b[58:5:196m"; got != want {
+		t.Errorf("underline color without truecolor, got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dpinela/mflg/internal/termesc"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
+)
+
+// A console is the terminal that the application runs in, as far as job control is concerned.
+type console interface {
+	// acquire sets the terminal up for mflg's use.
+	acquire() error
+	// suspend puts the terminal back the way it was before acquire, then stops mflg until the
+	// shell continues it. The terminal must be acquired again afterwards, even if it fails.
+	suspend() error
+}
+
+// ttyConsole is the console given by mflg's standard input and output.
+type ttyConsole struct {
+	oldMode *terminal.State // The mode the terminal was in before it was acquired
+}
+
+func (c *ttyConsole) acquire() error {
+	oldMode, err := terminal.MakeRaw(0)
+	if err != nil {
+		return fmt.Errorf("error entering raw mode: %w", err)
+	}
+	c.oldMode = oldMode
+	_, err = os.Stdout.WriteString(termesc.EnableMouseReporting + termesc.EnableBracketedPaste + termesc.EnterAlternateScreen)
+	return err
+}
+
+// release puts the terminal back the way it was before acquire.
+func (c *ttyConsole) release() error {
+	_, err := os.Stdout.WriteString(termesc.ExitAlternateScreen + termesc.DisableBracketedPaste + termesc.ShowCursor + termesc.DisableMouseReporting)
+	if rerr := terminal.Restore(0, c.oldMode); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (c *ttyConsole) suspend() error {
+	if err := c.release(); err != nil {
+		return err
+	}
+	// Stop the whole process group, as the shell does when Control-Z is typed at it. This returns
+	// once mflg is continued, or straight away if the signal is discarded, as it is when there is
+	// no shell doing job control.
+	return unix.Kill(0, unix.SIGTSTP)
+}
+
+// suspend saves the open file and hands the terminal back to the shell, stopping mflg until it is
+// brought back to the foreground. It then takes the terminal over again and has it redrawn from
+// scratch, since it can't be known what was drawn on it in the meantime, and picks up any changes
+// made to the open file while mflg was stopped.
+// It returns an error if the terminal can't be handed back and forth.
+func (app *application) suspend() error {
+	if app.console == nil {
+		return nil
+	}
+	// The user is likely to do something with the file in the meantime.
+	app.finishFormatNow()
+	app.saveNow()
+	app.syncJournal()
+	err := app.console.suspend()
+	if aerr := app.console.acquire(); err == nil {
+		err = aerr
+	}
+	if err != nil {
+		return err
+	}
+	app.screen.Invalidate()
+	if err := app.reloadFile(); err != nil {
+		app.setNotification(err.Error())
+	}
+	// The terminal may have been resized while mflg was stopped.
+	if w, h, err := terminal.GetSize(0); err == nil {
+		app.resize(h, w)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpinela/mflg/internal/buffer"
+)
+
+// Autosaving only happens every so often, so edits made since the last save would be lost if mflg
+// crashed or were killed. To avoid that, every change made to the open file is also appended, as
+// soon as it is made, to a journal kept alongside its undo history; when the file is opened again,
+// any changes found there can be replayed.
+//
+// A journal is made up of JSON values, one per line: a header giving the content that the changes
+// apply to - the file's content as last saved - followed by the changes themselves, in order.
+// It is started afresh on every save.
+
+// journalHeader is the first entry in a journal.
+type journalHeader struct {
+	BaseHash string // The SHA-256 hash of the content the changes apply to, in hex
+}
+
+// A journal records the changes made to a window's buffer, so that they can be recovered after a
+// crash.
+type journal struct {
+	f        *os.File
+	entries  int  // How many changes were recorded since the journal was last reset
+	unsynced bool // Whether anything was written since the last sync
+
+	// Syncing is done by a goroutine of its own, so that a slow disk doesn't hold up the UI.
+	syncReq  chan struct{} // Wakes up the syncing goroutine
+	syncDone chan struct{} // Closed when the syncing goroutine exits
+	mu       sync.Mutex
+	syncErr  error // Set if a sync failed
+}
+
+// openJournal creates the journal for the file at filename, replacing any existing one, with the
+// content whose hash is baseHash as the one that the changes recorded in it apply to.
+func openJournal(filename string, baseHash string) (j *journal, err error) {
+	if filename == os.DevNull {
+		return nil, nil
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("error opening edit journal: %w", err)
+		}
+	}()
+	jf, err := stateFilename("journal", filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(jf), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(jf, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j = &journal{f: f, syncReq: make(chan struct{}, 1), syncDone: make(chan struct{})}
+	if err := j.reset(baseHash); err != nil {
+		f.Close()
+		return nil, err
+	}
+	go j.syncLoop()
+	return j, nil
+}
+
+// reset discards all changes recorded in the journal, and makes the content whose hash is baseHash
+// the one that changes recorded from then on apply to.
+func (j *journal) reset(baseHash string) error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.f.Seek(0, 0); err != nil {
+		return err
+	}
+	j.entries = 0
+	return j.write(journalHeader{BaseHash: baseHash})
+}
+
+// record appends c to the journal.
+func (j *journal) record(c change) error {
+	j.entries++
+	return j.write(c)
+}
+
+// write appends the JSON encoding of v to the journal as a line of its own. Each entry is written
+// with a single system call, so that it survives the process dying right afterwards.
+func (j *journal) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.unsynced = true
+	_, err = j.f.Write(append(data, '\n'))
+	return err
+}
+
+// sync asks for the entries written to the journal since the last sync to be flushed to disk, so
+// that they survive the system crashing as well. Since that is much slower than writing them, it is
+// done in the background, once for each batch of input rather than for each entry; requests made
+// while a sync is running are combined into one. If an earlier sync failed, sync returns its error.
+func (j *journal) sync() error {
+	j.mu.Lock()
+	err := j.syncErr
+	j.mu.Unlock()
+	if err != nil || !j.unsynced {
+		return err
+	}
+	j.unsynced = false
+	select {
+	case j.syncReq <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (j *journal) syncLoop() {
+	defer close(j.syncDone)
+	for range j.syncReq {
+		if err := j.f.Sync(); err != nil {
+			j.mu.Lock()
+			j.syncErr = err
+			j.mu.Unlock()
+			return
+		}
+	}
+}
+
+// closeFile stops the syncing goroutine and closes the journal's file.
+func (j *journal) closeFile() error {
+	close(j.syncReq)
+	<-j.syncDone
+	return j.f.Close()
+}
+
+// close closes the journal, deleting it if it holds no changes.
+func (j *journal) close() error {
+	name := j.f.Name()
+	err := j.closeFile()
+	if j.entries == 0 {
+		os.Remove(name)
+	}
+	return err
+}
+
+// readJournal returns the changes recorded in the journal for the file at filename, as long as
+// they apply to buf, the file's current content. An entry cut short by a crash ends the list.
+func readJournal(filename string, buf *buffer.Buffer) (changes []change, err error) {
+	if filename == os.DevNull {
+		return nil, nil
+	}
+	jf, err := stateFilename("journal", filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading edit journal: %w", err)
+	}
+	f, err := os.Open(jf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading edit journal: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var h journalHeader
+	if err := dec.Decode(&h); err != nil || h.BaseHash != contentHash(buf) {
+		return nil, nil
+	}
+	for {
+		var c change
+		if err := dec.Decode(&c); err != nil {
+			return changes, nil
+		}
+		changes = append(changes, c)
+	}
+}
+
+// journalFailed stops recording the window's changes in its journal after an error writing to it.
+func (w *window) journalFailed(err error) {
+	w.journal.closeFile()
+	w.journal = nil
+	w.app.setNotification(fmt.Sprintf("error writing edit journal: %v", err))
+}
+
+// resetJournal starts the main window's journal afresh from app.savedBuf, the open file's content
+// as last saved or loaded, recording the window's unsaved changes, if there are any, as a single
+// change.
+func (app *application) resetJournal() {
+	w := app.mainWindow
+	if w.journal == nil {
+		return
+	}
+	err := w.journal.reset(app.savedContentHash())
+	if c := contentChange(app.savedBuf, w.buf); err == nil && c.Removed != c.Inserted {
+		err = w.journal.record(c)
+	}
+	if err != nil {
+		w.journalFailed(err)
+	}
+}
+
+// syncJournal has the main window's journal flushed to disk.
+func (app *application) syncJournal() {
+	if w := app.mainWindow; w != nil && w.journal != nil {
+		if err := w.journal.sync(); err != nil {
+			w.journalFailed(err)
+		}
+	}
+}
+
+// closeJournal closes the main window's journal. Unless the window's buffer couldn't be saved,
+// there is nothing left in it to recover, so it is deleted.
+func (app *application) closeJournal() {
+	if w := app.mainWindow; w != nil && w.journal != nil {
+		w.journal.close()
+		w.journal = nil
+	}
+}
+
+// startJournal starts recording the main window's changes in a new journal, replacing the one left
+// by an earlier session.
+func (app *application) startJournal() {
+	j, err := openJournal(app.filename, app.savedContentHash())
+	if err != nil {
+		app.setNotification(err.Error())
+		return
+	}
+	app.mainWindow.journal = j
+	app.resetJournal()
+}
+
+// offerRecovery asks whether to recover changes, found in the journal left behind by an earlier
+// session that didn't get to save them, in the main window. The journal is kept until the user
+// answers; if they dismiss the prompt instead, it is kept until the file is edited, so that the
+// changes are offered again the next time it is opened.
+func (app *application) offerRecovery(changes []change) {
+	app.keepOldJournal = true
+	app.openPrompt(fmt.Sprintf("Recover %d unsaved edits from an earlier session? [y/n]", len(changes)), func(resp string) {
+		switch strings.TrimSpace(resp) {
+		case "y", "Y":
+			app.keepOldJournal = false
+			app.recoverEdits(changes)
+			app.startJournal()
+		case "n", "N":
+			app.keepOldJournal = false
+			app.startJournal()
+		}
+	})
+}
+
+// recoverEdits replays changes in the main window, as a single undo step. It stops at the first
+// one that doesn't fit the buffer, which can only happen if the journal was damaged.
+func (app *application) recoverEdits(changes []change) {
+	w := app.mainWindow
+	n := 0
+	for _, c := range changes {
+		if !w.fits(c) {
+			break
+		}
+		if n == 0 {
+			w.resetSelectionState()
+			w.modificationTime = time.Time{}
+			w.takeSnapshot()
+		}
+		w.edit(c)
+		n++
+	}
+	if n == 0 {
+		app.setNotification("The unsaved edits could not be recovered")
+		return
+	}
+	last := changes[n-1]
+	w.modificationTime = time.Time{}
+	w.gotoTextPos(posAfterInsertion(last.At, last.Inserted))
+	w.needsRedraw = true
+	w.notifyChange()
+	if n < len(changes) {
+		app.setNotification(fmt.Sprintf("Recovered %d of %d unsaved edits; the rest were damaged", n, len(changes)))
+	} else {
+		app.setNotification(fmt.Sprintf("Recovered %d unsaved edits", n))
+	}
+}
+
+// fits reports whether c can be applied to the window's buffer: whether the text it removes is
+// there.
+func (w *window) fits(c change) bool {
+	if c.At.Y < 0 || c.At.X < 0 || c.At.Y >= w.buf.LineCount() {
+		return false
+	}
+	end := posAfterInsertion(c.At, c.Removed)
+	if end.Y >= w.buf.LineCount() || c.At.X > buffer.CharCount(trimLineEnding(w.buf.Line(c.At.Y))) ||
+		end.X > buffer.CharCount(trimLineEnding(w.buf.Line(end.Y))) {
+		return false
+	}
+	return string(w.buf.CopyRange(textRange{Begin: c.At, End: end})) == c.Removed
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/dpinela/mflg/internal/color"
+	"github.com/dpinela/mflg/internal/termdraw"
+	"github.com/dpinela/mflg/internal/termesc"
+)
+
+// A listView is a list of entries shown at the bottom of the screen, from which the user can pick one
+// with the arrow keys and Enter, or with the mouse.
+type listView struct {
+	title    string
+	entries  []string
+	selected int
+	top      int       // The index of the first entry on screen
+	onPick   func(int) // Called with the index of the entry picked, after the list is closed
+	onClose  func()    // If not nil, called when the list is closed, whether an entry was picked or not
+	// If not nil, each entry has a checkbox, which is ticked if the corresponding element is true.
+	// Space and clicking toggle the selected entry's checkbox, rather than picking it.
+	checked []bool
+	// If not nil, returns lines to show above the list to give more detail about the entry at the given
+	// index. Lines starting with "-" or "+" are colored as removed and added text, respectively.
+	preview func(int) []string
+
+	// Where the entries were last drawn, in screen coordinates, and how many rows of preview
+	// were drawn above them and the title.
+	pos, size   termdraw.Point
+	previewRows int
+}
+
+var (
+	listTitleStyle    = termdraw.Style{Bold: true, Background: &color.Color{R: 60, G: 60, B: 60}, Foreground: &color.Color{R: 230, G: 230, B: 230}}
+	listSelectedStyle = termdraw.Style{Inverted: true}
+	listPreviewStyle  = termdraw.Style{Background: &color.Color{R: 30, G: 30, B: 30}}
+	listRemovedStyle  = termdraw.Style{Background: &color.Color{R: 30, G: 30, B: 30}, Foreground: &color.Color{R: 230, G: 80, B: 80}}
+	listAddedStyle    = termdraw.Style{Background: &color.Color{R: 30, G: 30, B: 30}, Foreground: &color.Color{R: 80, G: 200, B: 80}}
+)
+
+// The most lines a list view's preview may take up.
+const maxListPreviewRows = 8
+
+// openList shows a list view with the given title and entries. When the user picks one, onPick is
+// called with its index.
+func (app *application) openList(title string, entries []string, onPick func(int)) {
+	app.list = &listView{title: title, entries: entries, onPick: onPick}
+	app.mainWindow.needsRedraw = true
+}
+
+func (app *application) closeList() {
+	if app.list.onClose != nil {
+		app.list.onClose()
+	}
+	app.list = nil
+	app.mainWindow.needsRedraw = true
+}
+
+func (app *application) pickListEntry(i int) {
+	lv := app.list
+	app.closeList()
+	lv.onPick(i)
+}
+
+// handleListKey handles a key press while the list view is open, reporting whether it was meant for it.
+func (app *application) handleListKey(c string) bool {
+	lv := app.list
+	switch c {
+	case termesc.UpKey:
+		lv.selected = max(lv.selected-1, 0)
+	case termesc.DownKey:
+		lv.selected = max(min(lv.selected+1, len(lv.entries)-1), 0)
+	case "\r":
+		if len(lv.entries) > 0 {
+			app.pickListEntry(lv.selected)
+		}
+	case " ":
+		if lv.checked == nil || len(lv.entries) == 0 {
+			return false
+		}
+		lv.checked[lv.selected] = !lv.checked[lv.selected]
+	case "\x1b":
+		app.closeList()
+	default:
+		return false
+	}
+	return true
+}
+
+// handleListMouseEvent handles a mouse event while the list view is open, reporting whether it
+// was meant for it. Clicking an entry picks it.
+func (app *application) handleListMouseEvent(ev termesc.MouseEvent) bool {
+	lv := app.list
+	i := lv.top + ev.Y - lv.pos.Y
+	if ev.Y < lv.pos.Y-1-lv.previewRows || ev.Y >= lv.pos.Y+lv.size.Y {
+		return false
+	}
+	switch ev.Button {
+	case termesc.LeftButton:
+		if ev.Y >= lv.pos.Y {
+			lv.selected = i
+		}
+	case termesc.ReleaseButton:
+		// Pick on release, so that the main window doesn't see half of the click.
+		switch {
+		case ev.Y < lv.pos.Y || ev.Move:
+		case lv.checked != nil:
+			lv.checked[i] = !lv.checked[i]
+		default:
+			app.pickListEntry(i)
+		}
+	case termesc.ScrollUpButton:
+		lv.selected = max(lv.selected-1, 0)
+	case termesc.ScrollDownButton:
+		lv.selected = max(min(lv.selected+1, len(lv.entries)-1), 0)
+	}
+	return true
+}
+
+// draw draws the list view onto console, with its last row just above yLimit. It takes up at most
+// a third of the screen.
+func (lv *listView) draw(console *termdraw.Screen, yLimit int) {
+	size := console.Size()
+	rows := min(len(lv.entries), max(size.Y/3, 1))
+	lv.size = termdraw.Point{X: size.X, Y: rows}
+	lv.pos = termdraw.Point{X: 0, Y: yLimit - rows}
+	switch {
+	case lv.selected < lv.top:
+		lv.top = lv.selected
+	case lv.selected >= lv.top+rows:
+		lv.top = lv.selected - rows + 1
+	}
+	putPadded(console, termdraw.Point{X: 0, Y: lv.pos.Y - 1}, ellipsify(lv.title, size.X), size.X, listTitleStyle)
+	for i := 0; i < rows; i++ {
+		style := termdraw.Style{}
+		if lv.top+i == lv.selected {
+			style = listSelectedStyle
+		}
+		text := lv.entries[lv.top+i]
+		if lv.checked != nil {
+			if lv.checked[lv.top+i] {
+				text = "[x] " + text
+			} else {
+				text = "[ ] " + text
+			}
+		}
+		putPadded(console, termdraw.Point{X: 0, Y: lv.pos.Y + i}, ellipsify(text, size.X), size.X, style)
+	}
+	lv.previewRows = 0
+	if lv.preview == nil || len(lv.entries) == 0 {
+		return
+	}
+	lines := lv.preview(lv.selected)
+	lv.previewRows = min(len(lines), min(maxListPreviewRows, max(lv.pos.Y-1, 0)))
+	for i, line := range lines[:lv.previewRows] {
+		style := listPreviewStyle
+		switch {
+		case strings.HasPrefix(line, "-"):
+			style = listRemovedStyle
+		case strings.HasPrefix(line, "+"):
+			style = listAddedStyle
+		}
+		line = strings.Replace(line, "\t", "    ", -1)
+		putPadded(console, termdraw.Point{X: 0, Y: lv.pos.Y - 1 - lv.previewRows + i}, ellipsify(line, size.X), size.X, style)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/lsp"
+)
+
+// A languageServer is a language server process, shared by all files in a project that use it.
+type languageServer struct {
+	client  *lsp.Client         // nil until the server has started
+	err     error               // Why the server failed to start, if it did
+	waiting []func(*lsp.Client) // Things to do once the server has started
+}
+
+// How long to wait for a language server to start.
+const languageServerStartTimeout = 10 * time.Second
+
+// withLanguageServer calls f with a client for the language server given by command, running for
+// the project at root. If the server isn't running yet, it is started in the background, and f is
+// called once it is ready; if it fails to start, f is never called.
+func (app *application) withLanguageServer(command []string, root string, f func(*lsp.Client)) {
+	key := root + "\x00" + strings.Join(command, "\x00")
+	if ls := app.langServers[key]; ls != nil {
+		switch {
+		case ls.client != nil:
+			f(ls.client)
+		case ls.err == nil:
+			ls.waiting = append(ls.waiting, f)
+		}
+		return
+	}
+	ls := &languageServer{waiting: []func(*lsp.Client){f}}
+	if app.langServers == nil {
+		app.langServers = map[string]*languageServer{}
+	}
+	app.langServers[key] = ls
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), languageServerStartTimeout)
+		defer cancel()
+		c, err := lsp.Start(ctx, command, root, func(method string, params json.RawMessage) {
+			app.do(func() { app.handleServerNotification(method, params) })
+		})
+		app.do(func() {
+			if err != nil {
+				ls.err = err
+				app.setNotification(err.Error())
+				return
+			}
+			ls.client = c
+			for _, f := range ls.waiting {
+				f(c)
+			}
+			ls.waiting = nil
+		})
+	}()
+}
+
+func (app *application) handleServerNotification(method string, params json.RawMessage) {
+	switch method {
+	case "window/showMessage":
+		var p lsp.ShowMessageParams
+		if json.Unmarshal(params, &p) == nil && p.Type <= lsp.MessageWarning {
+			app.setNotification(p.Message)
+		}
+	case "textDocument/publishDiagnostics":
+		var p lsp.PublishDiagnosticsParams
+		if json.Unmarshal(params, &p) == nil {
+			app.publishDiagnostics(p)
+		}
+	}
+}
+
+// closeLanguageServers shuts down all running language servers.
+func (app *application) closeLanguageServers() {
+	for _, ls := range app.langServers {
+		if ls.client != nil {
+			ls.client.Close()
+		}
+	}
+	app.langServers = nil
+}
+
+// openDocument tells the language server for w's language, if there is one, that w is editing
+// the file at filename, and starts keeping it up to date with w's content.
+func (app *application) openDocument(w *window, filename string) {
+	command := w.langConfig.LanguageServer
+	if len(command) == 0 {
+		return
+	}
+	app.withLanguageServer(command, projectRoot(filename), func(c *lsp.Client) {
+		if app.mainWindow != w {
+			// The file was closed while the server was starting.
+			return
+		}
+		w.doc = &document{client: c, uri: lsp.FileURI(filename), version: 1}
+		c.DidOpen(w.doc.uri, languageID(filepath.Ext(filename)), w.doc.version, bufferText(w.buf))
+	})
+}
+
+func (app *application) closeDocument(w *window) {
+	if w.doc != nil {
+		w.doc.client.DidClose(w.doc.uri)
+		w.doc = nil
+	}
+}
+
+// projectRoot returns the root directory of the project containing the file at filename: the
+// closest directory above it containing a .git directory, or the file's own directory if there is none.
+func projectRoot(filename string) string {
+	start := filepath.Dir(filename)
+	for dir := start; ; {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return start
+		}
+		dir = parent
+	}
+}
+
+// languageID returns the identifier that language servers use for the language of files with
+// the given extension.
+func languageID(ext string) string {
+	ext = strings.TrimPrefix(ext, ".")
+	switch ext {
+	case "js":
+		return "javascript"
+	case "ts":
+		return "typescript"
+	case "py":
+		return "python"
+	case "rs":
+		return "rust"
+	case "h":
+		return "c"
+	case "cc", "cxx", "hpp":
+		return "cpp"
+	case "md":
+		return "markdown"
+	}
+	return ext
+}
+
+// A document links a window's buffer to the language server's copy of it.
+type document struct {
+	client  *lsp.Client
+	uri     string
+	version int
+	// Changes made since the server was last told about them. If the server wants to get the full
+	// text instead, only the presence of changes matters.
+	changes []lsp.TextDocumentContentChangeEvent
+}
+
+// recordChange takes note of a change about to be applied to buf.
+func (d *document) recordChange(buf *buffer.Buffer, c change) {
+	ev := lsp.TextDocumentContentChangeEvent{Text: c.Inserted}
+	if d.client.SyncKind == lsp.SyncIncremental {
+		ev.Range = &lsp.Range{Start: lspPosition(buf, c.At), End: lspPosition(buf, posAfterInsertion(c.At, c.Removed))}
+	}
+	d.changes = append(d.changes, ev)
+}
+
+// sync sends the changes recorded since the last call to the server; buf should be the buffer
+// they were made to.
+func (d *document) sync(buf *buffer.Buffer) {
+	if len(d.changes) == 0 {
+		return
+	}
+	switch d.client.SyncKind {
+	case lsp.SyncIncremental:
+	case lsp.SyncFull:
+		d.changes = []lsp.TextDocumentContentChangeEvent{{Text: bufferText(buf)}}
+	default:
+		d.changes = d.changes[:0]
+		return
+	}
+	d.version++
+	d.client.DidChange(d.uri, d.version, d.changes)
+	d.changes = nil
+}
+
+// lspPosition converts a point in buf to the position language servers use for it.
+func lspPosition(buf *buffer.Buffer, p point) lsp.Position {
+	line := buf.Line(p.Y)
+	return lsp.Position{Line: p.Y, Character: lsp.UTF16Len(line[:buffer.ByteIndexForChar(line, p.X)])}
+}
+
+// bufferPoint converts a position given by a language server to the corresponding point in buf.
+// Positions past the end of a line or of the buffer are moved back to the end.
+func bufferPoint(buf *buffer.Buffer, p lsp.Position) point {
+	if p.Line >= buf.LineCount() {
+		last := buf.LineCount() - 1
+		return point{X: buffer.CharCount(buf.Line(last)), Y: last}
+	}
+	line := strings.TrimSuffix(buf.Line(p.Line), "\n")
+	return point{X: buffer.CharCount(line[:lsp.ByteOffset(line, p.Character)]), Y: p.Line}
+}
+
+func bufferText(buf *buffer.Buffer) string {
+	var sb strings.Builder
+	buf.WriteTo(&sb)
+	return sb.String()
+}
@@ -6,12 +6,12 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime/debug"
 	"time"
 
 	"github.com/dpinela/mflg/internal/atomicwrite"
 	"github.com/dpinela/mflg/internal/buffer"
 	"github.com/dpinela/mflg/internal/termdraw"
-	"github.com/dpinela/mflg/internal/termesc"
 
 	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/sys/unix"
@@ -24,6 +24,13 @@ func saveBuffer(fname string, buf *buffer.Buffer) error {
 	return atomicwrite.Write(fname, func(w io.Writer) error { _, err := buf.WriteTo(w); return err })
 }
 
+// saveAfterPanic saves whatever it can of the user's work after a panic, which may well have left
+// the application in a state where that panics too; such a panic is ignored.
+func saveAfterPanic(app *application) {
+	defer func() { recover() }()
+	app.shutdown()
+}
+
 func allASCIIDigits(s string) bool {
 	for i := range s {
 		if !(s[i] >= '0' && s[i] <= '9') {
@@ -66,25 +73,47 @@ func main() {
 		fmt.Fprintln(os.Stderr, "error finding terminal size:", err)
 		os.Exit(1)
 	}
-	app := newApplication(os.Stdout, termdraw.Point{X: w, Y: h})
+	os.Exit(edit(selector, termdraw.Point{X: w, Y: h}))
+}
+
+// edit runs the editor on the terminal, of the given size, starting at the location given by selector.
+// It returns the status for the program to exit with, once everything has been cleaned up.
+func edit(selector string, size termdraw.Point) (status int) {
+	app := newApplication(os.Stdout, size)
 	defer app.fsWatcher.Close()
+	defer app.closeLanguageServers()
 	app.loadConfig()
 	if err := app.navigateTo(selector); err != nil {
-		fmt.Fprintf(os.Stderr, "error loading %s: %v\n", os.Args[1], err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "error loading %s: %v\n", selector, err)
+		return 1
 	}
-	oldMode, err := terminal.MakeRaw(0)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "error entering raw mode:", err)
-		os.Exit(1)
-	}
-	defer terminal.Restore(0, oldMode)
-	os.Stdout.WriteString(termesc.EnableMouseReporting + termesc.EnableBracketedPaste + termesc.EnterAlternateScreen)
-	defer os.Stdout.WriteString(termesc.ExitAlternateScreen + termesc.DisableBracketedPaste + termesc.ShowCursor + termesc.DisableMouseReporting)
-	resizeCh := make(chan os.Signal, 32)
-	signal.Notify(resizeCh, unix.SIGWINCH)
-	if err := app.run(os.Stdin, resizeCh); err != nil {
+	con := &ttyConsole{}
+	if err := con.acquire(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return 1
 	}
+	app.console = con
+	var runErr error
+	defer func() {
+		r := recover()
+		var stack []byte
+		if r != nil {
+			stack = debug.Stack()
+			saveAfterPanic(app)
+		}
+		con.release()
+		// Errors and stack traces are only readable once the terminal is back to normal.
+		switch {
+		case r != nil:
+			fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", r, stack)
+			status = 2
+		case runErr != nil:
+			fmt.Fprintln(os.Stderr, runErr)
+			status = 1
+		}
+	}()
+	signalCh := make(chan os.Signal, 32)
+	signal.Notify(signalCh, unix.SIGWINCH, unix.SIGTERM, unix.SIGHUP)
+	runErr = app.run(os.Stdin, signalCh)
+	return 0
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dpinela/mflg/internal/buffer"
+)
+
+// A cursor is a place in a window's buffer where edits are made, with the text selected there, if
+// any. Besides the main cursor, given by the window's cursorPos and selection fields, a window may
+// have any number of additional ones; typing, deleting and pasting then act at all of them at once.
+type cursor struct {
+	pos       point // In text space
+	selection optionalTextRange
+}
+
+// allCursors returns the window's cursors, the main one included, sorted by position, along with
+// the index of the main one.
+func (w *window) allCursors() ([]cursor, int) {
+	main := cursor{pos: w.windowCoordsToTextCoords(w.cursorPos), selection: w.selection}
+	i := sort.Search(len(w.extraCursors), func(i int) bool { return main.pos.Less(w.extraCursors[i].pos) })
+	cs := make([]cursor, 0, len(w.extraCursors)+1)
+	cs = append(cs, w.extraCursors[:i]...)
+	cs = append(cs, main)
+	cs = append(cs, w.extraCursors[i:]...)
+	return cs, i
+}
+
+// addExtraCursor adds c to the window's additional cursors, unless there is already one at the
+// same place.
+func (w *window) addExtraCursor(c cursor) {
+	i := sort.Search(len(w.extraCursors), func(i int) bool { return !w.extraCursors[i].pos.Less(c.pos) })
+	if i < len(w.extraCursors) && w.extraCursors[i].pos == c.pos {
+		return
+	}
+	w.extraCursors = append(w.extraCursors, cursor{})
+	copy(w.extraCursors[i+1:], w.extraCursors[i:])
+	w.extraCursors[i] = c
+	w.needsRedraw = true
+}
+
+// clearExtraCursors removes all cursors but the main one.
+func (w *window) clearExtraCursors() {
+	if len(w.extraCursors) > 0 {
+		w.needsRedraw = true
+	}
+	w.extraCursors = nil
+}
+
+// shiftExtraCursors moves the additional cursors to follow the text they were at when c is applied.
+func (w *window) shiftExtraCursors(c change) {
+	for i := range w.extraCursors {
+		ec := &w.extraCursors[i]
+		ec.pos = shiftPoint(ec.pos, c)
+		if ec.selection.Set {
+			ec.selection.Begin = shiftPoint(ec.selection.Begin, c)
+			ec.selection.End = shiftPoint(ec.selection.End, c)
+		}
+	}
+}
+
+// anySelection reports whether any of the window's cursors has text selected.
+func (w *window) anySelection() bool {
+	if w.selection.Set {
+		return true
+	}
+	for _, c := range w.extraCursors {
+		if c.selection.Set {
+			return true
+		}
+	}
+	return false
+}
+
+// editAtCursors makes an edit at each of the window's cursors, as a single undo step.
+// For each cursor, given its index in order of position, edit returns the change to make there and
+// where the cursor ends up after it, or false to leave that cursor alone. Afterwards, nothing is
+// selected.
+func (w *window) editAtCursors(edit func(int, cursor) (change, point, bool)) {
+	cs, mainIndex := w.allCursors()
+	w.takeSnapshot()
+	// Go backwards, so that each edit doesn't move the cursors yet to be processed.
+	for i := len(cs) - 1; i >= 0; i-- {
+		c, pos, ok := edit(i, cs[i])
+		if !ok {
+			continue
+		}
+		w.edit(c)
+		for j := i + 1; j < len(cs); j++ {
+			cs[j].pos = shiftPoint(cs[j].pos, c)
+		}
+		cs[i].pos = pos
+	}
+	main := cs[mainIndex].pos
+	w.extraCursors = nil
+	for i, c := range cs {
+		if i != mainIndex && c.pos != main {
+			w.addExtraCursor(cursor{pos: c.pos})
+		}
+	}
+	w.resetSelectionState()
+	w.gotoTextPos(main)
+	w.needsRedraw = true
+	w.notifyChange()
+}
+
+// replaceAtCursors replaces the selected text at each cursor, or inserts at it if nothing is
+// selected there, with the text returned by insertion for the cursor's index in order of position
+// and the point where the insertion happens.
+func (w *window) replaceAtCursors(insertion func(i int, at point) string) {
+	w.editAtCursors(func(i int, c cursor) (change, point, bool) {
+		ch := change{At: c.pos}
+		if c.selection.Set {
+			ch = change{At: c.selection.Begin, Removed: string(w.buf.CopyRange(c.selection.textRange))}
+		}
+		ch.Inserted = insertion(i, ch.At)
+		return ch, posAfterInsertion(ch.At, ch.Inserted), true
+	})
+}
+
+// typeTextAtCursors is the multiple-cursor version of typeText.
+func (w *window) typeTextAtCursors(text string) {
+	w.replaceAtCursors(func(_ int, at point) string {
+		switch text[0] {
+		case '\r':
+			return "\n" + leadingIndentation(w.buf.Line(at.Y))
+		case '\t':
+			return w.tabString
+		default:
+			return text
+		}
+	})
+}
+
+// backspaceAtCursors is the multiple-cursor version of backspace. If any cursor has text selected,
+// it only deletes the selected text, leaving cursors without a selection alone.
+func (w *window) backspaceAtCursors() {
+	onlySelections := w.anySelection()
+	w.editAtCursors(func(_ int, c cursor) (change, point, bool) {
+		var r textRange
+		switch {
+		case c.selection.Set:
+			r = c.selection.textRange
+		case onlySelections:
+			return change{}, c.pos, false
+		case c.pos.X > 0:
+			r = textRange{Begin: point{X: c.pos.X - 1, Y: c.pos.Y}, End: c.pos}
+		case c.pos.Y > 0:
+			r = textRange{Begin: point{X: buffer.CharCount(trimLineEnding(w.buf.Line(c.pos.Y - 1))), Y: c.pos.Y - 1}, End: c.pos}
+		default:
+			return change{}, c.pos, false
+		}
+		return change{At: r.Begin, Removed: string(w.buf.CopyRange(r))}, r.Begin, true
+	})
+}
+
+// selectedTextAtCursors returns the text selected at each cursor, in order, joined by newlines.
+// Cursors without a selection contribute empty lines, so that pasting the text back puts each line
+// where it came from.
+func (w *window) selectedTextAtCursors() []byte {
+	cs, _ := w.allCursors()
+	parts := make([]string, len(cs))
+	for i, c := range cs {
+		if c.selection.Set {
+			parts[i] = string(w.buf.CopyRange(c.selection.textRange))
+		}
+	}
+	return []byte(strings.Join(parts, "\n"))
+}
+
+// addCursorAtNextOccurrence selects the word at the cursor, if nothing is selected. Otherwise, it
+// finds the next occurrence of the selected text after the selection, wrapping around the end of the
+// buffer, and adds a cursor there with that occurrence selected, which becomes the main cursor.
+func (w *window) addCursorAtNextOccurrence() {
+	if w.formatPending {
+		return
+	}
+	if !w.selection.Set {
+		if word := w.buf.WordBoundsAt(w.windowCoordsToTextCoords(w.cursorPos)); !word.Empty() {
+			w.selectMatch(word)
+		}
+		return
+	}
+	re := regexp.MustCompile(regexp.QuoteMeta(string(w.buf.CopyRange(w.selection.textRange))))
+	m, ok := w.findMatch(re, w.selection.End)
+	if ok {
+		cs, _ := w.allCursors()
+		for _, c := range cs {
+			if c.pos == m.Begin || (c.selection.Set && c.selection.textRange == m) {
+				ok = false
+				break
+			}
+		}
+	}
+	if !ok {
+		w.app.setNotification("No more occurrences")
+		return
+	}
+	w.addExtraCursor(cursor{pos: w.windowCoordsToTextCoords(w.cursorPos), selection: w.selection})
+	w.selectMatch(m)
+}
+
+// toggleCursorAt removes the additional cursor at tp, if there is one. Otherwise, it adds one there,
+// which becomes the main cursor.
+func (w *window) toggleCursorAt(tp point) {
+	w.needsRedraw = true
+	for i, c := range w.extraCursors {
+		if c.pos == tp {
+			w.extraCursors = append(w.extraCursors[:i], w.extraCursors[i+1:]...)
+			return
+		}
+	}
+	main := w.windowCoordsToTextCoords(w.cursorPos)
+	if main == tp {
+		return
+	}
+	w.addExtraCursor(cursor{pos: main, selection: w.selection})
+	w.resetSelectionState()
+	w.cursorPos = w.textCoordsToWindowCoords(tp)
+}
+
+// addCursorsToSelectedLines replaces the selection with a cursor at the end of the selected part of
+// each line it covers. The last of them becomes the main cursor.
+func (w *window) addCursorsToSelectedLines() {
+	if !w.selection.Set {
+		return
+	}
+	r := w.selection.textRange
+	var ps []point
+	for y := r.Begin.Y; y < r.End.Y; y++ {
+		ps = append(ps, point{X: buffer.CharCount(trimLineEnding(w.buf.Line(y))), Y: y})
+	}
+	// A selection of whole lines ends at the start of the next one, which shouldn't get a cursor.
+	if r.End.X > 0 || len(ps) == 0 {
+		ps = append(ps, r.End)
+	}
+	w.resetSelectionState()
+	for _, p := range ps[:len(ps)-1] {
+		w.addExtraCursor(cursor{pos: p})
+	}
+	w.gotoTextPos(ps[len(ps)-1])
+	w.needsRedraw = true
+}
+
+// inExtraSelection reports whether the character at tp is selected by one of the additional cursors.
+func (tf *textFormatter) inExtraSelection(tp point) bool {
+	for _, c := range tf.extraCursors {
+		if c.selection.Set && !tp.Less(c.selection.Begin) && tp.Less(c.selection.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// extraCursorAt reports whether one of the additional cursors is at tp.
+func (tf *textFormatter) extraCursorAt(tp point) bool {
+	for _, c := range tf.extraCursors {
+		if c.pos == tp {
+			return true
+		}
+	}
+	return false
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/dpinela/mflg/internal/color"
 	"github.com/dpinela/mflg/internal/config"
 	"github.com/dpinela/mflg/internal/highlight"
+	"github.com/dpinela/mflg/internal/lsp"
 	"github.com/dpinela/mflg/internal/termdraw"
 	"github.com/dpinela/mflg/internal/termesc"
 
@@ -25,8 +26,16 @@ func (w *window) redrawAtYOffset(console *termdraw.Screen, yOffset int) {
 		hr = w.highlighter.Regions(lines[0].Start.Y, lines[len(lines)-1].Start.Y+1)
 	}
 
-	tf := textFormatter{src: lines, highlightedRegions: hr,
-		invertedRegion: w.selection, gutterWidth: w.gutterWidth(), gutterText: w.customGutterText, config: w.app.config}
+	var ds, bms []diagnostic
+	var ms []textRange
+	if len(lines) != 0 {
+		ds = w.diagnosticsBetween(lines[0].Start.Y, lines[len(lines)-1].Start.Y+1)
+		bms = w.buildMarksBetween(lines[0].Start.Y, lines[len(lines)-1].Start.Y+1)
+		ms = w.matchesBetween(lines[0].Start.Y, lines[len(lines)-1].Start.Y+1)
+	}
+
+	tf := textFormatter{src: lines, highlightedRegions: hr, diagnostics: ds, buildMarks: bms, matches: ms,
+		invertedRegion: w.selection, extraCursors: w.extraCursors, gutterWidth: w.gutterWidth(), gutterText: w.customGutterText, config: w.app.config}
 	n := min(w.height, len(lines))
 	for j := 0; j < n; j++ {
 		tf.formatLine(console, yOffset, j)
@@ -38,6 +47,10 @@ type textFormatter struct {
 	currentHighlight   *highlight.StyledRegion
 	highlightedRegions []highlight.StyledRegion
 	invertedRegion     optionalTextRange
+	extraCursors       []cursor
+	diagnostics        []diagnostic
+	buildMarks         []diagnostic
+	matches            []textRange
 	gutterText         string
 	gutterWidth        int
 	config             *config.Config
@@ -55,6 +68,14 @@ var (
 
 var numericGutterStyle = termdraw.Style{Foreground: &color.Color{R: 200, G: 200, B: 200}}
 
+// The colors used to mark diagnostics of each severity.
+var diagnosticColors = map[lsp.DiagnosticSeverity]*color.Color{
+	lsp.SeverityError:       {R: 230, G: 0, B: 0},
+	lsp.SeverityWarning:     {R: 230, G: 180, B: 0},
+	lsp.SeverityInformation: {R: 0, G: 120, B: 230},
+	lsp.SeverityHint:        {R: 150, G: 150, B: 150},
+}
+
 func (tf *textFormatter) formatLine(console *termdraw.Screen, yOffset, j int) {
 	line := strings.TrimSuffix(tf.src[j].Text, "\n")
 	tp := tf.src[j].Start
@@ -72,10 +93,20 @@ func (tf *textFormatter) formatLine(console *termdraw.Screen, yOffset, j int) {
 		wp.X += runewidth.StringWidth(c)
 		gutterText = gutterText[len(c):]
 	}
-	for wp.X < tf.gutterWidth {
+	for wp.X < tf.gutterWidth-1 {
 		console.Put(wp, termdraw.Cell{})
 		wp.X++
 	}
+	// Mark lines where diagnostics start, or that the last build reported errors on, in the last
+	// column of the gutter, which is otherwise blank; only on the first row of a wrapped line.
+	if d := diagnosticStartingOn(tf.diagnostics, tp.Y); d != nil && tf.gutterText == "" && tp.X == 0 {
+		console.Put(wp, termdraw.Cell{Content: "!", Style: termdraw.Style{Foreground: diagnosticColors[d.Severity], Bold: true}})
+	} else if d := diagnosticStartingOn(tf.buildMarks, tp.Y); d != nil && tf.gutterText == "" && tp.X == 0 {
+		console.Put(wp, termdraw.Cell{Content: ">", Style: termdraw.Style{Foreground: diagnosticColors[d.Severity], Bold: true}})
+	} else {
+		console.Put(wp, termdraw.Cell{})
+	}
+	wp.X++
 	style := termdraw.Style{}
 	if tf.invertedRegion.Set && !tp.Less(tf.invertedRegion.Begin) && tp.Less(tf.invertedRegion.End) {
 		style.Inverted = true
@@ -112,28 +143,79 @@ func (tf *textFormatter) formatLine(console *termdraw.Screen, yOffset, j int) {
 				}
 			}
 		}
+		cellStyle := style
+		if tf.inMatch(tp) {
+			cellStyle.Foreground = matchStyle.Foreground
+			cellStyle.Background = matchStyle.Background
+		}
+		if d := tf.diagnosticAt(tp); d != nil {
+			cellStyle.CurlyUnderline = true
+			cellStyle.UnderlineColor = diagnosticColors[d.Severity]
+		}
+		// The terminal only shows the main cursor; show the others by inverting the character under them.
+		if tf.inExtraSelection(tp) {
+			cellStyle.Inverted = true
+		}
+		if tf.extraCursorAt(tp) {
+			cellStyle.Inverted = !cellStyle.Inverted
+		}
 		n := buffer.NextCharBoundary(line)
 		switch {
 		case line[:n] == "\t":
 			for i := 0; i < tf.config.TabWidth; i++ {
-				console.Put(wp, termdraw.Cell{Style: style})
+				console.Put(wp, termdraw.Cell{Style: cellStyle})
 				wp.X++
 			}
 		case line[:n] == "\n":
 		case n == 1 && line[0] < ' ':
-			console.Put(wp, termdraw.Cell{Content: string('\u2400' + rune(line[0])), Style: style})
+			console.Put(wp, termdraw.Cell{Content: string('\u2400' + rune(line[0])), Style: cellStyle})
 			wp.X++
 		case line[:n] == "\x7f":
-			console.Put(wp, termdraw.Cell{Content: "\u2421", Style: style})
+			console.Put(wp, termdraw.Cell{Content: "\u2421", Style: cellStyle})
 			wp.X++
 		default:
-			console.Put(wp, termdraw.Cell{Content: line[:n], Style: style})
+			console.Put(wp, termdraw.Cell{Content: line[:n], Style: cellStyle})
 			wp.X += runewidth.StringWidth(line[:n])
 		}
 		bx += n
 		line = line[n:]
 		tp.X++
 	}
+	// A cursor at the end of a line goes after its last character, unless the line continues on the next row.
+	if tf.extraCursorAt(tp) && (j+1 >= len(tf.src) || tf.src[j+1].Start != tp) {
+		console.Put(wp, termdraw.Cell{Style: termdraw.Style{Inverted: true}})
+	}
+}
+
+// diagnosticAt returns the most serious diagnostic covering the character at tp, or nil if there is none.
+func (tf *textFormatter) diagnosticAt(tp point) *diagnostic {
+	var found *diagnostic
+	for i := range tf.diagnostics {
+		d := &tf.diagnostics[i]
+		if tp.Less(d.Range.Begin) {
+			break
+		}
+		if tp.Less(d.Range.End) && (found == nil || d.Severity < found.Severity) {
+			found = d
+		}
+	}
+	return found
+}
+
+// diagnosticStartingOn returns the most serious diagnostic in ds starting on the line ty, or nil if
+// there is none. ds must be sorted by the start of their ranges.
+func diagnosticStartingOn(ds []diagnostic, ty int) *diagnostic {
+	var found *diagnostic
+	for i := range ds {
+		d := &ds[i]
+		if d.Range.Begin.Y > ty {
+			break
+		}
+		if d.Range.Begin.Y == ty && (found == nil || d.Severity < found.Severity) {
+			found = d
+		}
+	}
+	return found
 }
 
 func mergeStyle(ts *termdraw.Style, cs config.Style) {
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpinela/mflg/internal/buffer"
+)
+
+// A replaceSession steps through the matches for a regex in the main window, asking whether to
+// replace each one.
+type replaceSession struct {
+	app      *application
+	w        *window
+	matches  []expandedMatch // The matches left to ask about, in the order in which to ask about them
+	replaced int
+}
+
+// An expandedMatch is a match for a regex in a window's buffer, along with what to replace it with.
+type expandedMatch struct {
+	textRange
+	text        string // The text matched
+	replacement string
+}
+
+// replaceInteractively steps through the matches for re in the main window, starting at the cursor
+// and wrapping around the end of the buffer, and asks the user whether to replace each one with
+// replacement. All replacements made are undone as a single step.
+// The matches are all found when the session starts, as Regexp.ReplaceAllString would find them, so
+// replacing one doesn't make new ones.
+func (app *application) replaceInteractively(re *regexp.Regexp, replacement string) {
+	w := app.mainWindow
+	if w.formatPending {
+		return
+	}
+	tp := w.windowCoordsToTextCoords(w.cursorPos)
+	w.resetSelectionState()
+	ms := w.expandedMatches(re, replacement)
+	i := sort.Search(len(ms), func(i int) bool { return !ms[i].Begin.Less(tp) })
+	// Ask about the matches after the cursor first, then wrap around to the ones before it.
+	s := &replaceSession{app: app, w: w, matches: append(append([]expandedMatch(nil), ms[i:]...), ms[:i]...)}
+	s.next()
+}
+
+// expandedMatches returns the non-empty matches for re in the window's buffer, sorted by position,
+// each with replacement expanded for it as in Regexp.Expand. Unless re is multi-line (see
+// isMultilineRegexp), it is matched against each line separately.
+func (w *window) expandedMatches(re *regexp.Regexp, replacement string) []expandedMatch {
+	var ms []expandedMatch
+	add := func(re *regexp.Regexp, text string, loc []int, m textRange) {
+		if !m.Empty() {
+			ms = append(ms, expandedMatch{textRange: m, text: text[loc[0]:loc[1]], replacement: string(re.ExpandString(nil, replacement, text, loc))})
+		}
+	}
+	if isMultilineRegexp(re) {
+		re = bufferRegexp(re)
+		text := bufferText(w.buf)
+		pos, off := point{}, 0
+		for _, loc := range re.FindAllStringSubmatchIndex(text, -1) {
+			begin := posAfterInsertion(pos, text[off:loc[0]])
+			pos, off = posAfterInsertion(begin, text[loc[0]:loc[1]]), loc[1]
+			add(re, text, loc, textRange{Begin: begin, End: pos})
+		}
+		return ms
+	}
+	for y := 0; y < w.buf.LineCount(); y++ {
+		text := trimLineEnding(w.buf.Line(y))
+		for _, loc := range re.FindAllStringSubmatchIndex(text, -1) {
+			add(re, text, loc, textRange{Begin: point{X: buffer.CharCount(text[:loc[0]]), Y: y}, End: point{X: buffer.CharCount(text[:loc[1]]), Y: y}})
+		}
+	}
+	return ms
+}
+
+// next asks about the next match, or ends the session if there are no more.
+// Matches whose text has changed since the session started are skipped.
+func (s *replaceSession) next() {
+	for len(s.matches) > 0 && !s.stillThere(s.matches[0]) {
+		s.matches = s.matches[1:]
+	}
+	if len(s.matches) == 0 {
+		s.finish()
+		return
+	}
+	s.ask()
+}
+
+// stillThere reports whether m is still in the window's buffer, where it was found.
+func (s *replaceSession) stillThere(m expandedMatch) bool {
+	if m.End.Y >= s.w.buf.LineCount() {
+		return false
+	}
+	return string(s.w.buf.CopyRange(m.textRange)) == m.text
+}
+
+// ask shows the current match as selected, and opens a prompt asking what to do with it, which
+// reacts as soon as the user types an answer.
+func (s *replaceSession) ask() {
+	app, w := s.app, s.w
+	w.selection.Put(s.matches[0].textRange)
+	w.gotoTextPos(s.matches[0].Begin)
+	w.needsRedraw = true
+	// Don't let opening the new prompt end the session.
+	app.promptCancelHandler = nil
+	app.openPrompt("Replace? [y/n/a/q]:", func(string) { s.finish() })
+	app.promptCancelHandler = s.finish
+	pw := app.promptWindow
+	pw.onChange = func() {
+		switch strings.ToLower(pw.buf.Line(0)) {
+		case "y":
+			c := s.replace(s.matches[0])
+			w.notifyChange()
+			// The matches after this one move along with the text around them.
+			s.matches = s.matches[1:]
+			for i := range s.matches {
+				m := &s.matches[i]
+				m.Begin, m.End = shiftPoint(m.Begin, c), shiftPoint(m.End, c)
+			}
+			s.next()
+		case "n":
+			s.matches = s.matches[1:]
+			s.next()
+		case "a":
+			s.replaceAll()
+			s.finish()
+		case "q":
+			s.finish()
+		default:
+			// Ignore anything else.
+			app.promptCancelHandler = nil
+			s.ask()
+		}
+	}
+}
+
+// replaceAll replaces all the matches left in a single pass, starting from the last one in the buffer
+// so that the positions of the others stay valid.
+func (s *replaceSession) replaceAll() {
+	ms := s.matches
+	sort.Slice(ms, func(i, j int) bool { return ms[j].Begin.Less(ms[i].Begin) })
+	for _, m := range ms {
+		if s.stillThere(m) {
+			s.replace(m)
+		}
+	}
+	s.matches = nil
+	s.w.notifyChange()
+}
+
+// replace replaces m, adding the change to the session's undo step, and returns the change made.
+func (s *replaceSession) replace(m expandedMatch) change {
+	w := s.w
+	if s.replaced == 0 {
+		w.modificationTime = time.Time{}
+		w.takeSnapshot()
+	}
+	c := change{At: m.Begin, Removed: m.text, Inserted: m.replacement}
+	w.edit(c)
+	s.replaced++
+	return c
+}
+
+// finish ends the session, closing the prompt if it is open.
+func (s *replaceSession) finish() {
+	app, w := s.app, s.w
+	if app.promptWindow != nil {
+		app.promptCancelHandler = nil
+		app.closePrompt()
+	}
+	w.clearSelection()
+	if s.replaced > 0 {
+		// Make sure that later edits don't get merged into the session's undo step.
+		w.modificationTime = time.Time{}
+		w.roundCursorPos()
+	}
+	app.setNotification(fmt.Sprintf("Replaced %d matches", s.replaced))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpinela/mflg/internal/atomicwrite"
+	"github.com/dpinela/mflg/internal/buffer"
+)
+
+// How many lines to show before and after a match when previewing a replacement.
+const replacementContextLines = 2
+
+// replaceInFiles searches the files in the open file's project for re, listing the matches along with
+// a preview of what replacing them would do. The user can then choose which ones to replace;
+// picking any entry replaces all chosen matches with replacement.
+func (app *application) replaceInFiles(re *regexp.Regexp, replacement string) {
+	var fs *fileSearch
+	title := fmt.Sprintf("Replace in Files: %s with %s (Space: include/exclude, Enter: replace)", re, replacement)
+	fs = app.listFileMatches(title, re, func(int) {
+		app.applyReplacements(re, replacement, fs.matches, fs.list.checked)
+	})
+	fs.list.checked = []bool{}
+	bufs := map[string]*buffer.Buffer{}
+	fs.list.preview = func(i int) []string {
+		return app.replacementPreview(re, replacement, fs.matches[i], bufs)
+	}
+}
+
+// replacementPreview returns the lines to show to preview the replacement of m: the line containing it,
+// before and after, along with a few lines around it. The content of files is cached in bufs.
+func (app *application) replacementPreview(re *regexp.Regexp, replacement string, m fileMatch, bufs map[string]*buffer.Buffer) []string {
+	newText, _ := replaceMatches(re, replacement, m.text, []fileMatch{m})
+	lines := []string{fmt.Sprintf("- %4d  %s", m.line, m.text), fmt.Sprintf("+ %4d  %s", m.line, newText)}
+	buf, err := app.fileBuffer(m.filename, bufs)
+	if err != nil {
+		return lines
+	}
+	var before, after []string
+	for y := max(m.line-1-replacementContextLines, 0); y < m.line-1 && y < buf.LineCount(); y++ {
+		before = append(before, fmt.Sprintf("  %4d  %s", y+1, strings.TrimSuffix(buf.Line(y), "\n")))
+	}
+	// The empty line after the file's final newline doesn't count.
+	n := buf.LineCount()
+	if n > 0 && buf.Line(n-1) == "" {
+		n--
+	}
+	for y := m.line; y < m.line+replacementContextLines && y < n; y++ {
+		after = append(after, fmt.Sprintf("  %4d  %s", y+1, strings.TrimSuffix(buf.Line(y), "\n")))
+	}
+	return append(append(before, lines...), after...)
+}
+
+// applyReplacements replaces the matches for re in ms for which include is true with replacement.
+// Matches in the open file are replaced in the main window, as a single undo step; other files are
+// rewritten directly. Matches whose text changed since they were found are left alone.
+func (app *application) applyReplacements(re *regexp.Regexp, replacement string, ms []fileMatch, include []bool) {
+	// Group the matches by file, and then by line.
+	var files []string
+	byFile := map[string]map[int][]fileMatch{}
+	for i, m := range ms {
+		if !include[i] {
+			continue
+		}
+		if byFile[m.filename] == nil {
+			byFile[m.filename] = map[int][]fileMatch{}
+			files = append(files, m.filename)
+		}
+		byFile[m.filename][m.line-1] = append(byFile[m.filename][m.line-1], m)
+	}
+	total, replaced, changedFiles := 0, 0, 0
+	var firstErr error
+	for _, filename := range files {
+		lines := byFile[filename]
+		for _, hits := range lines {
+			total += len(hits)
+		}
+		var n int
+		var err error
+		if filename == app.filename {
+			n = app.mainWindow.replaceLineMatches(re, replacement, lines)
+			app.saveNow()
+		} else {
+			n, err = replaceFileMatches(filename, re, replacement, lines)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		replaced += n
+		if n > 0 {
+			changedFiles++
+		}
+	}
+	switch {
+	case firstErr != nil:
+		app.setNotification(firstErr.Error())
+	case replaced < total:
+		app.setNotification(fmt.Sprintf("Replaced %d matches in %d files; %d had changed and were skipped", replaced, changedFiles, total-replaced))
+	default:
+		app.setNotification(fmt.Sprintf("Replaced %d matches in %d files", replaced, changedFiles))
+	}
+}
+
+// replaceLineMatches replaces the given matches for re in the window's buffer, grouped by the index
+// of the line they are in, with replacement, as a single undo step. It returns how many were replaced.
+func (w *window) replaceLineMatches(re *regexp.Regexp, replacement string, lines map[int][]fileMatch) int {
+	w.app.finishFormatNow()
+	n := 0
+	for _, y := range sortedKeys(lines) {
+		if y >= w.buf.LineCount() {
+			continue
+		}
+		text := trimLineEnding(w.buf.Line(y))
+		newText, k := replaceMatches(re, replacement, text, lines[y])
+		if k == 0 {
+			continue
+		}
+		if n == 0 {
+			w.modificationTime = time.Time{}
+			w.takeSnapshot()
+		}
+		n += k
+		w.edit(change{At: point{Y: y}, Removed: text, Inserted: newText})
+	}
+	if n > 0 {
+		w.modificationTime = time.Time{}
+		w.roundCursorPos()
+		w.needsRedraw = true
+		w.notifyChange()
+	}
+	return n
+}
+
+// replaceFileMatches replaces the given matches for re in the file at filename, grouped by the index
+// of the line they are in, with replacement. It returns how many were replaced.
+func replaceFileMatches(filename string, re *regexp.Regexp, replacement string, lines map[int][]fileMatch) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	fileLines := strings.SplitAfter(string(data), "\n")
+	n := 0
+	for y, hits := range lines {
+		if y >= len(fileLines) {
+			continue
+		}
+		text := trimLineEnding(fileLines[y])
+		newText, k := replaceMatches(re, replacement, text, hits)
+		fileLines[y] = newText + fileLines[y][len(text):]
+		n += k
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, atomicwrite.Write(filename, func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(fileLines, ""))
+		return err
+	})
+}
+
+// replaceMatches replaces the matches for re in text that are among hits, with the same position and
+// text, with replacement, expanding references to groups as Regexp.Expand does. It returns the
+// resulting text and how many matches were replaced.
+func replaceMatches(re *regexp.Regexp, replacement string, text string, hits []fileMatch) (string, int) {
+	var b strings.Builder
+	last, n := 0, 0
+	for _, loc := range re.FindAllStringSubmatchIndex(text, -1) {
+		found := false
+		for _, h := range hits {
+			if h.start == loc[0] && h.end == loc[1] && h.text[h.start:h.end] == text[loc[0]:loc[1]] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		b.WriteString(text[last:loc[0]])
+		b.Write(re.ExpandString(nil, replacement, text, loc))
+		last = loc[1]
+		n++
+	}
+	b.WriteString(text[last:])
+	return b.String(), n
+}
+
+func sortedKeys(m map[int][]fileMatch) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
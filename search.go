@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/color"
+	"github.com/dpinela/mflg/internal/termdraw"
+)
+
+// The colors used to highlight matches for the regex being searched for.
+var matchStyle = termdraw.Style{Background: &color.Color{R: 230, G: 200, B: 60}, Foreground: &color.Color{R: 0, G: 0, B: 0}}
+
+// startSearch opens a prompt for a regex to search for in the main window. As the user types, the
+// cursor jumps to the first match at or after its original position, and all matches are highlighted.
+// Enter selects the match, saves the original position in the navigation stack, and makes the regex
+// the one that Find Next looks for; Esc returns the cursor to its original position.
+func (app *application) startSearch() {
+	w := app.mainWindow
+	origin := w.windowCoordsToTextCoords(w.cursorPos)
+	originTop := w.topLine
+	var re *regexp.Regexp
+	var match textRange
+	found := false
+	app.openPrompt("Search:", func(string) {
+		w.setMatchHighlight(nil)
+		if re == nil {
+			return
+		}
+		app.navStack = append(app.navStack, location{filename: app.filename, pos: origin})
+		app.searchRE = re
+		if found {
+			w.selectMatch(match)
+		}
+	})
+	app.promptCancelHandler = func() {
+		w.setMatchHighlight(nil)
+		w.topLine = originTop
+		w.cursorPos = w.textCoordsToWindowCoords(origin)
+	}
+	pw := app.promptWindow
+	pw.onChange = func() {
+		expr := pw.buf.Line(0)
+		if expr == "" {
+			re = nil
+		} else if r, err := regexp.Compile(expr); err == nil {
+			re = r
+		} else {
+			// Probably not typed in full yet; keep showing the last valid regex's matches.
+			return
+		}
+		w.setMatchHighlight(re)
+		match, found = w.findMatch(re, origin)
+		if !found {
+			w.topLine = originTop
+			w.cursorPos = w.textCoordsToWindowCoords(origin)
+			return
+		}
+		w.gotoTextPos(match.Begin)
+	}
+}
+
+// findMatch returns the range of the first match for re in the window's buffer that starts at or
+// after from, wrapping around the end of the buffer if there are none after it. It reports whether
+// there is any match at all.
+func (w *window) findMatch(re *regexp.Regexp, from point) (textRange, bool) {
+	if re == nil {
+		return textRange{}, false
+	}
+	if isMultilineRegexp(re) {
+		ms := bufferMatches(re, bufferText(w.buf))
+		if len(ms) == 0 {
+			return textRange{}, false
+		}
+		for _, m := range ms {
+			if !m.Begin.Less(from) {
+				return m, true
+			}
+		}
+		return ms[0], true
+	}
+	n := w.buf.LineCount()
+	for i := 0; i <= n; i++ {
+		y := (from.Y + i) % n
+		ms := lineMatches(re, w.buf.Line(y), y)
+		for _, m := range ms {
+			switch {
+			case i == 0 && m.Begin.X < from.X:
+				// Before the starting point; only counts when wrapping around back to this line.
+			case i == n && m.Begin.X >= from.X:
+				return textRange{}, false
+			default:
+				return m, true
+			}
+		}
+	}
+	return textRange{}, false
+}
+
+// gotoMatch selects the next match for the regex last searched for after the cursor if delta is 1,
+// or the previous one before it if delta is -1, wrapping around the ends of the buffer, and shows
+// which match it is.
+func (app *application) gotoMatch(delta int) {
+	re := app.searchRE
+	if re == nil {
+		return
+	}
+	w := app.mainWindow
+	if w.searchMatches == nil || w.searchMatches.re != re {
+		w.searchMatches = &matchCache{re: re}
+	}
+	ms := w.searchMatches.allMatches(w)
+	if len(ms) == 0 {
+		app.setNotification("No matches")
+		return
+	}
+	tp := w.windowCoordsToTextCoords(w.cursorPos)
+	var i int
+	if delta > 0 {
+		i = sort.Search(len(ms), func(i int) bool { return tp.Less(ms[i].Begin) })
+	} else {
+		i = sort.Search(len(ms), func(i int) bool { return !ms[i].Begin.Less(tp) }) - 1
+	}
+	i = (i + len(ms)) % len(ms)
+	app.navStack = append(app.navStack, location{filename: app.filename, pos: tp})
+	w.selectMatch(ms[i])
+	app.setNotification(fmt.Sprintf("Match %d of %d", i+1, len(ms)))
+}
+
+// selectMatch moves the cursor to the start of m and selects it, so that it can be cut, copied or
+// typed over straight away. Empty matches leave nothing selected.
+func (w *window) selectMatch(m textRange) {
+	w.resetSelectionState()
+	w.gotoTextPos(m.Begin)
+	if !m.Empty() {
+		w.selection.Put(m)
+	}
+	w.needsRedraw = true
+}
+
+// allMatches returns the ranges of all matches for re in the window's buffer, sorted by position.
+func (w *window) allMatches(re *regexp.Regexp) []textRange {
+	if isMultilineRegexp(re) {
+		return bufferMatches(re, bufferText(w.buf))
+	}
+	var ms []textRange
+	for y := 0; y < w.buf.LineCount(); y++ {
+		ms = append(ms, lineMatches(re, w.buf.Line(y), y)...)
+	}
+	return ms
+}
+
+// bufferMatches returns the ranges of the matches for the multi-line regexp re in text, the content of
+// a buffer. Each one's position is worked out from where the previous one ends.
+func bufferMatches(re *regexp.Regexp, text string) []textRange {
+	locs := bufferRegexp(re).FindAllStringIndex(text, -1)
+	ms := make([]textRange, len(locs))
+	pos, off := point{}, 0
+	for i, loc := range locs {
+		begin := posAfterInsertion(pos, text[off:loc[0]])
+		pos, off = posAfterInsertion(begin, text[loc[0]:loc[1]]), loc[1]
+		ms[i] = textRange{Begin: begin, End: pos}
+	}
+	return ms
+}
+
+// lineMatches returns the ranges of the matches for re in line, which is the line at index y.
+func lineMatches(re *regexp.Regexp, line string, y int) []textRange {
+	text := trimLineEnding(line)
+	var ms []textRange
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		ms = append(ms, textRange{Begin: point{X: buffer.CharCount(text[:loc[0]]), Y: y}, End: point{X: buffer.CharCount(text[:loc[1]]), Y: y}})
+	}
+	return ms
+}
+
+// A matchCache finds the matches for a regex in a window's buffer, to be highlighted or stepped
+// through. It remembers them until the buffer changes, so that they needn't be found again on every
+// redraw or use of Find Next.
+type matchCache struct {
+	re    *regexp.Regexp
+	lines map[int][]textRange // The matches in each line looked at so far, if re isn't multi-line
+	all   []textRange         // All matches, if they have been found
+}
+
+// allMatches returns all matches for c's regex in w's buffer, sorted by position.
+func (c *matchCache) allMatches(w *window) []textRange {
+	if c.all == nil {
+		c.all = append([]textRange{}, w.allMatches(c.re)...)
+	}
+	return c.all
+}
+
+// setMatchHighlight highlights the matches for re in the window; if re is nil, it removes the highlight.
+func (w *window) setMatchHighlight(re *regexp.Regexp) {
+	w.matchHighlight = nil
+	if re != nil {
+		w.matchHighlight = &matchCache{re: re}
+	}
+	w.needsRedraw = true
+}
+
+// matchesBetween returns the non-empty matches to be highlighted that cover any part of lines i
+// through j-1, sorted by position.
+func (w *window) matchesBetween(i, j int) []textRange {
+	h := w.matchHighlight
+	if h == nil {
+		return nil
+	}
+	var ms []textRange
+	if isMultilineRegexp(h.re) {
+		for _, m := range h.allMatches(w) {
+			if m.End.Y >= i && m.Begin.Y < j && !m.Empty() {
+				ms = append(ms, m)
+			}
+		}
+		return ms
+	}
+	if h.lines == nil {
+		h.lines = map[int][]textRange{}
+	}
+	for y := i; y < j && y < w.buf.LineCount(); y++ {
+		lm, ok := h.lines[y]
+		if !ok {
+			lm = lineMatches(h.re, w.buf.Line(y), y)
+			h.lines[y] = lm
+		}
+		for _, m := range lm {
+			if !m.Empty() {
+				ms = append(ms, m)
+			}
+		}
+	}
+	return ms
+}
+
+// forget discards the matches found so far; it must be called whenever the buffer changes.
+func (c *matchCache) forget() {
+	c.lines = nil
+	c.all = nil
+}
+
+// inMatch reports whether the character at tp is inside one of the matches to be highlighted.
+func (tf *textFormatter) inMatch(tp point) bool {
+	for _, m := range tf.matches {
+		if tp.Less(m.Begin) {
+			return false
+		}
+		if tp.Less(m.End) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dpinela/mflg/internal/buffer"
+	"github.com/dpinela/mflg/internal/lsp"
+)
+
+// A symbol is a named definition in a file.
+type symbol struct {
+	name string // Qualified with the names of the symbols containing it, separated by dots
+	pos  point  // Where its name is
+}
+
+// symbolPatterns match the lines that define symbols in each language, keyed by language ID
+// (see languageID). The first group of each pattern is the symbol's name.
+// They are used to find symbols when there is no language server to ask.
+var symbolPatterns = map[string][]*regexp.Regexp{
+	"go": {
+		regexp.MustCompile(`^func\s+(?:\([^)]*\)\s*)?(\w+)`),
+		regexp.MustCompile(`^(?:type|var|const)\s+(\w+)`),
+	},
+	"c":   cSymbolPatterns,
+	"cpp": cSymbolPatterns,
+	"python": {
+		regexp.MustCompile(`^\s*(?:async\s+)?(?:def|class)\s+(\w+)`),
+	},
+	"rust": {
+		regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:(?:async|const|unsafe|extern\s+"[^"]*")\s+)*(?:fn|struct|enum|union|trait|type|mod|const|static)\s+(\w+)`),
+		regexp.MustCompile(`^\s*macro_rules!\s*(\w+)`),
+	},
+	"javascript": jsSymbolPatterns,
+	"typescript": jsSymbolPatterns,
+	"markdown": {
+		regexp.MustCompile(`^#+\s+(.*?)\s*#*$`),
+	},
+}
+
+var cSymbolPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^#\s*define\s+(\w+)`),
+	regexp.MustCompile(`^(?:typedef\s+)?(?:struct|union|enum|class)\s+(\w+)`),
+	// Function definitions, which start at the beginning of a line, unlike calls.
+	regexp.MustCompile(`^(?:[A-Za-z_][\w\s*&:<>,]*?[\s*&])?(\w+)\s*\([^;]*$`),
+}
+
+var jsSymbolPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?(?:function\*?|class|interface|type|enum|const|let|var)\s+(\w+)`),
+}
+
+// scanSymbols finds the symbols defined in buf, which holds code in the language with the given ID,
+// using symbolPatterns.
+func scanSymbols(buf *buffer.Buffer, lang string) []symbol {
+	patterns := symbolPatterns[lang]
+	if len(patterns) == 0 {
+		return nil
+	}
+	var syms []symbol
+	for y, line := range buf.SliceLines(0, buf.LineCount()) {
+		line = strings.TrimSuffix(line, "\n")
+		for _, re := range patterns {
+			if m := re.FindStringSubmatchIndex(line); m != nil && m[2] != -1 {
+				syms = append(syms, symbol{name: line[m[2]:m[3]], pos: point{X: buffer.CharCount(line[:m[2]]), Y: y}})
+				break
+			}
+		}
+	}
+	return syms
+}
+
+// lspSymbols converts the symbol tree sent by a language server for buf into a flat list, with
+// qualified names.
+func lspSymbols(buf *buffer.Buffer, syms []lsp.DocumentSymbol) []symbol {
+	var flat []symbol
+	var walk func(prefix string, syms []lsp.DocumentSymbol)
+	walk = func(prefix string, syms []lsp.DocumentSymbol) {
+		for _, s := range syms {
+			name := prefix + s.Name
+			flat = append(flat, symbol{name: name, pos: bufferPoint(buf, s.SelectionRange.Start)})
+			walk(name+".", s.Children)
+		}
+	}
+	walk("", syms)
+	return flat
+}
+
+// findSymbol returns the first symbol in syms called name, either exactly or as the last part of
+// its qualified name.
+func findSymbol(syms []symbol, name string) (symbol, bool) {
+	for _, s := range syms {
+		if s.name == name {
+			return s, true
+		}
+	}
+	for _, s := range syms {
+		if strings.HasSuffix(s.name, "."+name) {
+			return s, true
+		}
+	}
+	return symbol{}, false
+}
+
+// gotoSymbol moves the cursor in w to the definition of the symbol called name, as given by the
+// language server if it is running, or otherwise by symbolPatterns.
+func (app *application) gotoSymbol(w *window, name string) {
+	lang := languageID(filepath.Ext(app.filename))
+	jump := func(syms []symbol) {
+		if s, ok := findSymbol(syms, name); ok {
+			w.gotoTextPos(s.pos)
+		} else {
+			app.setNotification("No symbol named " + name + " found")
+		}
+	}
+	if w.doc == nil {
+		jump(scanSymbols(w.buf, lang))
+		return
+	}
+	client, uri := w.doc.client, w.doc.uri
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		syms, err := client.DocumentSymbols(ctx, uri)
+		app.do(func() {
+			if app.mainWindow != w {
+				return
+			}
+			if err != nil {
+				// Not all servers support this; fall back to the patterns.
+				jump(scanSymbols(w.buf, lang))
+				return
+			}
+			jump(lspSymbols(w.buf, syms))
+		})
+	}()
+}
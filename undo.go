@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dpinela/mflg/internal/buffer"
+)
+
+// A change is a single edit to a buffer: at the point At, the text Removed was replaced with the
+// text Inserted. Either of them may be empty.
+//
+// The fields of this and the other history types are exported so that they can be saved to disk;
+// see history.go.
+type change struct {
+	At       point
+	Removed  string `json:",omitempty"`
+	Inserted string `json:",omitempty"`
+}
+
+// inverse returns the change that reverts c.
+func (c change) inverse() change { return change{At: c.At, Removed: c.Inserted, Inserted: c.Removed} }
+
+// A snapshot is one step in a window's undo history. It holds the changes made during that step,
+// in the order they were made, and the cursor state from before and after them.
+type snapshot struct {
+	Changes       []change
+	Before, After cursorState
+	Time          time.Time // When the first change was made
+}
+
+// cursorState holds positions in text coordinates, so that they remain valid when the window
+// is resized or the history is restored in a window of a different width.
+type cursorState struct {
+	CursorPos point
+	Selection optionalTextRange
+}
+
+func (w *window) cursorState() cursorState {
+	return cursorState{CursorPos: w.windowCoordsToTextCoords(w.cursorPos), Selection: w.selection}
+}
+
+func (w *window) restoreCursorState(cs cursorState) {
+	w.selection = cs.Selection
+	tp := cs.CursorPos
+	if n := w.buf.LineCount(); tp.Y >= n {
+		tp = point{Y: n - 1}
+	}
+	if tp.Y < 0 {
+		tp = point{}
+	}
+	w.cursorPos = w.textCoordsToWindowCoords(tp)
+	w.followCursor()
+}
+
+// takeSnapshot puts a new snapshot on the undo stack if the last change occurred long enough ago.
+// It should be called by each edit operation, before the edit actually takes place.
+// Since it starts a new line of history, anything that was undone before can no longer be redone,
+// but it is kept on the undo stack (see keepUndoneSteps).
+func (w *window) takeSnapshot() {
+	now := time.Now()
+	if len(w.redoStack) > 0 {
+		w.keepUndoneSteps()
+	}
+	if now.Sub(w.modificationTime) > changeCoalescingInterval || len(w.undoStack) == 0 {
+		w.undoStack = append(w.undoStack, snapshot{Before: w.cursorState(), Time: now})
+	}
+	w.modificationTime = now
+}
+
+// keepUndoneSteps empties the redo stack, putting the undone steps back on the undo stack, followed
+// by one that reverts them all, so that they are kept along with the rest of the history.
+func (w *window) keepUndoneSteps() {
+	n := len(w.redoStack)
+	if n == 0 {
+		return
+	}
+	// It starts from the state after the last of those steps, which was the first to be undone.
+	back := snapshot{Before: w.redoStack[0].After, After: w.cursorState(), Time: time.Now()}
+	for j := n - 1; j >= 0; j-- {
+		w.undoStack = append(w.undoStack, w.redoStack[j])
+	}
+	back.Changes = revertSteps(w.undoStack[len(w.undoStack)-n:])
+	w.undoStack = append(w.undoStack, back)
+	w.redoStack = nil
+	// The next edit mustn't be coalesced into the reverting step.
+	w.modificationTime = time.Time{}
+}
+
+// edit applies c to the window's buffer and records it in the current snapshot.
+// takeSnapshot must have been called before the first edit of each operation.
+func (w *window) edit(c change) {
+	s := &w.undoStack[len(w.undoStack)-1]
+	s.Changes = append(s.Changes, c)
+	w.applyChange(c)
+}
+
+func (w *window) insert(text string, tp point) { w.edit(change{At: tp, Inserted: text}) }
+
+func (w *window) deleteRange(r textRange) {
+	r = r.Normalize()
+	w.edit(change{At: r.Begin, Removed: string(w.buf.CopyRange(r))})
+}
+
+// applyChange applies c to the window's buffer, without recording it anywhere.
+func (w *window) applyChange(c change) {
+	for _, c := range []*matchCache{w.matchHighlight, w.searchMatches} {
+		if c != nil {
+			c.forget()
+		}
+	}
+	if w.doc != nil {
+		w.doc.recordChange(w.buf, c)
+	}
+	if c.Removed != "" {
+		w.wrappedBuf.DeleteRange(textRange{Begin: c.At, End: posAfterInsertion(c.At, c.Removed)})
+	}
+	if c.Inserted != "" {
+		w.wrappedBuf.Insert(c.Inserted, c.At)
+	}
+	w.shiftDiagnostics(c)
+	w.shiftExtraCursors(c)
+	w.highlighter.Invalidate(c.At.Y)
+	if w.journal != nil {
+		if err := w.journal.record(c); err != nil {
+			w.journalFailed(err)
+		}
+	}
+	w.updateWrapWidth()
+}
+
+// replaceContent replaces the content of the window's buffer with that of buf, as a single
+// undo step of its own.
+// It reports whether the content actually changed.
+func (w *window) replaceContent(buf *buffer.Buffer) bool {
+	c := contentChange(w.buf, buf)
+	if c.Removed == c.Inserted {
+		return false
+	}
+	w.modificationTime = time.Time{}
+	w.takeSnapshot()
+	w.edit(c)
+	w.modificationTime = time.Time{}
+	w.notifyChange()
+	w.needsRedraw = true
+	return true
+}
+
+// contentChange returns a change that turns the content of old into that of updated.
+// Lines that are the same at the start and end of both are left out of it.
+func contentChange(old, updated *buffer.Buffer) change {
+	n, m := old.LineCount(), updated.LineCount()
+	p := 0
+	for p < n && p < m && old.Line(p) == updated.Line(p) {
+		p++
+	}
+	s := 0
+	for s < n-p && s < m-p && old.Line(n-1-s) == updated.Line(m-1-s) {
+		s++
+	}
+	return change{
+		At:       point{X: 0, Y: p},
+		Removed:  strings.Join(old.SliceLines(p, n-s), ""),
+		Inserted: strings.Join(updated.SliceLines(p, m-s), ""),
+	}
+}
+
+// undo reverts the last step in the undo history, making it available for redo.
+func (w *window) undo() {
+	if w.formatPending || len(w.undoStack) == 0 {
+		return
+	}
+	s := w.undoStack[len(w.undoStack)-1]
+	w.undoStack = w.undoStack[:len(w.undoStack)-1]
+	s.After = w.cursorState()
+	for i := len(s.Changes) - 1; i >= 0; i-- {
+		w.applyChange(s.Changes[i].inverse())
+	}
+	w.restoreCursorState(s.Before)
+	w.redoStack = append(w.redoStack, s)
+	w.finishHistoryMove()
+}
+
+// redo reapplies the last step reverted by undo.
+func (w *window) redo() {
+	if w.formatPending || len(w.redoStack) == 0 {
+		return
+	}
+	s := w.redoStack[len(w.redoStack)-1]
+	w.redoStack = w.redoStack[:len(w.redoStack)-1]
+	for _, c := range s.Changes {
+		w.applyChange(c)
+	}
+	w.restoreCursorState(s.After)
+	w.undoStack = append(w.undoStack, s)
+	w.finishHistoryMove()
+}
+
+// undoAll reverts all changes in the undo history. They can all be redone afterwards.
+func (w *window) undoAll() {
+	if w.formatPending {
+		return
+	}
+	for len(w.undoStack) > 0 {
+		w.undo()
+	}
+}
+
+func (w *window) finishHistoryMove() {
+	// The next edit should never be coalesced into a snapshot that is now in the middle of the history.
+	w.modificationTime = time.Time{}
+	w.notifyChange()
+	w.needsRedraw = true
+}
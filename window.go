@@ -28,8 +28,11 @@ type window struct {
 
 	selectionAnchor      optionalPoint // The last point marked as an initial selection bound by keyboard
 	mouseSelectionAnchor optionalPoint // Same, but using the mouse
+	blockAnchor          optionalPoint // The corner marked by keyboard to start a block selection at
+	mouseBlockAnchor     optionalPoint // Same, but using the mouse
 	wordSelectionAnchor  optionalTextRange
 	selection            optionalTextRange
+	extraCursors         []cursor // Cursors besides the main one, sorted by position; see multicursor.go
 
 	// If not empty, this text is displayed in each gutter line instead of the line number.
 	// This shouldn't be set directly, as it affects the gutter width and therefore the wrapping in the main text area:
@@ -44,15 +47,23 @@ type window struct {
 	formatPending    bool
 	modificationTime time.Time // The time when the last edit occurred
 	undoStack        []snapshot
+	redoStack        []snapshot // Snapshots reverted by undo, most recently undone last
+	journal          *journal   // If not nil, where the window's changes are recorded; see journal.go
 
 	needsRedraw bool // Indicates whether the visible part of the window has changed since it was last drawn
 	drawBuffer  []byte
 
-	buf         *buffer.Buffer        // The buffer being edited in the window
-	wrappedBuf  *buffer.WrappedBuffer // Wrapped version of buf, for display purposes
-	tabString   string                // The string that should be inserted when typing a tab
-	langConfig  config.LangConfig
-	highlighter highlight.Highlighter
+	buf            *buffer.Buffer        // The buffer being edited in the window
+	wrappedBuf     *buffer.WrappedBuffer // Wrapped version of buf, for display purposes
+	tabString      string                // The string that should be inserted when typing a tab
+	langConfig     config.LangConfig
+	highlighter    highlight.Highlighter
+	doc            *document    // If not nil, the language server's copy of the buffer
+	diagnostics    []diagnostic // Sorted by the start of their ranges
+	buildMarks     []diagnostic // The errors reported on this window's file by the last build, sorted by line
+	buildMarkErrs  []int        // The index in the error list of each build mark
+	matchHighlight *matchCache  // If not nil, highlights the matches for a regex being searched for
+	searchMatches  *matchCache  // The matches for the regex last gone to with Find Next or Find Previous
 
 	app *application // The application that owns this window
 }
@@ -61,12 +72,6 @@ type window struct {
 // It is a variable so that it can be changed for testing.
 var changeCoalescingInterval = time.Second
 
-type snapshot struct {
-	content   *buffer.Buffer
-	selection optionalTextRange
-	cursorPos point
-}
-
 type timedMouseEvent struct {
 	termesc.MouseEvent
 	when   time.Time
@@ -173,13 +178,11 @@ func (w *window) formatBuffer() {
 				w.app.setNotification(err.Error())
 				return
 			}
-			w.takeSnapshot()
-			w.buf.ReadFrom(bytes.NewReader(formattedText))
-			w.wrappedBuf.Reset(w.buf)
-			w.highlighter.Invalidate(0)
-			w.notifyChange()
-			w.roundCursorPos()
-			w.needsRedraw = true
+			formatted := buffer.New()
+			formatted.ReadFrom(bytes.NewReader(formattedText))
+			if w.replaceContent(formatted) {
+				w.roundCursorPos()
+			}
 		})
 	}()
 }
@@ -321,6 +324,17 @@ func (w *window) gotoLine(ty int) {
 	}
 }
 
+// gotoLineAndColumn moves the cursor to the character at byte offset bx in the line at index ty, or
+// to the end of the line if it is shorter than that.
+func (w *window) gotoLineAndColumn(ty, bx int) {
+	if ty >= w.buf.LineCount() {
+		return
+	}
+	w.gotoLine(ty)
+	line := strings.TrimSuffix(w.buf.Line(ty), "\n")
+	w.gotoTextPos(point{X: buffer.CharCount(line[:min(bx, len(line))]), Y: ty})
+}
+
 func (w *window) roundCursorPos() {
 	w.cursorPos = w.textCoordsToWindowCoords(w.windowCoordsToTextCoords(w.cursorPos))
 }
@@ -377,45 +391,92 @@ func (w *window) followCursor() {
 	}
 }
 
+// searchRegexp moves the cursor to the start of the first match for re at or after the line at
+// index startY, wrapping around the end of the buffer, and selects it. If re is multi-line (see
+// isMultilineRegexp), the match may span several lines.
 func (w *window) searchRegexp(re *regexp.Regexp, startY int) {
-	for i, line := range w.buf.SliceLines(startY, w.buf.LineCount()) {
-		if re.MatchString(strings.TrimSuffix(line, "\n")) {
-			w.gotoLine(startY + i)
-			return
-		}
+	if m, ok := w.findMatch(re, point{Y: min(startY, w.buf.LineCount()-1)}); ok {
+		w.selectMatch(m)
 	}
-	for i, line := range w.buf.SliceLines(0, startY) {
-		if re.MatchString(strings.TrimSuffix(line, "\n")) {
-			w.gotoLine(i)
-			return
-		}
-	}
-}
-
-// takeSnapshot puts a new snapshot on the undo stack if the last change occurred long enough ago.
-// It should be called by each edit operation, before the edit actually takes place.
-func (w *window) takeSnapshot() {
-	now := time.Now()
-	if now.Sub(w.modificationTime) > changeCoalescingInterval {
-		w.undoStack = append(w.undoStack, snapshot{
-			content:   w.buf.Copy(),
-			selection: w.selection,
-			cursorPos: w.cursorPos,
-		})
-	}
-	w.modificationTime = now
 }
 
 func (w *window) notifyChange() {
+	if w.doc != nil {
+		w.doc.sync(w.buf)
+	}
 	if w.onChange != nil {
 		w.onChange()
 	}
 }
 
+// isMultilineRegexp reports whether re may match across lines: that is, whether it mentions a
+// newline explicitly, other than in a negated character class such as [^\n], or sets the s flag,
+// which lets . match newlines.
+// Other regexps are matched one line at a time, which keeps things like \s or [^x] from
+// unexpectedly matching line breaks.
+func isMultilineRegexp(re *regexp.Regexp) bool {
+	expr := re.String()
+	if sFlagRE.MatchString(expr) {
+		return true
+	}
+	inClass, negated := false, false
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '\n':
+			if !negated {
+				return true
+			}
+		case '\\':
+			if i+1 < len(expr) && expr[i+1] == 'n' && !negated {
+				return true
+			}
+			i++
+		case '[':
+			switch {
+			case inClass:
+				// Skip named classes such as [:alpha:], whose closing bracket doesn't end this one.
+				if j := strings.Index(expr[i:], ":]"); strings.HasPrefix(expr[i:], "[:") && j != -1 {
+					i += j + 1
+				}
+			default:
+				inClass = true
+				if strings.HasPrefix(expr[i+1:], "^") {
+					negated = true
+					i++
+				}
+				// A ] straight after the opening bracket stands for itself.
+				if strings.HasPrefix(expr[i+1:], "]") {
+					i++
+				}
+			}
+		case ']':
+			inClass, negated = false, false
+		}
+	}
+	return false
+}
+
+// bufferRegexp returns the regexp with which to match the multi-line regexp re against a whole
+// buffer: re in multi-line mode, so that ^ and $ match at the start and end of each line, as they do
+// when matching other regexps one line at a time.
+func bufferRegexp(re *regexp.Regexp) *regexp.Regexp {
+	return regexp.MustCompile("(?m)" + re.String())
+}
+
+// sFlagRE matches a flag group setting the s flag, such as (?s) or (?is:...).
+var sFlagRE = regexp.MustCompile(`\(\?[imU]*s[imsU]*(-[imsU]*)?[:)]`)
+
+// replaceRegexp replaces all matches for re in the buffer, or in the selection if there is one, with
+// replacement, as Regexp.ReplaceAllString does. Unless re is multi-line (see isMultilineRegexp),
+// it is applied to each line separately, and leaves line breaks alone.
 func (w *window) replaceRegexp(re *regexp.Regexp, replacement string) {
 	if w.formatPending {
 		return
 	}
+	if isMultilineRegexp(re) {
+		w.replaceMultilineRegexp(re, replacement)
+		return
+	}
 	var lines []string
 	// Process only the lines within the selection Y bounds.
 	if w.selection.Set {
@@ -434,8 +495,7 @@ func (w *window) replaceRegexp(re *regexp.Regexp, replacement string) {
 			begin = buffer.ByteIndexForChar(line, w.selection.Begin.X)
 		}
 		end := len(line)
-		// Prevent the regexp from removing the newlines.
-		// TODO: this should change if/when regexps can be applied across line boundaries.
+		// Prevent the regexp from removing the newlines; only multi-line regexps may do that.
 		if strings.HasSuffix(line, "\n") {
 			end--
 		}
@@ -446,10 +506,9 @@ func (w *window) replaceRegexp(re *regexp.Regexp, replacement string) {
 		if newLine := re.ReplaceAllString(oldLine, replacement); newLine != oldLine {
 			if !changed {
 				w.takeSnapshot()
-				w.highlighter.Invalidate(i)
 			}
 			changed = true
-			w.wrappedBuf.ReplaceLine(i, line[:begin]+newLine+line[end:])
+			w.edit(change{At: point{X: buffer.CharCount(line[:begin]), Y: i}, Removed: oldLine, Inserted: newLine})
 			// We only need to adjust the selection in its final line, and then only at the bottom-right
 			// end. The rest of it is guaranteed to stay in place, regardless of which replacements are
 			// made, since newlines cannot be taken out and the replacement doesn't touch anything
@@ -463,6 +522,42 @@ func (w *window) replaceRegexp(re *regexp.Regexp, replacement string) {
 	}
 }
 
+func (w *window) replaceMultilineRegexp(re *regexp.Regexp, replacement string) {
+	region := textRange{End: posAfterInsertion(point{}, bufferText(w.buf))}
+	if w.selection.Set {
+		region = w.selection.textRange
+	}
+	text := string(w.buf.CopyRange(region))
+	re = bufferRegexp(re)
+	matches := re.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return
+	}
+	// Find where each match starts, carrying on from the previous one.
+	starts := make([]point, len(matches))
+	pos, off := region.Begin, 0
+	for i, loc := range matches {
+		pos, off = posAfterInsertion(pos, text[off:loc[0]]), loc[0]
+		starts[i] = pos
+	}
+	w.takeSnapshot()
+	// Replace the last match first, so that the positions of the others stay valid.
+	for i := len(matches) - 1; i >= 0; i-- {
+		loc := matches[i]
+		w.edit(change{
+			At:       starts[i],
+			Removed:  text[loc[0]:loc[1]],
+			Inserted: string(re.ExpandString(nil, replacement, text, loc)),
+		})
+	}
+	if w.selection.Set {
+		w.selection.End = posAfterInsertion(region.Begin, re.ReplaceAllString(text, replacement))
+	}
+	w.roundCursorPos()
+	w.notifyChange()
+	w.needsRedraw = true
+}
+
 func (w *window) displayLenChar(char string) int {
 	if char == "\t" {
 		return w.app.config.TabWidth
@@ -515,6 +610,10 @@ func (w *window) typeText(text string) {
 	if w.formatPending {
 		return
 	}
+	if len(w.extraCursors) > 0 {
+		w.typeTextAtCursors(text)
+		return
+	}
 	if w.selection.Set {
 		// This already takes a snapshot, since it's callable by itself.
 		w.backspace()
@@ -526,21 +625,16 @@ func (w *window) typeText(text string) {
 	switch text[0] {
 	case '\r':
 		indent := leadingIndentation(w.buf.Line(tp.Y))
-		w.wrappedBuf.InsertLineBreak(tp)
-		w.wrappedBuf.Insert(indent, buffer.Point{Y: tp.Y + 1, X: 0})
-		w.updateWrapWidth()
+		w.insert("\n"+indent, tp)
 		w.moveCursorDown() // Needed to ensure scrolling if necessary
 		w.cursorPos = w.textCoordsToWindowCoords(point{X: len(indent), Y: tp.Y + 1})
 	case '\t':
-		w.wrappedBuf.Insert(w.tabString, tp)
-		w.updateWrapWidth()
+		w.insert(w.tabString, tp)
 		w.moveCursorRightBy(len(w.tabString))
 	default:
-		w.wrappedBuf.Insert(text, tp)
-		w.updateWrapWidth()
+		w.insert(text, tp)
 		w.moveCursorRight()
 	}
-	w.highlighter.Invalidate(tp.Y)
 	w.notifyChange()
 }
 
@@ -548,14 +642,16 @@ func (w *window) backspace() {
 	if w.formatPending {
 		return
 	}
+	if len(w.extraCursors) > 0 {
+		w.backspaceAtCursors()
+		return
+	}
 	if w.selection.Set || w.cursorPos.X > 0 || w.cursorPos.Y > 0 {
 		w.takeSnapshot()
 		w.needsRedraw = true
 	}
 	if w.selection.Set {
-		w.wrappedBuf.DeleteRange(w.selection.textRange)
-		w.highlighter.Invalidate(w.selection.Begin.Y)
-		w.updateWrapWidth()
+		w.deleteRange(w.selection.textRange)
 		w.gotoTextPos(w.selection.Begin)
 		w.selection = optionalTextRange{}
 		w.notifyChange()
@@ -566,19 +662,17 @@ func (w *window) backspace() {
 		newX = w.displayLen(w.wrappedBuf.Line(w.cursorPos.Y - 1).Text)
 	}
 	tp := w.windowCoordsToTextCoords(w.cursorPos)
-	w.wrappedBuf.DeleteChar(tp)
-	w.notifyChange()
-	w.updateWrapWidth()
 	switch {
 	case tp.X > 0:
+		w.deleteRange(textRange{Begin: point{X: tp.X - 1, Y: tp.Y}, End: tp})
 		w.gotoTextPos(point{Y: tp.Y, X: tp.X - 1})
-		w.highlighter.Invalidate(tp.Y)
 	case tp.Y > 0:
-		w.highlighter.Invalidate(tp.Y - 1)
+		w.deleteRange(textRange{Begin: point{X: buffer.CharCount(w.buf.Line(tp.Y - 1)), Y: tp.Y - 1}, End: tp})
 		w.moveCursorUp()
 		w.cursorPos.X = newX
 		w.roundCursorPos()
 	}
+	w.notifyChange()
 }
 
 func (w *window) gotoTextPos(tp point) {
@@ -621,6 +715,8 @@ func (w *window) resetSelectionState() {
 	w.clearSelection()
 	w.selectionAnchor = optionalPoint{}
 	w.mouseSelectionAnchor = optionalPoint{}
+	w.blockAnchor = optionalPoint{}
+	w.mouseBlockAnchor = optionalPoint{}
 }
 
 func (w *window) clearSelection() {
@@ -631,13 +727,21 @@ func (w *window) clearSelection() {
 }
 
 func (w *window) copySelection() {
+	if len(w.extraCursors) > 0 {
+		if w.anySelection() {
+			data := w.selectedTextAtCursors()
+			w.app.copiedBlock = data
+			go clipboard.Copy(data)
+		}
+		return
+	}
 	if w.selection.Set {
 		go clipboard.Copy(w.buf.CopyRange(w.selection.textRange))
 	}
 }
 
 func (w *window) cutSelection() {
-	if w.selection.Set && !w.formatPending {
+	if w.anySelection() && !w.formatPending {
 		w.copySelection()
 		w.backspace()
 	}
@@ -651,6 +755,10 @@ func (w *window) paste() {
 	if err != nil {
 		return
 	}
+	if len(w.extraCursors) == 0 && w.app.copiedBlock != nil && bytes.Equal(data, w.app.copiedBlock) {
+		w.insertBlock(strings.Split(string(data), "\n"))
+		return
+	}
 	w.insertText(data)
 }
 
@@ -658,6 +766,19 @@ func (w *window) insertText(data []byte) {
 	if w.formatPending || len(data) == 0 {
 		return
 	}
+	if len(w.extraCursors) > 0 {
+		// Text with a line for each cursor, as copied from them, goes back to them one line each.
+		text := string(data)
+		lines := strings.Split(text, "\n")
+		oneEach := len(lines) == len(w.extraCursors)+1
+		w.replaceAtCursors(func(i int, _ point) string {
+			if oneEach {
+				return lines[i]
+			}
+			return text
+		})
+		return
+	}
 	// backspace() already takes a snapshot, so in that case, we don't have to.
 	if w.selection.Set {
 		w.backspace()
@@ -666,9 +787,7 @@ func (w *window) insertText(data []byte) {
 	}
 	s := string(data)
 	tp := w.windowCoordsToTextCoords(w.cursorPos)
-	w.wrappedBuf.Insert(s, tp)
-	w.highlighter.Invalidate(tp.Y)
-	w.updateWrapWidth()
+	w.insert(s, tp)
 	w.gotoTextPos(posAfterInsertion(tp, s))
 	w.needsRedraw = true
 	w.notifyChange()
@@ -688,30 +807,20 @@ func posAfterInsertion(tp point, data string) point {
 	return tp
 }
 
-func (w *window) undo()    { w.undoSince(len(w.undoStack) - 1) }
-func (w *window) undoAll() { w.undoSince(0) }
-
-// undoSince reverts all changes made since the i-th snapshot.
-func (w *window) undoSince(i int) {
-	if w.formatPending || len(w.undoStack) == 0 {
-		return
-	}
-	oldState := w.undoStack[i]
-	w.undoStack = w.undoStack[:i]
-	w.buf = oldState.content
-	w.wrappedBuf.Reset(w.buf)
-	w.highlighter.Invalidate(0)
-	w.selection = oldState.selection
-	w.cursorPos = oldState.cursorPos
-	w.notifyChange()
-	w.needsRedraw = true
-}
-
 func (w *window) handleMouseEvent(ev termesc.MouseEvent) {
 	const doubleClickInterval = time.Second / 2
 
 	switch ev.Button {
 	case termesc.LeftButton:
+		if ev.Alt && !ev.Move {
+			// This either starts a block selection, or, if the mouse isn't dragged, toggles a cursor.
+			w.mouseBlockAnchor.Put(w.textPosFromMouse(ev))
+			return
+		}
+		if ev.Move && w.mouseBlockAnchor.Set {
+			w.selectBlock(w.mouseBlockAnchor.point, w.textPosFromMouse(ev))
+			return
+		}
 		if ev.Move {
 			if w.lastMouseLeftPress.when.After(w.lastMouseRelease.when) {
 				w.lastMouseLeftPress.isDrag = true
@@ -746,6 +855,15 @@ func (w *window) handleMouseEvent(ev termesc.MouseEvent) {
 			w.lastMouseLeftPress.put(ev)
 		}
 	case termesc.ReleaseButton:
+		if w.mouseBlockAnchor.Set {
+			if tp := w.textPosFromMouse(ev); tp == w.mouseBlockAnchor.point {
+				w.toggleCursorAt(tp)
+			} else {
+				w.selectBlock(w.mouseBlockAnchor.point, tp)
+			}
+			w.mouseBlockAnchor = optionalPoint{}
+			return
+		}
 		tpNew := w.textPosFromMouse(ev)
 		w.cursorPos = w.textCoordsToWindowCoords(tpNew)
 		didSelectWord := false
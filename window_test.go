@@ -7,6 +7,7 @@ import (
 	"github.com/dpinela/mflg/internal/highlight"
 	"github.com/dpinela/mflg/internal/termesc"
 
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -663,6 +664,73 @@ func TestReplaceInSelection(t *testing.T) {
 		checkSelection(t, 2, w, optionalTextRange{newSelection, true})*/
 }
 
+func TestMultilineReplace(t *testing.T) {
+	w := newTestWindow(t, 20, 10, "a\n\nb\n\n\nc")
+	w.cursorPos = point{X: 0, Y: 5}
+	w.replaceRegexp(regexp.MustCompile(`\n\n+`), "\n")
+	checkBufContent(t, w.buf, "a\nb\nc")
+	w.undo()
+	checkBufContent(t, w.buf, "a\n\nb\n\n\nc")
+
+	w = newTestWindow(t, 20, 10, "func A() {\n}\n\nfunc B() {\n}\n\nfunc C() {\n}")
+	w.selection.Put(buffer.Range{point{0, 1}, point{4, 3}})
+	w.replaceRegexp(regexp.MustCompile(`(?s)\}.*func`), "} func")
+	checkBufContent(t, w.buf, "func A() {\n} func B() {\n}\n\nfunc C() {\n}")
+	checkSelection(t, 1, w, optionalTextRange{buffer.Range{point{0, 1}, point{6, 1}}, true})
+
+	// ^ and $ still match at the start and end of each line.
+	w = newTestWindow(t, 20, 10, "a\nb\n\nc")
+	w.replaceRegexp(regexp.MustCompile(`^(\w)\n`), "$1,")
+	checkBufContent(t, w.buf, "a,b,\nc")
+	w = newTestWindow(t, 20, 10, "a\nb\n\nc")
+	w.replaceRegexp(regexp.MustCompile(`(?s)\w$.`), "x")
+	checkBufContent(t, w.buf, "xx\nc")
+}
+
+func TestMultilineSearch(t *testing.T) {
+	w := newTestWindow(t, 20, 10, "func A() {\n}\nvar x\n\nfunc B() {\n}\n\nfunc C() {\n}")
+	re := regexp.MustCompile(`\}\n\nfunc`)
+	w.searchRegexp(re, 0)
+	checkCursorPos(t, 1, w, point{X: 0, Y: 5})
+	checkSelection(t, 1, w, optionalTextRange{buffer.Range{point{0, 5}, point{4, 7}}, true})
+	w.searchRegexp(re, 6)
+	checkCursorPos(t, 2, w, point{X: 0, Y: 5})
+
+	w = newTestWindow(t, 20, 10, "é\n\nü\n\n\nx")
+	want := []textRange{{Begin: point{X: 1, Y: 0}, End: point{X: 0, Y: 2}}, {Begin: point{X: 1, Y: 2}, End: point{X: 0, Y: 5}}}
+	if got := w.allMatches(regexp.MustCompile(`\n\n+`)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got matches %v, want %v", got, want)
+	}
+}
+
+func TestIsMultilineRegexp(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		want bool
+	}{
+		{`func \w+`, false},
+		{`a\s+b`, false},
+		{`[^x]`, false},
+		{`\\n`, false},
+		{`a\nb`, true},
+		{"a\nb", true},
+		{`(?s)a.b`, true},
+		{`(?is:a.b)`, true},
+		{`(?i)a.b`, false},
+		{`^foo[^\n]*`, false},
+		{"[^\n]", false},
+		{`[^]\n]`, false},
+		{`[^[:space:]\n]+`, false},
+		{`[^\n]\n`, true},
+		{`[a\n]`, true},
+		{`[]\n]`, true},
+	} {
+		if got := isMultilineRegexp(regexp.MustCompile(tt.expr)); got != tt.want {
+			t.Errorf("isMultilineRegexp(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
 const (
 	undoneText1 = "boom!"
 	undoneText2 = " HO! HO! HO!"
@@ -682,6 +750,18 @@ func TestUndo(t *testing.T) {
 	checkCursorPos(t, 3, w, point{X: 0, Y: 0})
 }
 
+func TestUndoAfterResize(t *testing.T) {
+	w := newTestWindowEmpty(t)
+	typeStringsWithPause(w, strings.Repeat("x", 30), "y")
+	w.resize(10, 20)
+	w.undo()
+	checkLineContent(t, 1, w, 0, strings.Repeat("x", 30))
+	checkCursorPos(t, 1, w, w.textCoordsToWindowCoords(point{X: 30, Y: 0}))
+	if got := w.windowCoordsToTextCoords(w.cursorPos); got != (point{X: 30, Y: 0}) {
+		t.Errorf("after undoing in a narrower window, cursor at text position %v, want (30, 0)", got)
+	}
+}
+
 func TestUndoAll(t *testing.T) {
 	w := newTestWindow(t, 20, 10, shortTestDocument)
 	typeStringsWithPause(w, undoneText1, undoneText2)
@@ -707,13 +787,13 @@ func TestUndoWithSelection(t *testing.T) {
 	w := newTestWindow(t, 20, 10, shortTestDocument)
 	selectionEnd := point{9, 1}
 	selection := buffer.Range{point{4, 0}, selectionEnd}
-	w.cursorPos = selectionEnd
+	w.gotoTextPos(selectionEnd)
 	w.selection.Put(selection)
 	w.typeText("B")
 	w.undo()
 	checkLineContent(t, 1, w, 0, "func A() int { return 4 }")
 	checkLineContent(t, 1, w, 1, "func Go() int { return 5 }")
-	checkCursorPos(t, 1, w, selectionEnd)
+	checkCursorPos(t, 1, w, w.textCoordsToWindowCoords(selectionEnd))
 	checkSelection(t, 1, w, optionalTextRange{Set: true, textRange: selection})
 }
 
@@ -726,3 +806,276 @@ func TestUndoNothing(t *testing.T) {
 	checkLineContent(t, 1, w, 1, "func Go() int { return 5 }")
 	checkCursorPos(t, 1, w, p)
 }
+
+func TestRedo(t *testing.T) {
+	w := newTestWindowEmpty(t)
+	typeStringsWithPause(w, undoneText1, undoneText2)
+	w.undo()
+	w.undo()
+	checkLineContent(t, 1, w, 0, "")
+	w.redo()
+	checkLineContent(t, 2, w, 0, undoneText1)
+	checkCursorPos(t, 2, w, point{X: len(undoneText1), Y: 0})
+	w.redo()
+	checkLineContent(t, 3, w, 0, undoneText1+undoneText2)
+	checkCursorPos(t, 3, w, point{X: len(undoneText1) + len(undoneText2), Y: 0})
+	// There is nothing left to redo.
+	w.redo()
+	checkLineContent(t, 4, w, 0, undoneText1+undoneText2)
+	w.undo()
+	checkLineContent(t, 5, w, 0, undoneText1)
+}
+
+func TestRedoAfterUndoAll(t *testing.T) {
+	w := newTestWindow(t, 20, 10, shortTestDocument)
+	typeStringsWithPause(w, undoneText1, "\r", undoneText2)
+	w.undoAll()
+	checkBufContent(t, w.buf, shortTestDocument)
+	for i := 0; i < 3; i++ {
+		w.redo()
+	}
+	checkBufContent(t, w.buf, undoneText1+"\n"+undoneText2+shortTestDocument)
+}
+
+func TestEditDiscardsRedo(t *testing.T) {
+	w := newTestWindowEmpty(t)
+	typeStringsWithPause(w, undoneText1, undoneText2)
+	w.undo()
+	typeString(w, "!")
+	w.redo()
+	checkLineContent(t, 1, w, 0, undoneText1+"!")
+	w.undo()
+	checkLineContent(t, 2, w, 0, undoneText1)
+	// The undone step is still in the history, before the edit.
+	w.undo()
+	checkLineContent(t, 3, w, 0, undoneText1+undoneText2)
+	w.undo()
+	checkLineContent(t, 4, w, 0, undoneText1)
+}
+
+func TestUndoMultilineEdits(t *testing.T) {
+	w := newTestWindowA(t)
+	w.selection.Put(textRange{point{3, 0}, point{4, 4}})
+	w.typeText("X")
+	w.cursorPos = point{0, 1}
+	w.backspace()
+	w.undo()
+	checkBufContent(t, w.buf, testDocument)
+	w.redo()
+	checkLineContent(t, 1, w, 0, "#loX consectetur(adìpiscing, elit vestibulum) {"+line5)
+}
+
+func TestUndoReplaceContent(t *testing.T) {
+	w := newTestWindowA(t)
+	typeString(w, "abc")
+	formatted := buffer.New()
+	formatted.ReadFrom(strings.NewReader(strings.Replace(testDocument, "sit", "SIT", -1)))
+	if !w.replaceContent(formatted) {
+		t.Fatal("replaceContent reported no change")
+	}
+	typeString(w, "def")
+	w.undo()
+	checkBufContent(t, w.buf, strings.Replace(testDocument, "sit", "SIT", -1))
+	w.undo()
+	checkBufContent(t, w.buf, "abc"+testDocument)
+	w.redo()
+	checkBufContent(t, w.buf, strings.Replace(testDocument, "sit", "SIT", -1))
+	if w.replaceContent(formatted) {
+		t.Error("replaceContent with identical content reported a change")
+	}
+}
+
+func checkDiagnosticRange(t *testing.T, stepN int, w *window, i int, want textRange) {
+	t.Helper()
+	if got := w.diagnostics[i].Range; got != want {
+		t.Errorf("step %d: diagnostic %d covers %v, want %v", stepN, i, got, want)
+	}
+}
+
+func TestDiagnosticsFollowEdits(t *testing.T) {
+	w := newTestWindowA(t)
+	// "sit" in "dolor sit[10];" and "sapien" in the line with "tincidunt"
+	w.setDiagnostics([]diagnostic{
+		{Range: textRange{Begin: point{X: 7, Y: 5}, End: point{X: 16, Y: 5}}, Message: "second"},
+		{Range: textRange{Begin: point{X: 6, Y: 2}, End: point{X: 9, Y: 2}}, Message: "first"},
+	})
+	if w.diagnostics[0].Message != "first" {
+		t.Fatalf("diagnostics not sorted: %v", w.diagnostics)
+	}
+	w.cursorPos = point{X: 0, Y: 2}
+	typeString(w, "xy")
+	checkDiagnosticRange(t, 1, w, 0, textRange{Begin: point{X: 8, Y: 2}, End: point{X: 11, Y: 2}})
+	checkDiagnosticRange(t, 1, w, 1, textRange{Begin: point{X: 7, Y: 5}, End: point{X: 16, Y: 5}})
+	time.Sleep(2 * time.Millisecond)
+	w.cursorPos = point{X: 0, Y: 1}
+	w.insertText([]byte("\n\n"))
+	checkDiagnosticRange(t, 2, w, 0, textRange{Begin: point{X: 8, Y: 4}, End: point{X: 11, Y: 4}})
+	checkDiagnosticRange(t, 2, w, 1, textRange{Begin: point{X: 7, Y: 7}, End: point{X: 16, Y: 7}})
+	w.undo()
+	checkDiagnosticRange(t, 3, w, 0, textRange{Begin: point{X: 8, Y: 2}, End: point{X: 11, Y: 2}})
+	// Deleting part of a diagnostic's range shrinks it.
+	w.selection.Put(textRange{Begin: point{X: 0, Y: 2}, End: point{X: 9, Y: 2}})
+	w.backspace()
+	checkDiagnosticRange(t, 4, w, 0, textRange{Begin: point{X: 0, Y: 2}, End: point{X: 2, Y: 2}})
+	if d := w.diagnosticAt(point{X: 9, Y: 5}); d == nil || d.Message != "second" {
+		t.Errorf("diagnosticAt(9, 5) = %v, want the second diagnostic", d)
+	}
+	if d := w.diagnosticAt(point{X: 0, Y: 0}); d != nil {
+		t.Errorf("diagnosticAt(0, 0) = %v, want nil", d)
+	}
+}
+
+func checkExtraCursors(t *testing.T, stepN int, w *window, want ...point) {
+	t.Helper()
+	var got []point
+	for _, c := range w.extraCursors {
+		got = append(got, c.pos)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("step %d: extra cursors at %v, want %v", stepN, got, want)
+	}
+}
+
+func TestMultipleCursorsAtOccurrences(t *testing.T) {
+	w := newTestWindow(t, 20, 10, "foo bar\nfoo baz\n  foo\n")
+	w.addCursorAtNextOccurrence()
+	checkSelection(t, 1, w, optionalTextRange{buffer.Range{point{0, 0}, point{3, 0}}, true})
+	w.addCursorAtNextOccurrence()
+	w.addCursorAtNextOccurrence()
+	checkCursorPos(t, 2, w, point{2, 2})
+	checkExtraCursors(t, 2, w, point{0, 0}, point{0, 1})
+	w.addCursorAtNextOccurrence()
+	checkExtraCursors(t, 3, w, point{0, 0}, point{0, 1})
+	if want := "No more occurrences"; w.app.note != want {
+		t.Errorf("notification is %q, want %q", w.app.note, want)
+	}
+	typeString(w, "qu")
+	checkBufContent(t, w.buf, "qu bar\nqu baz\n  qu\n")
+	checkCursorPos(t, 4, w, point{4, 2})
+	checkExtraCursors(t, 4, w, point{2, 0}, point{2, 1})
+	w.backspace()
+	w.insertText([]byte("ux\n"))
+	checkBufContent(t, w.buf, "qux\n bar\nqux\n baz\n  qux\n\n")
+	checkExtraCursors(t, 5, w, point{0, 1}, point{0, 3})
+	w.backspace()
+	checkBufContent(t, w.buf, "qux bar\nqux baz\n  qux\n")
+	w.undo()
+	checkBufContent(t, w.buf, "foo bar\nfoo baz\n  foo\n")
+}
+
+func TestMultipleCursorsFromMouseAndLines(t *testing.T) {
+	w := newTestWindow(t, 20, 10, "ab\ncd\nef\n")
+	gw := w.gutterWidth()
+	w.handleMouseEvent(termesc.MouseEvent{Button: termesc.LeftButton, Alt: true, X: gw + 1, Y: 1})
+	w.handleMouseEvent(termesc.MouseEvent{Button: termesc.ReleaseButton, Alt: true, X: gw + 1, Y: 1})
+	checkCursorPos(t, 1, w, point{1, 1})
+	checkExtraCursors(t, 1, w, point{0, 0})
+	typeString(w, "\r")
+	checkBufContent(t, w.buf, "\nab\nc\nd\nef\n")
+	w.undo()
+	// Clicking on a cursor again removes it.
+	w.handleMouseEvent(termesc.MouseEvent{Button: termesc.LeftButton, Alt: true, X: gw, Y: 0})
+	w.handleMouseEvent(termesc.MouseEvent{Button: termesc.ReleaseButton, Alt: true, X: gw, Y: 0})
+	checkExtraCursors(t, 2, w)
+
+	w.selection.Put(buffer.Range{point{1, 0}, point{0, 2}})
+	w.addCursorsToSelectedLines()
+	checkExtraCursors(t, 3, w, point{2, 0})
+	checkCursorPos(t, 3, w, point{2, 1})
+	checkSelection(t, 3, w, optionalTextRange{})
+	typeString(w, ";")
+	checkBufContent(t, w.buf, "ab;\ncd;\nef\n")
+}
+
+func TestBlockSelection(t *testing.T) {
+	w := newTestWindow(t, 40, 10, "0123456\n01\n\tab\n世界ab\n")
+	w.selectBlock(point{1, 0}, point{2, 3})
+	checkCursorPos(t, 1, w, point{4, 3})
+	checkSelection(t, 1, w, optionalTextRange{buffer.Range{point{1, 3}, point{2, 3}}, true})
+	checkExtraCursors(t, 1, w, point{4, 0}, point{2, 1}, point{1, 2})
+	if got, want := string(w.selectedTextAtCursors()), "123\n1\n\n界"; got != want {
+		t.Errorf("block text is %q, want %q", got, want)
+	}
+	w.backspace()
+	checkBufContent(t, w.buf, "0456\n0\n\tab\n世ab\n")
+	typeString(w, "|")
+	checkBufContent(t, w.buf, "0|456\n0|\n\t|ab\n世|ab\n")
+	w.insertText([]byte("A\nB\nC\nD"))
+	checkBufContent(t, w.buf, "0|A456\n0|B\n\t|Cab\n世|Dab\n")
+	w.undo()
+	checkBufContent(t, w.buf, "0123456\n01\n\tab\n世界ab\n")
+}
+
+func TestBlockSelectionByKeyboardAndMouse(t *testing.T) {
+	w := newTestWindow(t, 40, 10, "abc\ndef\nghi\n")
+	w.cursorPos = point{1, 0}
+	w.markBlockBound()
+	w.cursorPos = point{3, 1}
+	w.markBlockBound()
+	checkSelection(t, 1, w, optionalTextRange{buffer.Range{point{1, 1}, point{3, 1}}, true})
+	checkExtraCursors(t, 1, w, point{3, 0})
+
+	w.resetSelectionState()
+	w.clearExtraCursors()
+	gw := w.gutterWidth()
+	w.handleMouseEvent(termesc.MouseEvent{Button: termesc.LeftButton, Alt: true, X: gw + 2, Y: 2})
+	w.handleMouseEvent(termesc.MouseEvent{Button: termesc.LeftButton, Alt: true, Move: true, X: gw + 1, Y: 1})
+	w.handleMouseEvent(termesc.MouseEvent{Button: termesc.ReleaseButton, Alt: true, X: gw, Y: 0})
+	checkCursorPos(t, 2, w, point{2, 0})
+	checkSelection(t, 2, w, optionalTextRange{buffer.Range{point{0, 0}, point{2, 0}}, true})
+	checkExtraCursors(t, 2, w, point{2, 1}, point{2, 2})
+	w.cutSelection()
+	checkBufContent(t, w.buf, "c\nf\ni\n")
+}
+
+func TestInsertBlock(t *testing.T) {
+	w := newTestWindow(t, 40, 10, "ab\ncd\n")
+	w.cursorPos = point{1, 0}
+	w.insertBlock([]string{"X", "Y", "Z", "W"})
+	checkBufContent(t, w.buf, "aXb\ncYd\n Z\n W")
+	checkCursorPos(t, 1, w, point{2, 0})
+	w.undo()
+	checkBufContent(t, w.buf, "ab\ncd\n")
+}
+
+func TestHistoryStates(t *testing.T) {
+	w := newTestWindow(t, 20, 10, "a\n")
+	typeStringsWithPause(w, "1", "2", "3")
+	w.undo()
+	w.undo()
+	checkBufContent(t, w.buf, "1a\n")
+	// Going back to the start keeps the undone states.
+	w.gotoHistoryState(0)
+	checkBufContent(t, w.buf, "a\n")
+	steps, current := w.historySteps()
+	if len(steps) != 5 || current != 5 {
+		t.Fatalf("after going to the start, history has %d steps and current state %d, want 5 and 5", len(steps), current)
+	}
+	w.gotoHistoryState(3)
+	checkBufContent(t, w.buf, "123a\n")
+	checkCursorPos(t, 1, w, point{3, 0})
+	w.undo()
+	checkBufContent(t, w.buf, "a\n")
+	w.undo()
+	checkBufContent(t, w.buf, "1a\n")
+	w.redo()
+	w.redo()
+	w.gotoHistoryState(2)
+	checkBufContent(t, w.buf, "12a\n")
+}
+
+func TestDescribeSnapshot(t *testing.T) {
+	when := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, tt := range []struct {
+		s    snapshot
+		want string
+	}{
+		{snapshot{Time: when, Changes: []change{{At: point{2, 4}, Inserted: "xy"}}}, "Mar  4 05:06:07  line 5, +2 -0 bytes"},
+		{snapshot{Time: when, Changes: []change{{At: point{0, 1}, Removed: "ab\ncd\n", Inserted: "e"}, {At: point{0, 0}, Inserted: "f"}}}, "Mar  4 05:06:07  lines 1-4, +2 -6 bytes"},
+		{snapshot{}, "(unknown time)  no changes"},
+	} {
+		if got := describeSnapshot(tt.s); got != tt.want {
+			t.Errorf("describeSnapshot(%v) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}